@@ -0,0 +1,144 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+	ActionAll    = "*"
+
+	TypeRepository = "repository"
+	TypeRegistry   = "registry"
+
+	// CatalogName is the resource name for accessing the repository catalog.
+	CatalogName = "catalog"
+)
+
+// Access describes a set of actions on a resource as defined by the Docker registry token authentication
+// specification.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// ParseScope parses a space-separated list of scopes of the form 'type:name:action1,action2'.
+func ParseScope(s string) ([]Access, error) {
+	var res []Access
+	for _, scope := range strings.Fields(s) {
+		// the name part might contain a colon, e.g. when it includes a registry port.
+		i := strings.Index(scope, ":")
+		j := strings.LastIndex(scope, ":")
+		if i == -1 || i == j {
+			return nil, fmt.Errorf("malformed scope %q", scope)
+		}
+		a := Access{
+			Type: scope[:i],
+			Name: scope[i+1 : j],
+		}
+		if a.Type == "" || a.Name == "" {
+			return nil, fmt.Errorf("malformed scope %q", scope)
+		}
+		for _, action := range strings.Split(scope[j+1:], ",") {
+			if action != "" {
+				a.Actions = append(a.Actions, action)
+			}
+		}
+		res = append(res, a)
+	}
+
+	return res, nil
+}
+
+func (a Access) String() string {
+	return fmt.Sprintf("%s:%s:%s", a.Type, a.Name, strings.Join(a.Actions, ","))
+}
+
+// Allows reports whether the access includes the given action on the resource.
+func (a Access) Allows(typ, name, action string) bool {
+	if a.Type != typ || a.Name != name {
+		return false
+	}
+	for _, act := range a.Actions {
+		if act == action || act == ActionAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether the granted access includes all actions of the requested access.
+func Covers(granted []Access, requested []Access) bool {
+	for _, req := range requested {
+		for _, action := range req.Actions {
+			found := false
+			for _, g := range granted {
+				if g.Allows(req.Type, req.Name, action) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Authenticator verifies the credentials sent by a client.
+type Authenticator interface {
+	// Authenticate checks the value of a request's Authorization header and verifies that the credentials permit the
+	// requested access. It returns the name of the authenticated user.
+	Authenticate(header string, access []Access) (string, error)
+	// Challenge returns the value of the WWW-Authenticate header that is sent to the client when authentication
+	// failed with the given error.
+	Challenge(access []Access, err error) string
+}
+
+// PasswordVerifier verifies a user's password.
+type PasswordVerifier interface {
+	Verify(user, password string) bool
+}
+
+type ErrUnauthorized struct {
+	Err error
+}
+
+func (e ErrUnauthorized) Error() string {
+	return fmt.Sprintf("unauthorized: %s", e.Err)
+}
+
+// ErrInsufficientScope is returned when the credentials are valid but don't permit the requested access.
+type ErrInsufficientScope struct {
+	Err error
+}
+
+func (e ErrInsufficientScope) Error() string {
+	return fmt.Sprintf("insufficient scope: %s", e.Err)
+}
+
+// ParseBasicAuth extracts user name and password from the value of an Authorization header using the Basic scheme.
+func ParseBasicAuth(header string) (string, string, bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	dec, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok := strings.Cut(string(dec), ":")
+	if !ok {
+		return "", "", false
+	}
+	return user, pass, true
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		scope     string
+		expAccess []auth.Access
+		expErr    bool
+	}{
+		{
+			name:  "single scope",
+			scope: "repository:ns/repo:pull,push",
+			expAccess: []auth.Access{
+				{Type: "repository", Name: "ns/repo", Actions: []string{"pull", "push"}},
+			},
+		},
+		{
+			name:  "multiple scopes",
+			scope: "repository:ns/repo:pull registry:catalog:*",
+			expAccess: []auth.Access{
+				{Type: "repository", Name: "ns/repo", Actions: []string{"pull"}},
+				{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+			},
+		},
+		{
+			name:  "name with port",
+			scope: "repository:localhost:5000/ns/repo:pull",
+			expAccess: []auth.Access{
+				{Type: "repository", Name: "localhost:5000/ns/repo", Actions: []string{"pull"}},
+			},
+		},
+		{
+			name:   "missing actions",
+			scope:  "repository:ns/repo",
+			expErr: true,
+		},
+		{
+			name:   "missing name",
+			scope:  "repository::pull",
+			expErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			access, err := auth.ParseScope(tt.scope)
+			if tt.expErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(access).To(Equal(tt.expAccess))
+			if len(access) == 1 {
+				g.Expect(access[0].String()).To(Equal(tt.scope))
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	g := NewWithT(t)
+
+	granted := []auth.Access{
+		{Type: "repository", Name: "ns/repo", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "ns/all", Actions: []string{"*"}},
+	}
+
+	g.Expect(auth.Covers(granted, nil)).To(BeTrue())
+	g.Expect(auth.Covers(granted, []auth.Access{{Type: "repository", Name: "ns/repo", Actions: []string{"pull"}}})).To(BeTrue())
+	g.Expect(auth.Covers(granted, []auth.Access{{Type: "repository", Name: "ns/repo", Actions: []string{"push", "delete"}}})).To(BeFalse())
+	g.Expect(auth.Covers(granted, []auth.Access{{Type: "repository", Name: "ns/all", Actions: []string{"delete"}}})).To(BeTrue())
+	g.Expect(auth.Covers(granted, []auth.Access{{Type: "repository", Name: "ns/other", Actions: []string{"pull"}}})).To(BeFalse())
+	g.Expect(auth.Covers(granted, []auth.Access{{Type: "registry", Name: "ns/repo", Actions: []string{"pull"}}})).To(BeFalse())
+}
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	user, pass, ok := auth.ParseBasicAuth(basicAuth("alice", "s3cr:t"))
+	g.Expect(ok).To(BeTrue())
+	g.Expect(user).To(Equal("alice"))
+	g.Expect(pass).To(Equal("s3cr:t"))
+
+	_, _, ok = auth.ParseBasicAuth("Bearer foo")
+	g.Expect(ok).To(BeFalse())
+
+	_, _, ok = auth.ParseBasicAuth("Basic not-base64!")
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestHtpasswd(t *testing.T) {
+	g := NewWithT(t)
+
+	// The password for alice is "secret".
+	h, err := auth.ParseHtpasswd(strings.NewReader("# users\nalice:$2a$04$sCOj5Z24PjgEJu5ZhdAU8.09CnratC1BDbvv4uOFDHtR94y61HK8C\n\n"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(h.Verify("alice", "secret")).To(BeTrue())
+	g.Expect(h.Verify("alice", "wrong")).To(BeFalse())
+	g.Expect(h.Verify("bob", "secret")).To(BeFalse())
+
+	_, err = auth.ParseHtpasswd(strings.NewReader("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	g.Expect(err).To(MatchError(ContainSubstring("unsupported password hash")))
+}
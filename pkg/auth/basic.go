@@ -0,0 +1,63 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+)
+
+// BasicAuthenticator authenticates clients using HTTP Basic authentication. All authenticated users are granted
+// any access.
+type BasicAuthenticator struct {
+	realm string
+	users PasswordVerifier
+}
+
+var _ Authenticator = BasicAuthenticator{}
+
+func NewBasicAuthenticator(realm string, users PasswordVerifier) BasicAuthenticator {
+	return BasicAuthenticator{
+		realm: realm,
+		users: users,
+	}
+}
+
+func (ba BasicAuthenticator) Authenticate(header string, _ []Access) (string, error) {
+	user, pass, ok := ParseBasicAuth(header)
+	if !ok {
+		return "", ErrUnauthorized{Err: fmt.Errorf("no basic credentials provided")}
+	}
+
+	if !ba.users.Verify(user, pass) {
+		return "", ErrUnauthorized{Err: fmt.Errorf("invalid credentials for user %q", user)}
+	}
+
+	return user, nil
+}
+
+func (ba BasicAuthenticator) Challenge(_ []Access, _ error) string {
+	return fmt.Sprintf("Basic realm=%q", ba.realm)
+}
+
+// HtpasswdFile verifies passwords against an htpasswd file that is reloaded whenever it changes.
+type HtpasswdFile struct {
+	f *watchedFile[Htpasswd]
+}
+
+var _ PasswordVerifier = HtpasswdFile{}
+
+func NewHtpasswdFile(path string, log logr.Logger) (HtpasswdFile, error) {
+	f, err := newWatchedFile(path, LoadHtpasswd, log)
+	if err != nil {
+		return HtpasswdFile{}, err
+	}
+
+	return HtpasswdFile{f: f}, nil
+}
+
+func (h HtpasswdFile) Verify(user, password string) bool {
+	return h.f.get().Verify(user, password)
+}
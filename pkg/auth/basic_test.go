@@ -0,0 +1,72 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+)
+
+const (
+	// aliceEntry sets the password of alice to "secret".
+	aliceEntry = "alice:$2a$04$sCOj5Z24PjgEJu5ZhdAU8.09CnratC1BDbvv4uOFDHtR94y61HK8C\n"
+	// bobEntry sets the password of bob to "secret".
+	bobEntry = "bob:$2a$04$sCOj5Z24PjgEJu5ZhdAU8.09CnratC1BDbvv4uOFDHtR94y61HK8C\n"
+)
+
+func TestBasicAuthenticator(t *testing.T) {
+	g := NewWithT(t)
+
+	p := filepath.Join(t.TempDir(), "htpasswd")
+	g.Expect(os.WriteFile(p, []byte(aliceEntry), 0600)).To(Succeed())
+
+	users, err := auth.NewHtpasswdFile(p, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed loading htpasswd file")
+
+	ba := auth.NewBasicAuthenticator("garage", users)
+
+	g.Expect(ba.Challenge(nil, nil)).To(Equal(`Basic realm="garage"`))
+
+	user, err := ba.Authenticate(basicAuth("alice", "secret"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(user).To(Equal("alice"))
+
+	_, err = ba.Authenticate(basicAuth("alice", "wrong"), nil)
+	g.Expect(isUnauthorized(err)).To(BeTrue(), "unexpected error: %v", err)
+
+	_, err = ba.Authenticate("", nil)
+	g.Expect(isUnauthorized(err)).To(BeTrue(), "unexpected error: %v", err)
+
+	// When the file changes
+
+	g.Expect(os.WriteFile(p, []byte(bobEntry), 0600)).To(Succeed())
+	g.Expect(os.Chtimes(p, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+
+	// Then
+
+	g.Eventually(func() error {
+		_, err := ba.Authenticate(basicAuth("bob", "secret"), nil)
+		return err
+	}, 3*time.Second, 100*time.Millisecond).Should(Succeed(), "htpasswd file should have been reloaded")
+	_, err = ba.Authenticate(basicAuth("alice", "secret"), nil)
+	g.Expect(isUnauthorized(err)).To(BeTrue(), "alice should have been removed: %v", err)
+
+	// When the file is broken
+
+	g.Expect(os.WriteFile(p, []byte("this is broken"), 0600)).To(Succeed())
+	g.Expect(os.Chtimes(p, time.Now(), time.Now().Add(2*time.Minute))).To(Succeed())
+	time.Sleep(1100 * time.Millisecond)
+
+	// Then
+
+	_, err = ba.Authenticate(basicAuth("bob", "secret"), nil)
+	g.Expect(err).NotTo(HaveOccurred(), "previous users should have been kept")
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when an unknown user tries to authenticate so that response times don't reveal which
+// users exist.
+const dummyHash = "$2a$10$xYBIVwbWxvlZen/hII3ie.MK3zj9cLDdYTlaMHnfNatpdZ73GuD5W"
+
+// Htpasswd maps user names to bcrypt password hashes.
+type Htpasswd map[string][]byte
+
+var _ PasswordVerifier = Htpasswd{}
+
+// ParseHtpasswd reads entries of the form 'user:hash' from r. Only bcrypt hashes are supported.
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	res := make(Htpasswd)
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("malformed entry in line %d", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("unsupported password hash for user %q in line %d: %w", user, lineNo, err)
+		}
+		res[user] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading htpasswd data: %w", err)
+	}
+
+	return res, nil
+}
+
+func LoadHtpasswd(path string) (Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening htpasswd file: %w", err)
+	}
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+func (h Htpasswd) Verify(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
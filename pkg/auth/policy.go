@@ -0,0 +1,179 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/go-logr/logr"
+	"go.yaml.in/yaml/v3"
+)
+
+// ActionList permits a user to see a repository in the catalog.
+const ActionList = "list"
+
+// AnyUser matches all users in a policy rule, including anonymous ones.
+const AnyUser = "*"
+
+var knownActions = map[string]bool{
+	ActionPull:   true,
+	ActionPush:   true,
+	ActionDelete: true,
+	ActionList:   true,
+	ActionAll:    true,
+}
+
+// Authorizer decides which access users are permitted.
+type Authorizer interface {
+	// Permitted returns the subset of the requested access that is permitted for user. The empty user name denotes
+	// an anonymous user.
+	Permitted(user string, access []Access) []Access
+}
+
+// Rule permits the users and members of the groups the given actions on all repositories whose name matches one of
+// the glob patterns in Repositories, e.g. 'team-a/*'.
+type Rule struct {
+	Users        []string `yaml:"users"`
+	Groups       []string `yaml:"groups"`
+	Repositories []string `yaml:"repositories"`
+	Actions      []string `yaml:"actions"`
+}
+
+// Policy maps users and groups to the actions they are permitted on repositories. Everything not permitted by a rule
+// is denied.
+type Policy struct {
+	Groups map[string][]string `yaml:"groups"`
+	Rules  []Rule              `yaml:"rules"`
+}
+
+var _ Authorizer = Policy{}
+
+// ParsePolicy reads a YAML-encoded policy from r.
+func ParsePolicy(r io.Reader) (Policy, error) {
+	var p Policy
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && err != io.EOF {
+		return Policy{}, fmt.Errorf("failed decoding policy: %w", err)
+	}
+
+	for idx, rule := range p.Rules {
+		for _, pattern := range rule.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return Policy{}, fmt.Errorf("invalid repository pattern %q in rule %d: %w", pattern, idx, err)
+			}
+		}
+		for _, action := range rule.Actions {
+			if !knownActions[action] {
+				return Policy{}, fmt.Errorf("unknown action %q in rule %d", action, idx)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func LoadPolicy(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Policy{}, fmt.Errorf("failed opening policy file: %w", err)
+	}
+	defer f.Close()
+
+	return ParsePolicy(f)
+}
+
+func (p Policy) Permitted(user string, access []Access) []Access {
+	res := make([]Access, 0, len(access))
+	for _, a := range access {
+		if a.Type != TypeRepository {
+			// access to registry-wide resources such as the catalog is filtered by the respective handler.
+			res = append(res, a)
+			continue
+		}
+
+		permitted := Access{
+			Type: a.Type,
+			Name: a.Name,
+		}
+		for _, action := range a.Actions {
+			if p.allows(user, a.Name, action) {
+				permitted.Actions = append(permitted.Actions, action)
+			}
+		}
+		if len(permitted.Actions) > 0 {
+			res = append(res, permitted)
+		}
+	}
+
+	return res
+}
+
+func (p Policy) allows(user, repo, action string) bool {
+	for _, rule := range p.Rules {
+		if !p.matchesUser(rule, user) {
+			continue
+		}
+		if !matchesAny(rule.Repositories, repo) {
+			continue
+		}
+		for _, a := range rule.Actions {
+			if a == action || a == ActionAll {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p Policy) matchesUser(rule Rule, user string) bool {
+	for _, u := range rule.Users {
+		if u == AnyUser || (u == user && user != "") {
+			return true
+		}
+	}
+	if user == "" {
+		return false
+	}
+	for _, g := range rule.Groups {
+		for _, member := range p.Groups[g] {
+			if member == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyFile is a Policy that is reloaded whenever the file it has been loaded from changes.
+type PolicyFile struct {
+	f *watchedFile[Policy]
+}
+
+var _ Authorizer = PolicyFile{}
+
+func NewPolicyFile(path string, log logr.Logger) (PolicyFile, error) {
+	f, err := newWatchedFile(path, LoadPolicy, log)
+	if err != nil {
+		return PolicyFile{}, err
+	}
+
+	return PolicyFile{f: f}, nil
+}
+
+func (pf PolicyFile) Permitted(user string, access []Access) []Access {
+	return pf.f.get().Permitted(user, access)
+}
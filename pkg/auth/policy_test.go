@@ -0,0 +1,129 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+)
+
+const testPolicy = `
+groups:
+  team-a: [alice]
+rules:
+  - groups: [team-a]
+    repositories: ["team-a/*"]
+    actions: ["*"]
+  - users: [bob]
+    repositories: ["team-a/*"]
+    actions: [pull]
+  - users: ["*"]
+    repositories: ["public/*"]
+    actions: [pull, list]
+`
+
+func repoAccess(name string, actions ...string) []auth.Access {
+	return []auth.Access{{Type: auth.TypeRepository, Name: name, Actions: actions}}
+}
+
+func TestPolicyPermitted(t *testing.T) {
+	p, err := auth.ParsePolicy(strings.NewReader(testPolicy))
+	NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed parsing policy")
+
+	tests := []struct {
+		name      string
+		user      string
+		requested []auth.Access
+		expected  []auth.Access
+	}{
+		{
+			name:      "group member gets all actions",
+			user:      "alice",
+			requested: repoAccess("team-a/app", "pull", "push", "delete"),
+			expected:  repoAccess("team-a/app", "pull", "push", "delete"),
+		},
+		{
+			name:      "user gets subset of requested actions",
+			user:      "bob",
+			requested: repoAccess("team-a/app", "pull", "push"),
+			expected:  repoAccess("team-a/app", "pull"),
+		},
+		{
+			name:      "pattern doesn't match nested repositories",
+			user:      "alice",
+			requested: repoAccess("team-a/nested/app", "pull"),
+			expected:  []auth.Access{},
+		},
+		{
+			name:      "anonymous user matches wildcard",
+			user:      "",
+			requested: repoAccess("public/app", "pull", "push"),
+			expected:  repoAccess("public/app", "pull"),
+		},
+		{
+			name:      "anonymous user isn't permitted anything else",
+			user:      "",
+			requested: repoAccess("team-a/app", "pull"),
+			expected:  []auth.Access{},
+		},
+		{
+			name:      "registry access is passed through",
+			user:      "",
+			requested: []auth.Access{{Type: auth.TypeRegistry, Name: auth.CatalogName, Actions: []string{"*"}}},
+			expected:  []auth.Access{{Type: auth.TypeRegistry, Name: auth.CatalogName, Actions: []string{"*"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(p.Permitted(tt.user, tt.requested)).To(Equal(tt.expected))
+		})
+	}
+}
+
+func TestParsePolicyFailsOnInvalidInput(t *testing.T) {
+	for name, in := range map[string]string{
+		"unknown action":  "rules:\n  - users: [alice]\n    repositories: [a/b]\n    actions: [fly]\n",
+		"invalid pattern": "rules:\n  - users: [alice]\n    repositories: [\"a/[\"]\n    actions: [pull]\n",
+		"unknown field":   "rulez: []\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := auth.ParsePolicy(strings.NewReader(in))
+			NewWithT(t).Expect(err).To(HaveOccurred())
+		})
+	}
+}
+
+func TestPolicyFileIsReloaded(t *testing.T) {
+	g := NewWithT(t)
+
+	p := filepath.Join(t.TempDir(), "policy.yaml")
+	g.Expect(os.WriteFile(p, []byte(testPolicy), 0600)).To(Succeed())
+
+	pf, err := auth.NewPolicyFile(p, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed loading policy file")
+
+	g.Expect(pf.Permitted("bob", repoAccess("team-a/app", "push"))).To(BeEmpty())
+
+	// When the file changes
+
+	g.Expect(os.WriteFile(p, []byte("rules:\n  - users: [bob]\n    repositories: [\"team-a/*\"]\n    actions: [push]\n"), 0600)).
+		To(Succeed())
+	g.Expect(os.Chtimes(p, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+
+	// Then
+
+	g.Eventually(func() []auth.Access {
+		return pf.Permitted("bob", repoAccess("team-a/app", "push"))
+	}, 3*time.Second, 100*time.Millisecond).Should(Equal(repoAccess("team-a/app", "push")), "policy file should have been reloaded")
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims of a registry token as defined by the Docker registry token authentication specification.
+type Claims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+}
+
+// TokenAuthenticator authenticates clients by verifying the bearer tokens they present.
+type TokenAuthenticator struct {
+	realm, service, issuer string
+	key                    crypto.PublicKey
+	methods                []string
+}
+
+var _ Authenticator = TokenAuthenticator{}
+
+// NewTokenAuthenticator creates an authenticator that accepts tokens issued by issuer for service and signed with the
+// private counterpart of key. Clients are referred to realm for obtaining a token.
+func NewTokenAuthenticator(realm, service, issuer string, key crypto.PublicKey) (TokenAuthenticator, error) {
+	methods, err := signingMethods(key)
+	if err != nil {
+		return TokenAuthenticator{}, err
+	}
+
+	ta := TokenAuthenticator{
+		realm:   realm,
+		service: service,
+		issuer:  issuer,
+		key:     key,
+	}
+	for _, m := range methods {
+		ta.methods = append(ta.methods, m.Alg())
+	}
+
+	return ta, nil
+}
+
+func (ta TokenAuthenticator) Authenticate(header string, access []Access) (string, error) {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ErrUnauthorized{Err: fmt.Errorf("no bearer token provided")}
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(header[len(prefix):], &claims, func(*jwt.Token) (interface{}, error) {
+		return ta.key, nil
+	},
+		jwt.WithValidMethods(ta.methods),
+		jwt.WithIssuer(ta.issuer),
+		jwt.WithAudience(ta.service),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", ErrUnauthorized{Err: fmt.Errorf("invalid token: %w", err)}
+	}
+
+	if !Covers(claims.Access, access) {
+		return "", ErrInsufficientScope{Err: fmt.Errorf("token doesn't grant the requested access")}
+	}
+
+	return claims.Subject, nil
+}
+
+func (ta TokenAuthenticator) Challenge(access []Access, err error) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Bearer realm=%q,service=%q", ta.realm, ta.service)
+
+	if len(access) > 0 {
+		scopes := make([]string, len(access))
+		for idx, a := range access {
+			scopes[idx] = a.String()
+		}
+		fmt.Fprintf(&sb, ",scope=%q", strings.Join(scopes, " "))
+	}
+
+	if errors.As(err, &ErrInsufficientScope{}) {
+		sb.WriteString(`,error="insufficient_scope"`)
+	}
+
+	return sb.String()
+}
+
+// TokenIssuer issues registry tokens to users authenticated by their password.
+type TokenIssuer struct {
+	issuer, service string
+	key             crypto.Signer
+	method          jwt.SigningMethod
+	ttl             time.Duration
+	users           PasswordVerifier
+}
+
+// NewTokenIssuer creates an issuer that signs tokens for service with key. The tokens are valid for the duration ttl.
+func NewTokenIssuer(issuer, service string, key crypto.Signer, ttl time.Duration, users PasswordVerifier) (TokenIssuer, error) {
+	methods, err := signingMethods(key.Public())
+	if err != nil {
+		return TokenIssuer{}, err
+	}
+
+	return TokenIssuer{
+		issuer:  issuer,
+		service: service,
+		key:     key,
+		method:  methods[0],
+		ttl:     ttl,
+		users:   users,
+	}, nil
+}
+
+func (ti TokenIssuer) Service() string {
+	return ti.service
+}
+
+func (ti TokenIssuer) TTL() time.Duration {
+	return ti.ttl
+}
+
+func (ti TokenIssuer) Verify(user, password string) bool {
+	return ti.users.Verify(user, password)
+}
+
+// Issue creates a signed token for user that grants the given access.
+func (ti TokenIssuer) Issue(user string, access []Access, now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("failed generating token ID: %w", err)
+	}
+
+	if access == nil {
+		access = []Access{}
+	}
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ti.issuer,
+			Subject:   user,
+			Audience:  jwt.ClaimStrings{ti.service},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ti.ttl)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        hex.EncodeToString(jti),
+		},
+		Access: access,
+	}
+
+	tok, err := jwt.NewWithClaims(ti.method, claims).SignedString(ti.key)
+	if err != nil {
+		return "", fmt.Errorf("failed signing token: %w", err)
+	}
+
+	return tok, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+)
+
+func isUnauthorized(err error) bool {
+	return errors.As(err, &auth.ErrUnauthorized{})
+}
+
+func isInsufficientScope(err error) bool {
+	return errors.As(err, &auth.ErrInsufficientScope{})
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+
+	pull := auth.Access{Type: auth.TypeRepository, Name: "ns/repo", Actions: []string{auth.ActionPull}}
+	push := auth.Access{Type: auth.TypeRepository, Name: "ns/repo", Actions: []string{auth.ActionPush}}
+
+	tests := []struct {
+		name       string
+		issuerName string
+		service    string
+		key        *ecdsa.PrivateKey
+		issuedAt   time.Time
+		requested  []auth.Access
+		expErr     func(error) bool
+	}{
+		{
+			name:       "valid token",
+			issuerName: "garage",
+			service:    "garage",
+			key:        key,
+			issuedAt:   time.Now(),
+			requested:  []auth.Access{pull},
+		},
+		{
+			name:       "insufficient scope",
+			issuerName: "garage",
+			service:    "garage",
+			key:        key,
+			issuedAt:   time.Now(),
+			requested:  []auth.Access{pull, push},
+			expErr:     isInsufficientScope,
+		},
+		{
+			name:       "wrong issuer",
+			issuerName: "someone-else",
+			service:    "garage",
+			key:        key,
+			issuedAt:   time.Now(),
+			requested:  []auth.Access{pull},
+			expErr:     isUnauthorized,
+		},
+		{
+			name:       "wrong service",
+			issuerName: "garage",
+			service:    "another-service",
+			key:        key,
+			issuedAt:   time.Now(),
+			requested:  []auth.Access{pull},
+			expErr:     isUnauthorized,
+		},
+		{
+			name:       "wrong key",
+			issuerName: "garage",
+			service:    "garage",
+			key:        otherKey,
+			issuedAt:   time.Now(),
+			requested:  []auth.Access{pull},
+			expErr:     isUnauthorized,
+		},
+		{
+			name:       "expired token",
+			issuerName: "garage",
+			service:    "garage",
+			key:        key,
+			issuedAt:   time.Now().Add(-time.Hour),
+			requested:  []auth.Access{pull},
+			expErr:     isUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ta, err := auth.NewTokenAuthenticator("https://example.org/token", "garage", "garage", key.Public())
+			g.Expect(err).NotTo(HaveOccurred(), "failed creating authenticator")
+
+			ti, err := auth.NewTokenIssuer(tt.issuerName, tt.service, tt.key, 5*time.Minute, auth.Htpasswd{})
+			g.Expect(err).NotTo(HaveOccurred(), "failed creating issuer")
+
+			tok, err := ti.Issue("alice", []auth.Access{pull}, tt.issuedAt)
+			g.Expect(err).NotTo(HaveOccurred(), "failed issuing token")
+
+			user, err := ta.Authenticate("Bearer "+tok, tt.requested)
+			if tt.expErr != nil {
+				g.Expect(tt.expErr(err)).To(BeTrue(), "unexpected error: %v", err)
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(user).To(Equal("alice"))
+		})
+	}
+}
+
+func TestTokenChallenge(t *testing.T) {
+	g := NewWithT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred(), "failed generating key")
+
+	ta, err := auth.NewTokenAuthenticator("https://example.org/token", "garage", "garage", key.Public())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating authenticator")
+
+	g.Expect(ta.Challenge(nil, auth.ErrUnauthorized{})).To(Equal(`Bearer realm="https://example.org/token",service="garage"`))
+	g.Expect(ta.Challenge([]auth.Access{
+		{Type: auth.TypeRepository, Name: "ns/repo", Actions: []string{auth.ActionPull, auth.ActionPush}},
+	}, auth.ErrInsufficientScope{})).
+		To(Equal(`Bearer realm="https://example.org/token",service="garage",scope="repository:ns/repo:pull,push",error="insufficient_scope"`))
+}
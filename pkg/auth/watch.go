@@ -0,0 +1,89 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package auth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// watchInterval is the minimum duration between two checks of a watched file for changes.
+const watchInterval = time.Second
+
+// watchedFile holds a value loaded from a file and reloads it when the file changes. If reloading fails, the
+// previously loaded value is kept so that a broken edit doesn't lock everybody out.
+type watchedFile[T any] struct {
+	path string
+	load func(path string) (T, error)
+	log  logr.Logger
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	modTime   time.Time
+	size      int64
+	val       T
+}
+
+func newWatchedFile[T any](path string, load func(path string) (T, error), log logr.Logger) (*watchedFile[T], error) {
+	w := &watchedFile[T]{
+		path: path,
+		load: load,
+		log:  log,
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed checking file: %w", err)
+	}
+	if err := w.reload(fi); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *watchedFile[T]) reload(fi os.FileInfo) error {
+	val, err := w.load(w.path)
+	if err != nil {
+		return err
+	}
+	w.val = val
+	w.modTime = fi.ModTime()
+	w.size = fi.Size()
+	return nil
+}
+
+// get returns the current value, reloading the file first if it has changed since the last check.
+func (w *watchedFile[T]) get() T {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.lastCheck) < watchInterval {
+		return w.val
+	}
+	w.lastCheck = now
+
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		w.log.Error(err, "failed checking file for changes", "path", w.path)
+		return w.val
+	}
+
+	if fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return w.val
+	}
+
+	if err := w.reload(fi); err != nil {
+		w.log.Error(err, "failed reloading file, keeping previous content", "path", w.path)
+		return w.val
+	}
+	w.log.Info("reloaded file", "path", w.path)
+
+	return w.val
+}
@@ -4,14 +4,18 @@
 package cfg
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/makkes/garage/pkg/features"
+	"github.com/makkes/garage/pkg/storage"
 )
 
 const (
@@ -22,6 +26,63 @@ const (
 	KeyHelp        = "help"
 	KeyTLSCertFile = "tls-cert-file"
 	KeyTLSKeyFile  = "tls-key-file"
+
+	KeyHtpasswdFile = "htpasswd-file"
+
+	KeyTokenRealm          = "token-realm"
+	KeyTokenService        = "token-service"
+	KeyTokenIssuer         = "token-issuer"
+	KeyTokenPublicKeyFile  = "token-public-key-file"
+	KeyTokenSigningKeyFile = "token-signing-key-file"
+	KeyTokenUsersFile      = "token-users-file"
+	KeyTokenTTL            = "token-ttl"
+
+	KeyPolicyFile = "policy-file"
+
+	KeySessionTTL = "upload-session-ttl"
+
+	KeyGCInterval    = "gc-interval"
+	KeyGCGracePeriod = "gc-grace-period"
+	KeyGCDryRun      = "dry-run"
+
+	// KeyStorageDriver selects the storage driver. Each driver reads its options from the sub-tree of KeyStorage named
+	// after the driver, e.g. "storage.s3".
+	KeyStorage       = "storage"
+	KeyStorageDriver = KeyStorage + ".driver"
+
+	KeyFileDir = KeyStorage + "." + storage.DriverFile + ".dir"
+
+	KeyS3Endpoint  = KeyStorage + "." + storage.DriverS3 + ".endpoint"
+	KeyS3Region    = KeyStorage + "." + storage.DriverS3 + ".region"
+	KeyS3Bucket    = KeyStorage + "." + storage.DriverS3 + ".bucket"
+	KeyS3Prefix    = KeyStorage + "." + storage.DriverS3 + ".prefix"
+	KeyS3PathStyle = KeyStorage + "." + storage.DriverS3 + ".path-style"
+	KeyS3Insecure  = KeyStorage + "." + storage.DriverS3 + ".insecure"
+	KeyS3AccessKey = KeyStorage + "." + storage.DriverS3 + ".access-key"
+	KeyS3SecretKey = KeyStorage + "." + storage.DriverS3 + ".secret-key"
+	KeyS3PartSize  = KeyStorage + "." + storage.DriverS3 + ".part-size"
+
+	KeyProxy         = "proxy"
+	KeyProxyURL      = KeyProxy + ".url"
+	KeyProxyUsername = KeyProxy + ".username"
+	KeyProxyPassword = KeyProxy + ".password"
+	KeyProxyTagTTL   = KeyProxy + ".tag-ttl"
+
+	// KeyReplicationTargets holds the list of replication targets which can only be configured in the config file.
+	KeyReplication           = "replication"
+	KeyReplicationTargets    = KeyReplication + ".targets"
+	KeyReplicationQueueDir   = KeyReplication + ".queue-dir"
+	KeyReplicationMinBackoff = KeyReplication + ".min-backoff"
+	KeyReplicationMaxBackoff = KeyReplication + ".max-backoff"
+
+	// KeyNotificationsEndpoints holds the list of notification endpoints which can only be configured in the config
+	// file.
+	KeyNotifications           = "notifications"
+	KeyNotificationsEndpoints  = KeyNotifications + ".endpoints"
+	KeyNotificationsQueueSize  = KeyNotifications + ".queue-size"
+	KeyNotificationsMaxRetries = KeyNotifications + ".max-retries"
+	KeyNotificationsMinBackoff = KeyNotifications + ".min-backoff"
+	KeyNotificationsMaxBackoff = KeyNotifications + ".max-backoff"
 )
 
 type Config struct {
@@ -38,6 +99,20 @@ func InitViper() (Config, error) {
 	cfg.V.SetDefault(KeyListenHost, "0.0.0.0")
 	cfg.V.SetDefault(KeyListenPort, 8080)
 	cfg.V.SetDefault(KeyDataDir, "data")
+	cfg.V.SetDefault(KeyStorageDriver, storage.DriverFile)
+	cfg.V.SetDefault(KeyTokenService, "garage")
+	cfg.V.SetDefault(KeyTokenIssuer, "garage")
+	cfg.V.SetDefault(KeyTokenTTL, 5*time.Minute)
+	cfg.V.SetDefault(KeySessionTTL, 24*time.Hour)
+	cfg.V.SetDefault(KeyGCGracePeriod, time.Hour)
+	cfg.V.SetDefault(KeyS3Endpoint, "s3.amazonaws.com")
+	cfg.V.SetDefault(KeyProxyTagTTL, 5*time.Minute)
+	cfg.V.SetDefault(KeyReplicationMinBackoff, time.Second)
+	cfg.V.SetDefault(KeyReplicationMaxBackoff, 5*time.Minute)
+	cfg.V.SetDefault(KeyNotificationsQueueSize, 1000)
+	cfg.V.SetDefault(KeyNotificationsMaxRetries, 5)
+	cfg.V.SetDefault(KeyNotificationsMinBackoff, time.Second)
+	cfg.V.SetDefault(KeyNotificationsMaxBackoff, time.Minute)
 
 	cfg.V.AddConfigPath(".")
 	if err := cfg.V.ReadInConfig(); err != nil {
@@ -46,16 +121,64 @@ func InitViper() (Config, error) {
 		}
 	}
 
-	cfg.V.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	cfg.V.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	cfg.V.AutomaticEnv()
 
+	// the storage backend used to be selected by a plain "storage" value which is now the sub-tree of all storage
+	// configuration.
+	if driver, ok := cfg.V.Get(KeyStorage).(string); ok {
+		return cfg, fmt.Errorf("%q doesn't select the storage driver anymore, set %s (or STORAGE_DRIVER) to %q instead",
+			KeyStorage, KeyStorageDriver, driver)
+	}
+
 	cfg.FS = pflag.NewFlagSet("default", pflag.ContinueOnError)
 	cfg.FS.String(KeyListenHost, cfg.V.GetString(KeyListenHost), "Host to bind to")
 	cfg.FS.IntP(KeyListenPort, "p", cfg.V.GetInt(KeyListenPort), "Port to bind to")
-	cfg.FS.String(KeyDataDir, cfg.V.GetString(KeyDataDir), "Directory for storing all data")
+	cfg.FS.String(KeyDataDir, cfg.V.GetString(KeyDataDir), fmt.Sprintf("Directory for storing all data with the %q storage driver unless %s is set", storage.DriverFile, KeyFileDir))
+	cfg.FS.String(KeyStorageDriver, cfg.V.GetString(KeyStorageDriver),
+		fmt.Sprintf("Storage driver, one of %q. Data in memory is lost when the process exits", storage.Drivers()))
+	legacyDriver := cfg.FS.String(KeyStorage, "", "Storage driver")
+	if err := cfg.FS.MarkDeprecated(KeyStorage, fmt.Sprintf("use --%s instead", KeyStorageDriver)); err != nil {
+		return cfg, fmt.Errorf("failed deprecating flag: %w", err)
+	}
 	cfg.FS.IntP(KeyVerbosity, "v", cfg.V.GetInt(KeyVerbosity), "Number for the log level verbosity (higher is more verbose)")
 	cfg.FS.String(KeyTLSCertFile, cfg.V.GetString(KeyTLSCertFile), "Certificate file for serving HTTPS")
 	cfg.FS.String(KeyTLSKeyFile, cfg.V.GetString(KeyTLSKeyFile), "Key file for serving HTTPS")
+	cfg.FS.String(KeyHtpasswdFile, cfg.V.GetString(KeyHtpasswdFile), "htpasswd file with bcrypt-hashed passwords. Enables HTTP Basic authentication")
+	cfg.FS.String(KeyTokenRealm, cfg.V.GetString(KeyTokenRealm), "URL of the token endpoint that clients are referred to for authentication")
+	cfg.FS.String(KeyTokenService, cfg.V.GetString(KeyTokenService), "Name of the service that tokens are issued for")
+	cfg.FS.String(KeyTokenIssuer, cfg.V.GetString(KeyTokenIssuer), "Name of the token issuer")
+	cfg.FS.String(KeyTokenPublicKeyFile, cfg.V.GetString(KeyTokenPublicKeyFile), "PEM-encoded public key or certificate for verifying tokens. Enables token authentication")
+	cfg.FS.String(KeyTokenSigningKeyFile, cfg.V.GetString(KeyTokenSigningKeyFile),
+		"PEM-encoded private key for signing tokens. Enables token authentication and the built-in token endpoint at /token")
+	cfg.FS.String(KeyTokenUsersFile, cfg.V.GetString(KeyTokenUsersFile), "htpasswd file with bcrypt-hashed passwords of the users the built-in token endpoint authenticates")
+	cfg.FS.Duration(KeyTokenTTL, cfg.V.GetDuration(KeyTokenTTL), "Validity period of tokens issued by the built-in token endpoint")
+	cfg.FS.String(KeyPolicyFile, cfg.V.GetString(KeyPolicyFile), "YAML file with rules permitting users access to repositories. Everything not permitted is denied")
+	cfg.FS.Duration(KeySessionTTL, cfg.V.GetDuration(KeySessionTTL), "Duration after which blob upload sessions without any activity expire. 0 disables expiry")
+	cfg.FS.Duration(KeyGCInterval, cfg.V.GetDuration(KeyGCInterval), "Interval for collecting unreferenced blobs while serving. 0 disables garbage collection")
+	cfg.FS.Duration(KeyGCGracePeriod, cfg.V.GetDuration(KeyGCGracePeriod), "Minimum age of unreferenced blobs before they are collected")
+	cfg.FS.Bool(KeyGCDryRun, false, "Only report the blobs that 'garage gc' would remove")
+	cfg.FS.String(KeyS3Endpoint, cfg.V.GetString(KeyS3Endpoint), "Host and optional port of the S3 API")
+	cfg.FS.String(KeyS3Region, cfg.V.GetString(KeyS3Region), "Region of the S3 bucket")
+	cfg.FS.String(KeyS3Bucket, cfg.V.GetString(KeyS3Bucket), "Name of the S3 bucket for storing all data")
+	cfg.FS.String(KeyS3Prefix, cfg.V.GetString(KeyS3Prefix), "Prefix of all object keys in the S3 bucket")
+	cfg.FS.Bool(KeyS3PathStyle, cfg.V.GetBool(KeyS3PathStyle), "Use path-style addressing of the S3 bucket as required by many S3-compatible stores")
+	cfg.FS.Bool(KeyS3Insecure, cfg.V.GetBool(KeyS3Insecure), "Talk to the S3 endpoint using plain HTTP")
+	cfg.FS.String(KeyS3AccessKey, cfg.V.GetString(KeyS3AccessKey),
+		"Access key for S3. If unset, credentials are taken from the environment, the AWS credentials file or the instance metadata")
+	cfg.FS.String(KeyS3SecretKey, cfg.V.GetString(KeyS3SecretKey), "Secret key for S3")
+	cfg.FS.Int64(KeyS3PartSize, cfg.V.GetInt64(KeyS3PartSize), "Size in bytes of the parts that chunked uploads are stored in. Must be at least the minimum part size of S3 (5 MiB), which is used if unset")
+	cfg.FS.String(KeyProxyURL, cfg.V.GetString(KeyProxyURL), "URL of an upstream registry, e.g. https://registry-1.docker.io. Enables the pull-through cache")
+	cfg.FS.String(KeyProxyUsername, cfg.V.GetString(KeyProxyUsername), "Username for authenticating with the upstream registry")
+	cfg.FS.String(KeyProxyPassword, cfg.V.GetString(KeyProxyPassword), "Password for authenticating with the upstream registry")
+	cfg.FS.Duration(KeyProxyTagTTL, cfg.V.GetDuration(KeyProxyTagTTL), "Duration after which cached tags are revalidated with the upstream registry")
+	cfg.FS.String(KeyReplicationQueueDir, cfg.V.GetString(KeyReplicationQueueDir), fmt.Sprintf("Directory for persisting manifests waiting to be replicated. Defaults to the directory \"_replication\" inside of %s", KeyDataDir))
+	cfg.FS.Duration(KeyReplicationMinBackoff, cfg.V.GetDuration(KeyReplicationMinBackoff), "Delay before retrying a failed replication for the first time")
+	cfg.FS.Duration(KeyReplicationMaxBackoff, cfg.V.GetDuration(KeyReplicationMaxBackoff), "Maximum delay between attempts to replicate a manifest")
+	cfg.FS.Int(KeyNotificationsQueueSize, cfg.V.GetInt(KeyNotificationsQueueSize), "Maximum number of events waiting to be sent to each notification endpoint")
+	cfg.FS.Int(KeyNotificationsMaxRetries, cfg.V.GetInt(KeyNotificationsMaxRetries), "Number of times sending an event is retried before it is dropped")
+	cfg.FS.Duration(KeyNotificationsMinBackoff, cfg.V.GetDuration(KeyNotificationsMinBackoff), "Delay before retrying to send an event for the first time")
+	cfg.FS.Duration(KeyNotificationsMaxBackoff, cfg.V.GetDuration(KeyNotificationsMaxBackoff), "Maximum delay between attempts to send an event")
 	cfg.FS.BoolP(KeyHelp, "h", false, "Show this help")
 
 	cfg.Features = features.Features{}
@@ -65,13 +188,53 @@ func InitViper() (Config, error) {
 		return cfg, fmt.Errorf("failed parsing command-line flags: %w", err)
 	}
 
-	if err := cfg.V.BindPFlags(cfg.FS); err != nil {
-		return cfg, fmt.Errorf("failed binding flag set: %w", err)
+	// the deprecated storage flag isn't bound as it would shadow all keys of the storage sub-tree.
+	var bindErr error
+	cfg.FS.VisitAll(func(f *pflag.Flag) {
+		if f.Name != KeyStorage {
+			bindErr = errors.Join(bindErr, cfg.V.BindPFlag(f.Name, f))
+		}
+	})
+	if bindErr != nil {
+		return cfg, fmt.Errorf("failed binding flag set: %w", bindErr)
+	}
+	if cfg.FS.Changed(KeyStorage) {
+		cfg.V.Set(KeyStorageDriver, *legacyDriver)
 	}
 
+	// the file driver and the replication queue store their data in the data directory unless configured otherwise.
+	cfg.V.SetDefault(KeyFileDir, cfg.V.GetString(KeyDataDir))
+	cfg.V.SetDefault(KeyReplicationQueueDir, filepath.Join(cfg.V.GetString(KeyDataDir), "_replication"))
+
 	cfg.FS.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags]     serve the registry\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s gc [flags]  remove unreferenced blobs and exit\n\nFlags:\n", os.Args[0])
 		cfg.FS.PrintDefaults()
 	}
 	return cfg, nil
 }
+
+// StorageDriverConfig returns the configuration sub-tree of the storage driver with the given name.
+func (c Config) StorageDriverConfig(name string) storage.DriverConfig {
+	return driverConfig{v: c.V, prefix: KeyStorage + "." + name + "."}
+}
+
+// driverConfig reads all keys relative to prefix so that flags, environment variables and the config file are all
+// taken into account which isn't the case for viper.Viper.Sub.
+type driverConfig struct {
+	v      *viper.Viper
+	prefix string
+}
+
+func (c driverConfig) GetString(key string) string {
+	return c.v.GetString(c.prefix + key)
+}
+
+func (c driverConfig) GetBool(key string) bool {
+	return c.v.GetBool(c.prefix + key)
+}
+
+func (c driverConfig) GetInt64(key string) int64 {
+	return c.v.GetInt64(c.prefix + key)
+}
@@ -0,0 +1,497 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package client implements a client for registries serving the OCI distribution API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+// maxManifestBytes is the maximum size of a manifest fetched from a registry.
+const maxManifestBytes = 8 * 1024 * 1024
+
+// ManifestMediaTypes are the media types of all manifests that the client accepts.
+var ManifestMediaTypes = []string{
+	types.MediaTypeImageManifest,
+	types.MediaTypeImageIndex,
+	types.MediaTypeDockerManifest,
+	types.MediaTypeDockerManifestList,
+}
+
+type ErrNotFound struct {
+	Err error
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("not found in remote registry: %s", e.Err)
+}
+
+// ErrUnexpectedStatus is returned when the remote registry responds with an unexpected status code.
+type ErrUnexpectedStatus struct {
+	Method, URL string
+	Status      int
+	Body        string
+}
+
+func (e ErrUnexpectedStatus) Error() string {
+	return fmt.Sprintf("unexpected status %d for %s %s: %s", e.Status, e.Method, e.URL, e.Body)
+}
+
+type Opt func(c *Client) error
+
+// Client talks to a single remote registry, negotiating credentials using HTTP Basic authentication or the Docker
+// registry token authentication flow as requested by the registry.
+type Client struct {
+	base     *url.URL
+	hc       *http.Client
+	username string
+	password string
+	tokens   *tokenCache
+}
+
+// New creates a client for the registry at baseURL, e.g. "https://registry-1.docker.io".
+func New(baseURL string, opts ...Opt) (Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed parsing registry URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Client{}, fmt.Errorf("unsupported scheme %q in registry URL", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	c := Client{
+		base:   u,
+		hc:     http.DefaultClient,
+		tokens: &tokenCache{tokens: make(map[string]token)},
+	}
+
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return c, fmt.Errorf("failed applying option: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// WithBasicAuth authenticates with the given credentials, either directly or when fetching tokens.
+func WithBasicAuth(username, password string) Opt {
+	return func(c *Client) error {
+		c.username = username
+		c.password = password
+		return nil
+	}
+}
+
+func WithHTTPClient(hc *http.Client) Opt {
+	return func(c *Client) error {
+		c.hc = hc
+		return nil
+	}
+}
+
+// URL returns the base URL of the remote registry.
+func (c Client) URL() string {
+	return c.base.String()
+}
+
+// Manifest is a manifest as returned by a registry.
+type Manifest struct {
+	Data      []byte
+	MediaType string
+	Digest    types.Digest
+}
+
+// GetManifest fetches the manifest identified by ref which is either a tag or a digest from the repository name.
+func (c Client) GetManifest(ctx context.Context, name, ref string) (Manifest, error) {
+	resp, err := c.do(ctx, http.MethodGet, name, "/manifests/"+ref, acceptManifests)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed reading manifest: %w", err)
+	}
+	if len(data) > maxManifestBytes {
+		return Manifest{}, fmt.Errorf("manifest exceeds maximum size of %d bytes", maxManifestBytes)
+	}
+
+	algo := types.AlgoSHA256
+	expected, refErr := types.ParseDigest(ref)
+	if refErr == nil {
+		algo = types.SupportedAlgos(expected.Algo)
+	}
+	dig, err := types.NewDigest(algo, bytes.NewReader(data))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed calculating manifest digest: %w", err)
+	}
+	if refErr == nil && dig != expected {
+		return Manifest{}, fmt.Errorf("manifest digest %s doesn't match requested digest %s", dig, expected)
+	}
+
+	return Manifest{
+		Data:      data,
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    dig,
+	}, nil
+}
+
+// HeadManifest returns the digest of the manifest identified by ref from the repository name without fetching it.
+func (c Client) HeadManifest(ctx context.Context, name, ref string) (types.Digest, error) {
+	resp, err := c.do(ctx, http.MethodHead, name, "/manifests/"+ref, acceptManifests)
+	if err != nil {
+		return types.Digest{}, err
+	}
+	resp.Body.Close()
+
+	dig, err := types.ParseDigest(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed parsing manifest digest returned by registry: %w", err)
+	}
+
+	return dig, nil
+}
+
+// GetBlob returns a reader for the blob with the digest dig from the repository name and the blob's size which is -1
+// if unknown. The caller needs to close the reader.
+func (c Client) GetBlob(ctx context.Context, name string, dig types.Digest) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, name, "/blobs/"+dig.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// HeadBlob returns the size of the blob with the digest dig from the repository name.
+func (c Client) HeadBlob(ctx context.Context, name string, dig types.Digest) (int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, name, "/blobs/"+dig.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+// Tags returns all tags of the repository name, following pagination links.
+func (c Client) Tags(ctx context.Context, name string) ([]string, error) {
+	var res []string
+	path := "/tags/list"
+	for path != "" {
+		resp, err := c.do(ctx, http.MethodGet, name, path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var tl types.TagList
+		err = json.NewDecoder(resp.Body).Decode(&tl)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding tag list: %w", err)
+		}
+		res = append(res, tl.Tags...)
+
+		path, err = nextPage(resp.Header.Get("Link"), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// nextPage returns the path relative to the repository name of the next page referenced by the Link header or an empty
+// string if there is none.
+func nextPage(link, name string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start == -1 || end < start || !strings.Contains(link[end:], `rel="next"`) {
+		return "", nil
+	}
+
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return "", fmt.Errorf("failed parsing Link header: %w", err)
+	}
+	prefix := "/v2/" + name
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", fmt.Errorf("unexpected path in Link header: %q", u.Path)
+	}
+
+	return u.Path[len(prefix):] + "?" + u.RawQuery, nil
+}
+
+// acceptManifests lists all accepted media types in a single header as some servers only look at the first one.
+func acceptManifests(req *http.Request) {
+	req.Header.Set("Accept", strings.Join(ManifestMediaTypes, ", "))
+}
+
+// do sends a request to the endpoint path of the repository name with pull access. See send for details.
+func (c Client) do(ctx context.Context, method, name, path string, prepare func(*http.Request)) (*http.Response, error) {
+	return c.send(ctx, method, c.base.String()+"/v2/"+name+path, pullScope(name), prepare, nil)
+}
+
+func pullScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull", name)
+}
+
+func pushScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull,push", name)
+}
+
+// send sends a request to u, authenticating for the space-separated scopes when challenged. The body is rewound when
+// the request needs to be repeated. It returns an ErrNotFound for 404 responses and an ErrUnexpectedStatus for all
+// other unsuccessful responses.
+func (c Client) send(ctx context.Context, method, u, scope string, prepare func(*http.Request), body io.ReadSeeker) (*http.Response, error) {
+	newReq := func() (*http.Request, error) {
+		var b io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("failed rewinding request body: %w", err)
+			}
+			b = io.NopCloser(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, b)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating request: %w", err)
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+		c.authorize(req, scope)
+		return req, nil
+	}
+
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed sending request: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		drain(resp)
+		if err := c.negotiate(ctx, challenge, scope); err != nil {
+			return nil, err
+		}
+
+		if req, err = newReq(); err != nil {
+			return nil, err
+		}
+		if resp, err = c.hc.Do(req); err != nil {
+			return nil, fmt.Errorf("failed sending request: %w", err)
+		}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer drain(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound{Err: fmt.Errorf("%s %s", method, u)}
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, ErrUnexpectedStatus{Method: method, URL: u, Status: resp.StatusCode, Body: string(b)}
+}
+
+// drain discards the rest of the response body so that the connection can be re-used.
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
+
+// authorize adds credentials to the request if the registry asked for them before.
+func (c Client) authorize(req *http.Request, scope string) {
+	if tok, ok := c.tokens.get(scope); ok {
+		req.Header.Set("Authorization", "Bearer "+tok)
+		return
+	}
+	if c.tokens.basic() {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// negotiate obtains credentials as requested by the WWW-Authenticate challenge.
+func (c Client) negotiate(ctx context.Context, challenge, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry requires credentials")
+		}
+		c.tokens.setBasic()
+		return nil
+	case "bearer":
+		return c.fetchToken(ctx, params, scope)
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+}
+
+func (c Client) fetchToken(ctx context.Context, params map[string]string, scope string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+
+	q := realm.Query()
+	if svc := params["service"]; svc != "" {
+		q.Set("service", svc)
+	}
+	// the registry might ask for less access than the client needs, e.g. when mounting blobs from other repositories.
+	requested := make(map[string]struct{})
+	for _, s := range append(strings.Fields(params["scope"]), strings.Fields(scope)...) {
+		if _, ok := requested[s]; !ok {
+			requested[s] = struct{}{}
+			q.Add("scope", s)
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed creating token request: %w", err)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed requesting token: %w", err)
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return ErrUnexpectedStatus{Method: req.Method, URL: realm.String(), Status: resp.StatusCode, Body: string(b)}
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("failed decoding token response: %w", err)
+	}
+
+	tok := tr.Token
+	if tok == "" {
+		tok = tr.AccessToken
+	}
+	if tok == "" {
+		return fmt.Errorf("token response doesn't contain a token")
+	}
+	// the token specification mandates a default of 60 seconds.
+	if tr.ExpiresIn <= 0 {
+		tr.ExpiresIn = 60
+	}
+
+	c.tokens.set(scope, tok, time.Now().Add(time.Duration(tr.ExpiresIn)*time.Second))
+
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header of the form 'Scheme key="value",key2="value2"'.
+func parseChallenge(hdr string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(hdr), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, val, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(val, `"`) {
+			end := strings.Index(val[1:], `"`)
+			if end == -1 {
+				params[key] = val[1:]
+				break
+			}
+			params[key] = val[1 : end+1]
+			rest = val[end+2:]
+			continue
+		}
+
+		end := strings.Index(val, ",")
+		if end == -1 {
+			params[key] = val
+			break
+		}
+		params[key] = val[:end]
+		rest = val[end:]
+	}
+
+	return scheme, params
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// tokenCache holds the credentials negotiated with a registry, shared by all copies of a Client.
+type tokenCache struct {
+	mu        sync.Mutex
+	tokens    map[string]token
+	basicAuth bool
+}
+
+func (tc *tokenCache) get(scope string) (string, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tok, ok := tc.tokens[scope]
+	// tokens are renewed a little early to account for clock skew and request latency.
+	if !ok || time.Now().Add(5*time.Second).After(tok.expires) {
+		return "", false
+	}
+	return tok.value, true
+}
+
+func (tc *tokenCache) set(scope, value string, expires time.Time) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.tokens[scope] = token{value: value, expires: expires}
+}
+
+func (tc *tokenCache) setBasic() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.basicAuth = true
+}
+
+func (tc *tokenCache) basic() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return tc.basicAuth
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/types"
+)
+
+const testManifest = `{"schemaVersion":2}`
+
+func TestBasicAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "alice" || p != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", types.MediaTypeImageManifest)
+		fmt.Fprint(w, testManifest)
+	}))
+	defer srv.Close()
+
+	c, err := client.New(srv.URL, client.WithBasicAuth("alice", "secret"))
+	g.Expect(err).NotTo(HaveOccurred())
+	m, err := c.GetManifest(context.Background(), "ns/repo", "latest")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(m.Data)).To(Equal(testManifest))
+	g.Expect(m.MediaType).To(Equal(types.MediaTypeImageManifest))
+
+	anon, err := client.New(srv.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = anon.GetManifest(context.Background(), "ns/repo", "latest")
+	g.Expect(err).To(MatchError("registry requires credentials"))
+}
+
+func TestTokenAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	var tokenRequests atomic.Int32
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+		if r.URL.Query().Get("service") != "test" || r.URL.Query().Get("scope") != "repository:ns/repo:pull" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			fmt.Fprint(w, `{"token":"user-token"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"anon-token","expires_in":300}`)
+	})
+	mux.HandleFunc("/v2/ns/repo/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		if h := r.Header.Get("Authorization"); h != "Bearer user-token" && h != "Bearer anon-token" {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:ns/repo:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "blob")
+	})
+
+	for _, opts := range [][]client.Opt{nil, {client.WithBasicAuth("alice", "secret")}} {
+		tokenRequests.Store(0)
+		c, err := client.New(srv.URL, opts...)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		for range 3 {
+			rdr, size, err := c.GetBlob(context.Background(), "ns/repo", types.Digest{Algo: "sha256", Enc: "abc"})
+			g.Expect(err).NotTo(HaveOccurred())
+			b, err := io.ReadAll(rdr)
+			rdr.Close()
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(b)).To(Equal("blob"))
+			g.Expect(size).To(BeEquivalentTo(4))
+		}
+		g.Expect(tokenRequests.Load()).To(BeEquivalentTo(1), "token hasn't been cached")
+	}
+}
+
+func TestTagsFollowsLinks(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("last") {
+		case "":
+			w.Header().Set("Link", `</v2/ns/repo/tags/list?last=b&n=2>; rel="next"`)
+			fmt.Fprint(w, `{"name":"ns/repo","tags":["a","b"]}`)
+		case "b":
+			fmt.Fprint(w, `{"name":"ns/repo","tags":["c"]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := client.New(srv.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	tags, err := c.Tags(context.Background(), "ns/repo")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"a", "b", "c"}))
+}
+
+func TestErrors(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "oops")
+		default:
+			fmt.Fprint(w, testManifest)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := client.New(srv.URL + "/")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = c.GetManifest(context.Background(), "ns/repo", "missing")
+	g.Expect(errors.As(err, &client.ErrNotFound{})).To(BeTrue(), "unexpected error %v", err)
+
+	_, err = c.GetManifest(context.Background(), "ns/repo", "broken")
+	var use client.ErrUnexpectedStatus
+	g.Expect(errors.As(err, &use)).To(BeTrue(), "unexpected error %v", err)
+	g.Expect(use.Status).To(Equal(http.StatusInternalServerError))
+	g.Expect(use.Body).To(Equal("oops"))
+
+	_, err = c.GetManifest(context.Background(), "ns/repo", "sha256:"+strings.Repeat("0", 64))
+	g.Expect(err).To(MatchError(ContainSubstring("doesn't match requested digest")))
+
+	_, err = client.New("ftp://example.org")
+	g.Expect(err).To(MatchError(`unsupported scheme "ftp" in registry URL`))
+}
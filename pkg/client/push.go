@@ -0,0 +1,96 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+// BlobExists reports whether the repository name contains the blob with the digest dig.
+func (c Client) BlobExists(ctx context.Context, name string, dig types.Digest) (bool, error) {
+	if _, err := c.HeadBlob(ctx, name, dig); err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PushBlob uploads the blob with the digest dig and the given size to the repository name. If from isn't empty, the
+// registry is asked to mount the blob from that repository instead which avoids uploading it if the registry supports
+// cross-repository mounts. It reports whether the blob has been mounted.
+func (c Client) PushBlob(ctx context.Context, name string, dig types.Digest, size int64, content io.ReadSeeker, from string) (bool, error) {
+	u := c.base.String() + "/v2/" + name + "/blobs/uploads/"
+	scope := pushScope(name)
+	if from != "" {
+		u += "?" + url.Values{"mount": {dig.String()}, "from": {from}}.Encode()
+		scope += " " + pullScope(from)
+	}
+
+	resp, err := c.send(ctx, http.MethodPost, u, scope, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed starting upload: %w", err)
+	}
+	drain(resp)
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+	default:
+		return false, ErrUnexpectedStatus{Method: http.MethodPost, URL: u, Status: resp.StatusCode}
+	}
+
+	loc, err := c.base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return false, fmt.Errorf("failed parsing upload location: %w", err)
+	}
+	q := loc.Query()
+	q.Set("digest", dig.String())
+	loc.RawQuery = q.Encode()
+
+	resp, err = c.send(ctx, http.MethodPut, loc.String(), scope, func(req *http.Request) {
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}, content)
+	if err != nil {
+		return false, fmt.Errorf("failed uploading blob: %w", err)
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return false, ErrUnexpectedStatus{Method: http.MethodPut, URL: loc.String(), Status: resp.StatusCode}
+	}
+
+	return false, nil
+}
+
+// PutManifest pushes the manifest with the given media type to the repository name under ref which is either a tag or
+// a digest.
+func (c Client) PutManifest(ctx context.Context, name, ref, mediaType string, data []byte) error {
+	u := c.base.String() + "/v2/" + name + "/manifests/" + ref
+	resp, err := c.send(ctx, http.MethodPut, u, pushScope(name), func(req *http.Request) {
+		req.Header.Set("Content-Type", mediaType)
+		req.ContentLength = int64(len(data))
+	}, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed pushing manifest: %w", err)
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return ErrUnexpectedStatus{Method: http.MethodPut, URL: u, Status: resp.StatusCode}
+	}
+
+	return nil
+}
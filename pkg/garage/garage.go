@@ -0,0 +1,337 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package garage implements the garage command. It allows building custom registry binaries that register additional
+// storage drivers before calling Main.
+package garage
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/google/uuid"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/makkes/garage/pkg/auth"
+	cfgp "github.com/makkes/garage/pkg/cfg"
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/replication"
+	"github.com/makkes/garage/pkg/storage"
+)
+
+// sessionJanitorInterval is the maximum interval between two runs of the janitor removing expired upload sessions.
+const sessionJanitorInterval = 10 * time.Minute
+
+func toInt8(i int) (int8, error) {
+	if i > math.MaxInt8 || i < math.MinInt8 {
+		return 0, fmt.Errorf("overflow of %d", i)
+	}
+	return int8(i), nil
+}
+
+// authOpts returns the registry options for enabling authentication if it is configured.
+func authOpts(cfg cfgp.Config, log logr.Logger) ([]registry.Opt, error) {
+	htpasswdFile := cfg.V.GetString(cfgp.KeyHtpasswdFile)
+	pubKeyFile := cfg.V.GetString(cfgp.KeyTokenPublicKeyFile)
+	signingKeyFile := cfg.V.GetString(cfgp.KeyTokenSigningKeyFile)
+
+	if htpasswdFile != "" {
+		if pubKeyFile != "" || signingKeyFile != "" {
+			return nil, fmt.Errorf("basic and token authentication are mutually exclusive")
+		}
+		users, err := auth.NewHtpasswdFile(htpasswdFile, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading htpasswd file: %w", err)
+		}
+		return []registry.Opt{registry.WithAuthenticator(auth.NewBasicAuthenticator("garage", users))}, nil
+	}
+
+	if pubKeyFile == "" && signingKeyFile == "" {
+		return nil, nil
+	}
+
+	realm := cfg.V.GetString(cfgp.KeyTokenRealm)
+	if realm == "" {
+		return nil, fmt.Errorf("--%s is required for token authentication", cfgp.KeyTokenRealm)
+	}
+	service := cfg.V.GetString(cfgp.KeyTokenService)
+	issuer := cfg.V.GetString(cfgp.KeyTokenIssuer)
+
+	var opts []registry.Opt
+	var pubKey crypto.PublicKey
+	if signingKeyFile != "" {
+		key, err := auth.LoadPrivateKey(signingKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading token signing key: %w", err)
+		}
+
+		usersFile := cfg.V.GetString(cfgp.KeyTokenUsersFile)
+		if usersFile == "" {
+			return nil, fmt.Errorf("--%s is required for issuing tokens", cfgp.KeyTokenUsersFile)
+		}
+		users, err := auth.NewHtpasswdFile(usersFile, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading token users: %w", err)
+		}
+
+		ti, err := auth.NewTokenIssuer(issuer, service, key, cfg.V.GetDuration(cfgp.KeyTokenTTL), users)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating token issuer: %w", err)
+		}
+		opts = append(opts, registry.WithTokenIssuer(ti))
+		pubKey = key.Public()
+	}
+
+	if pubKeyFile != "" {
+		var err error
+		pubKey, err = auth.LoadPublicKey(pubKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading token verification key: %w", err)
+		}
+	}
+
+	ta, err := auth.NewTokenAuthenticator(realm, service, issuer, pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating token authenticator: %w", err)
+	}
+
+	return append(opts, registry.WithAuthenticator(ta)), nil
+}
+
+// gc collects garbage once and prints the removed blobs.
+func gc(s storage.FileStorage, opts storage.GCOptions) error {
+	res, err := s.GarbageCollect(opts)
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if opts.DryRun {
+		verb = "would remove"
+	}
+	for _, dig := range res.Removed {
+		fmt.Printf("%s %s\n", verb, dig)
+	}
+	fmt.Printf("%s %d blobs (%d bytes)\n", verb, len(res.Removed), res.Bytes)
+
+	return nil
+}
+
+// Main runs the garage command with the process's arguments and exits the process when it returns.
+func Main() {
+	if err := Run(); err != nil {
+		if !errors.Is(err, pflag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// Run runs the garage command with the process's arguments, either serving the registry until the server fails or
+// executing a sub-command.
+func Run() error {
+	cfg, err := cfgp.InitViper()
+	if err != nil {
+		return fmt.Errorf("failed initializing configuration: %w", err)
+	}
+
+	if cfg.V.GetBool(cfgp.KeyHelp) {
+		cfg.FS.Usage()
+		return pflag.ErrHelp
+	}
+
+	var verbosity int8
+	verbosity, err = toInt8(cfg.V.GetInt(cfgp.KeyVerbosity))
+	if err != nil {
+		return fmt.Errorf("conversion of verbosity flag failed: %w", err)
+	}
+
+	zlog := zap.New(
+		zapcore.NewCore(
+			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+			zapcore.Lock(os.Stderr),
+			zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
+				return lvl >= zapcore.Level(-verbosity)
+			}),
+		),
+	)
+	log := zapr.NewLogger(zlog)
+
+	gcOpts := storage.GCOptions{
+		DryRun:      cfg.V.GetBool(cfgp.KeyGCDryRun),
+		GracePeriod: cfg.V.GetDuration(cfgp.KeyGCGracePeriod),
+	}
+
+	driver := cfg.V.GetString(cfgp.KeyStorageDriver)
+	s, err := storage.New(driver, cfg.StorageDriverConfig(driver), log.WithName("storage"))
+	if err != nil {
+		return fmt.Errorf("failed creating storage backend: %w", err)
+	}
+	location := driver
+	if fs, ok := s.(storage.FileStorage); ok {
+		location = fs.Dir()
+	}
+
+	switch cmd := cfg.FS.Arg(0); cmd {
+	case "":
+	case "gc":
+		fs, ok := s.(storage.FileStorage)
+		if !ok {
+			return fmt.Errorf("garbage collection is only supported by the %q storage driver", storage.DriverFile)
+		}
+		if err := gc(fs, gcOpts); err != nil {
+			return fmt.Errorf("garbage collection failed: %w", err)
+		}
+		return nil
+	default:
+		cfg.FS.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+
+	if interval := cfg.V.GetDuration(cfgp.KeyGCInterval); interval > 0 {
+		fs, ok := s.(storage.FileStorage)
+		if !ok {
+			return fmt.Errorf("garbage collection is only supported by the %q storage driver", storage.DriverFile)
+		}
+		go fs.RunGarbageCollection(context.Background(), interval, gcOpts)
+	}
+
+	opts, err := authOpts(cfg, log.WithName("auth"))
+	if err != nil {
+		return fmt.Errorf("failed configuring authentication: %w", err)
+	}
+
+	if policyFile := cfg.V.GetString(cfgp.KeyPolicyFile); policyFile != "" {
+		policy, err := auth.NewPolicyFile(policyFile, log.WithName("policy"))
+		if err != nil {
+			return fmt.Errorf("failed loading policy file: %w", err)
+		}
+		opts = append(opts, registry.WithAuthorizer(policy))
+	}
+
+	if upstreamURL := cfg.V.GetString(cfgp.KeyProxyURL); upstreamURL != "" {
+		upstream, err := client.New(upstreamURL,
+			client.WithBasicAuth(cfg.V.GetString(cfgp.KeyProxyUsername), cfg.V.GetString(cfgp.KeyProxyPassword)))
+		if err != nil {
+			return fmt.Errorf("failed creating upstream registry client: %w", err)
+		}
+		opts = append(opts, registry.WithProxy(upstream, cfg.V.GetDuration(cfgp.KeyProxyTagTTL)))
+	}
+
+	replOpts, err := replicationOpts(cfg, s, log.WithName("replication"))
+	if err != nil {
+		return fmt.Errorf("failed configuring replication: %w", err)
+	}
+	opts = append(opts, replOpts...)
+
+	notifyOpts, err := notificationOpts(cfg, log.WithName("notifications"))
+	if err != nil {
+		return fmt.Errorf("failed configuring notifications: %w", err)
+	}
+	opts = append(opts, notifyOpts...)
+
+	sessionTTL := cfg.V.GetDuration(cfgp.KeySessionTTL)
+	r, err := registry.New(append([]registry.Opt{
+		registry.WithFeatures(cfg.Features),
+		registry.WithStorage(s),
+		registry.WithMiddleware(logger.New()),
+		registry.WithLogger(log.WithName("registry")),
+		registry.WithSessionTTL(sessionTTL),
+	}, opts...)...)
+	if err != nil {
+		return fmt.Errorf("failed creating registry: %w", err)
+	}
+
+	go r.RunSessionJanitor(context.Background(), min(sessionTTL, sessionJanitorInterval))
+
+	laddr := fmt.Sprintf("%s:%d", cfg.V.GetString(cfgp.KeyListenHost), cfg.V.GetInt(cfgp.KeyListenPort))
+
+	start := func() error {
+		fmt.Fprintf(os.Stderr, "starting server at %s, serving from %s\n", laddr, location)
+		return r.Start(laddr)
+	}
+
+	certFile := cfg.V.GetString(cfgp.KeyTLSCertFile)
+	keyFile := cfg.V.GetString(cfgp.KeyTLSKeyFile)
+	if certFile != "" && keyFile != "" {
+		start = func() error {
+			fmt.Fprintf(os.Stderr, "starting TLS server at %s, serving from %s\n", laddr, location)
+			return r.StartTLS(laddr, certFile, keyFile)
+		}
+	}
+
+	if err := start(); err != nil {
+		return fmt.Errorf("failed starting server: %w", err)
+	}
+
+	return nil
+}
+
+// replicationOpts returns the registry options for replicating pushes from s if replication targets are configured. It
+// starts replicating in the background.
+func replicationOpts(cfg cfgp.Config, s storage.Storage, log logr.Logger) ([]registry.Opt, error) {
+	var targets []replication.Target
+	if err := cfg.V.UnmarshalKey(cfgp.KeyReplicationTargets, &targets); err != nil {
+		return nil, fmt.Errorf("failed reading replication targets: %w", err)
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	rep, err := replication.New(s, targets, replication.Options{
+		QueueDir:   cfg.V.GetString(cfgp.KeyReplicationQueueDir),
+		MinBackoff: cfg.V.GetDuration(cfgp.KeyReplicationMinBackoff),
+		MaxBackoff: cfg.V.GetDuration(cfgp.KeyReplicationMaxBackoff),
+	}, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating replicator: %w", err)
+	}
+	go rep.Run(context.Background())
+
+	return []registry.Opt{registry.WithReplicator(rep)}, nil
+}
+
+// notificationOpts returns the registry options for emitting events if notification endpoints are configured. It starts
+// sending events in the background.
+func notificationOpts(cfg cfgp.Config, log logr.Logger) ([]registry.Opt, error) {
+	var endpoints []notifications.Endpoint
+	if err := cfg.V.UnmarshalKey(cfgp.KeyNotificationsEndpoints, &endpoints); err != nil {
+		return nil, fmt.Errorf("failed reading notification endpoints: %w", err)
+	}
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed determining hostname: %w", err)
+	}
+	n, err := notifications.New(endpoints, notifications.Options{
+		QueueSize:  cfg.V.GetInt(cfgp.KeyNotificationsQueueSize),
+		MaxRetries: cfg.V.GetInt(cfgp.KeyNotificationsMaxRetries),
+		MinBackoff: cfg.V.GetDuration(cfgp.KeyNotificationsMinBackoff),
+		MaxBackoff: cfg.V.GetDuration(cfgp.KeyNotificationsMaxBackoff),
+		Source: notifications.Source{
+			Addr:       fmt.Sprintf("%s:%d", hostname, cfg.V.GetInt(cfgp.KeyListenPort)),
+			InstanceID: uuid.NewString(),
+		},
+	}, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating notifier: %w", err)
+	}
+	go n.Run(context.Background())
+
+	return []registry.Opt{registry.WithNotifier(n)}, nil
+}
@@ -0,0 +1,459 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package notifications delivers registry events to HTTP endpoints in the format of Docker distribution notifications.
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+)
+
+const (
+	ActionPush   = "push"
+	ActionPull   = "pull"
+	ActionMount  = "mount"
+	ActionDelete = "delete"
+
+	// EventsMediaType is the content type of the envelopes that events are delivered in.
+	EventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+	// SignatureHeader holds the hex-encoded HMAC-SHA256 of the request body, prefixed with "sha256=", if the endpoint
+	// has a secret.
+	SignatureHeader = "X-Garage-Signature"
+
+	defaultQueueSize  = 1000
+	defaultTimeout    = 5 * time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+var endpointNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Envelope is the body of every request sent to an endpoint.
+type Envelope struct {
+	Events []Event `json:"events"`
+}
+
+// Event describes an action performed on a manifest or blob.
+type Event struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    Target    `json:"target"`
+	Request   Request   `json:"request"`
+	Actor     Actor     `json:"actor"`
+	Source    Source    `json:"source"`
+}
+
+// Target is the manifest or blob that an event is about.
+type Target struct {
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	// Length is the same as Size and only kept for compatibility with older consumers.
+	Length         int64  `json:"length,omitempty"`
+	Repository     string `json:"repository"`
+	FromRepository string `json:"fromRepository,omitempty"`
+	URL            string `json:"url,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+}
+
+// Request describes the HTTP request that caused an event.
+type Request struct {
+	ID        string `json:"id,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Method    string `json:"method,omitempty"`
+	UserAgent string `json:"useragent,omitempty"`
+}
+
+// Actor is the user that caused an event.
+type Actor struct {
+	Name string `json:"name,omitempty"`
+}
+
+// Source is the registry instance that generated an event.
+type Source struct {
+	Addr       string `json:"addr,omitempty"`
+	InstanceID string `json:"instanceID,omitempty"`
+}
+
+// Endpoint is an HTTP endpoint that events are sent to.
+type Endpoint struct {
+	// Name identifies the endpoint in the notification status.
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+	// Headers are added to every request sent to the endpoint.
+	Headers map[string]string `mapstructure:"headers"`
+	// Secret is the key that the body of every request is signed with. Requests aren't signed if it is empty.
+	Secret  string        `mapstructure:"secret"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Include and Exclude are glob patterns as understood by path.Match that repository names are matched against.
+	// Only events of repositories matching any of the Include patterns (or all if there are none) and none of the
+	// Exclude patterns are sent to the endpoint.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+	// Actions are the actions of the events that are sent to the endpoint. Events of all actions but ActionPull are
+	// sent if it is empty as pulls are usually far more frequent than any other action.
+	Actions []string `mapstructure:"actions"`
+	// IgnoredMediaTypes are the media types of targets whose events aren't sent to the endpoint.
+	IgnoredMediaTypes []string `mapstructure:"ignored-media-types"`
+}
+
+func (e Endpoint) matches(ev Event) bool {
+	if len(e.Actions) == 0 && ev.Action == ActionPull {
+		return false
+	}
+	if len(e.Actions) > 0 && !slices.Contains(e.Actions, ev.Action) {
+		return false
+	}
+	if ev.Target.MediaType != "" && slices.Contains(e.IgnoredMediaTypes, ev.Target.MediaType) {
+		return false
+	}
+	if len(e.Include) > 0 && !matchesAny(e.Include, ev.Target.Repository) {
+		return false
+	}
+	return !matchesAny(e.Exclude, ev.Target.Repository)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configure a Notifier.
+type Options struct {
+	// QueueSize is the maximum number of events waiting to be sent to each endpoint. Events are dropped while an
+	// endpoint's queue is full.
+	QueueSize int
+	// MaxRetries is the number of times sending an event is retried before it is dropped.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponentially growing delay between attempts to send an event.
+	MinBackoff, MaxBackoff time.Duration
+	// Source is set on all events.
+	Source Source
+}
+
+// Status describes the delivery state of an endpoint.
+type Status struct {
+	Endpoint string `json:"endpoint"`
+	URL      string `json:"url"`
+	// Pending is the number of events waiting to be sent.
+	Pending int `json:"pending"`
+	// Sent is the number of events sent since the registry has been started.
+	Sent uint64 `json:"sent"`
+	// Failures is the number of failed attempts to send an event since the registry has been started.
+	Failures uint64 `json:"failures"`
+	// Dropped is the number of events dropped because the queue was full or sending them failed too often.
+	Dropped       uint64     `json:"dropped"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Notifier sends events to all matching endpoints. Events are queued in memory so that a slow or unavailable endpoint
+// doesn't hold up the registry, and failed attempts are retried with exponential backoff.
+type Notifier struct {
+	endpoints []*endpoint
+	opts      Options
+	log       logr.Logger
+}
+
+// endpoint holds the queue and state of a single endpoint.
+type endpoint struct {
+	Endpoint
+	hc *http.Client
+	// redactedURL is the endpoint's URL without a password.
+	redactedURL string
+	// wake is signaled when an event has been queued.
+	wake chan struct{}
+
+	// mu guards all fields below.
+	mu     sync.Mutex
+	queue  []Event
+	status Status
+}
+
+// New creates a Notifier that sends events to endpoints. It doesn't send anything until Run is called.
+func New(endpoints []Endpoint, opts Options, log logr.Logger) (Notifier, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.MaxRetries < 0 {
+		return Notifier{}, fmt.Errorf("maximum number of retries must not be negative")
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+
+	n := Notifier{
+		opts: opts,
+		log:  log,
+	}
+
+	names := make(map[string]struct{}, len(endpoints))
+	for _, e := range endpoints {
+		if !endpointNameRE.MatchString(e.Name) {
+			return Notifier{}, fmt.Errorf("invalid endpoint name %q", e.Name)
+		}
+		if _, ok := names[e.Name]; ok {
+			return Notifier{}, fmt.Errorf("duplicate endpoint name %q", e.Name)
+		}
+		names[e.Name] = struct{}{}
+
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return Notifier{}, fmt.Errorf("failed parsing URL of endpoint %q: %w", e.Name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return Notifier{}, fmt.Errorf("unsupported scheme %q in URL of endpoint %q", u.Scheme, e.Name)
+		}
+
+		for _, p := range append(append([]string{}, e.Include...), e.Exclude...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return Notifier{}, fmt.Errorf("invalid repository pattern %q for endpoint %q: %w", p, e.Name, err)
+			}
+		}
+
+		if e.Timeout <= 0 {
+			e.Timeout = defaultTimeout
+		}
+
+		n.endpoints = append(n.endpoints, &endpoint{
+			Endpoint:    e,
+			hc:          &http.Client{Timeout: e.Timeout},
+			redactedURL: u.Redacted(),
+			wake:        make(chan struct{}, 1),
+		})
+	}
+
+	return n, nil
+}
+
+// Notify queues the event for all endpoints whose filters match it. The event's ID, timestamp and source are set if
+// they're empty. Notify never blocks; events are dropped for endpoints whose queue is full.
+func (n Notifier) Notify(ev Event) {
+	if ev.ID == "" {
+		ev.ID = uuid.NewString()
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	if ev.Source == (Source{}) {
+		ev.Source = n.opts.Source
+	}
+
+	for _, e := range n.endpoints {
+		if !e.matches(ev) {
+			continue
+		}
+		if !e.enqueue(ev, n.opts.QueueSize) {
+			n.log.Error(nil, "dropping event because the queue is full", "endpoint", e.Name, "action", ev.Action,
+				"repository", ev.Target.Repository, "digest", ev.Target.Digest)
+			continue
+		}
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enqueue adds ev to the queue and reports whether there was room for it.
+func (e *endpoint) enqueue(ev Event, size int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.queue) >= size {
+		e.status.Dropped++
+		return false
+	}
+	e.queue = append(e.queue, ev)
+	return true
+}
+
+// next returns the oldest queued event without removing it from the queue.
+func (e *endpoint) next() (Event, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.queue) == 0 {
+		return Event{}, false
+	}
+	return e.queue[0], true
+}
+
+// done removes the oldest queued event from the queue.
+func (e *endpoint) done() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.queue[0] = Event{}
+	e.queue = e.queue[1:]
+}
+
+// Run sends queued events to all endpoints until ctx is done. Events are sent to each endpoint one at a time and in
+// the order they have been queued.
+func (n Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range n.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.runEndpoint(ctx, e)
+		}()
+	}
+	wg.Wait()
+}
+
+func (n Notifier) runEndpoint(ctx context.Context, e *endpoint) {
+	for {
+		ev, ok := e.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.wake:
+			}
+			continue
+		}
+
+		if !n.deliver(ctx, e, ev) {
+			return
+		}
+		e.done()
+	}
+}
+
+// deliver sends the event to the endpoint, retrying failed attempts. It returns false if ctx is done before the event
+// has been sent or dropped.
+func (n Notifier) deliver(ctx context.Context, e *endpoint, ev Event) bool {
+	log := n.log.WithValues("endpoint", e.Name, "event", ev.ID, "action", ev.Action)
+
+	body, err := json.Marshal(Envelope{Events: []Event{ev}})
+	if err != nil {
+		log.Error(err, "dropping event that can't be encoded")
+		e.mu.Lock()
+		e.status.Dropped++
+		e.mu.Unlock()
+		return true
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := e.send(ctx, body)
+
+		e.mu.Lock()
+		now := time.Now()
+		if err == nil {
+			e.status.Sent++
+			e.status.LastSuccess = &now
+			e.mu.Unlock()
+			log.V(5).Info("sent event")
+			return true
+		}
+		if ctx.Err() != nil {
+			e.mu.Unlock()
+			return false
+		}
+		e.status.Failures++
+		e.status.LastError = err.Error()
+		e.status.LastErrorTime = &now
+		if attempt > n.opts.MaxRetries {
+			e.status.Dropped++
+			e.mu.Unlock()
+			log.Error(err, "dropping event after failed attempts", "attempts", attempt)
+			return true
+		}
+		e.mu.Unlock()
+
+		delay := n.backoff(attempt)
+		log.Error(err, "failed sending event", "attempts", attempt, "retryIn", delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt after the given number of failed attempts.
+func (n Notifier) backoff(attempts int) time.Duration {
+	d := n.opts.MinBackoff
+	for i := 1; i < attempts && d < n.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, n.opts.MaxBackoff)
+}
+
+func (e *endpoint) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed creating request: %w", err)
+	}
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", EventsMediaType)
+	if e.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign([]byte(e.Secret), body))
+	}
+
+	resp, err := e.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed sending request: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the value of the SignatureHeader for a request with the given body sent to an endpoint with the given
+// secret. Receivers verify a request by comparing the header with the value they compute using hmac.Equal.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Status returns the delivery status of all endpoints.
+func (n Notifier) Status() []Status {
+	res := make([]Status, 0, len(n.endpoints))
+	for _, e := range n.endpoints {
+		e.mu.Lock()
+		s := e.status
+		s.Endpoint = e.Name
+		s.URL = e.redactedURL
+		s.Pending = len(e.queue)
+		e.mu.Unlock()
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package notifications_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/notifications"
+)
+
+// receiver is an endpoint that records all events it receives.
+type receiver struct {
+	*httptest.Server
+	mu      *sync.Mutex
+	events  *[]notifications.Event
+	headers *[]http.Header
+	bodies  *[][]byte
+	// fail is the number of requests that are still to be answered with an error.
+	fail *atomic.Int32
+}
+
+func newReceiver(t *testing.T) receiver {
+	t.Helper()
+
+	rcv := receiver{
+		mu:      &sync.Mutex{},
+		events:  &[]notifications.Event{},
+		headers: &[]http.Header{},
+		bodies:  &[][]byte{},
+		fail:    &atomic.Int32{},
+	}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rcv.fail.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var env notifications.Envelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rcv.mu.Lock()
+		*rcv.events = append(*rcv.events, env.Events...)
+		*rcv.headers = append(*rcv.headers, r.Header)
+		*rcv.bodies = append(*rcv.bodies, body)
+		rcv.mu.Unlock()
+	}))
+	t.Cleanup(rcv.Close)
+
+	return rcv
+}
+
+func (rcv receiver) received() []notifications.Event {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]notifications.Event{}, *rcv.events...)
+}
+
+func run(t *testing.T, n notifications.Notifier) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func newNotifier(t *testing.T, opts notifications.Options, endpoints ...notifications.Endpoint) notifications.Notifier {
+	t.Helper()
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 10 * time.Millisecond
+		opts.MaxBackoff = 20 * time.Millisecond
+	}
+	n, err := notifications.New(endpoints, opts, logr.Discard())
+	NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed creating notifier")
+	return n
+}
+
+func event(action, repo string) notifications.Event {
+	return notifications.Event{
+		Action: action,
+		Target: notifications.Target{
+			MediaType:  "application/octet-stream",
+			Digest:     "sha256:abc",
+			Repository: repo,
+		},
+	}
+}
+
+func TestSendsSignedEvents(t *testing.T) {
+	g := NewWithT(t)
+
+	rcv := newReceiver(t)
+	n := newNotifier(t, notifications.Options{Source: notifications.Source{Addr: "registry:8080"}}, notifications.Endpoint{
+		Name:    "ci",
+		URL:     rcv.URL,
+		Secret:  "s3cr3t",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	run(t, n)
+
+	for _, action := range []string{notifications.ActionPush, notifications.ActionDelete} {
+		n.Notify(event(action, "team/app"))
+	}
+	g.Eventually(rcv.received).Should(HaveLen(2))
+
+	evs := rcv.received()
+	g.Expect(evs[0].Action).To(Equal(notifications.ActionPush))
+	g.Expect(evs[1].Action).To(Equal(notifications.ActionDelete))
+	g.Expect(evs[0].ID).NotTo(BeEmpty())
+	g.Expect(evs[0].ID).NotTo(Equal(evs[1].ID))
+	g.Expect(evs[0].Timestamp).NotTo(BeZero())
+	g.Expect(evs[0].Source.Addr).To(Equal("registry:8080"))
+	g.Expect(evs[0].Target.Repository).To(Equal("team/app"))
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	hdr := (*rcv.headers)[0]
+	g.Expect(hdr.Get("Content-Type")).To(Equal(notifications.EventsMediaType))
+	g.Expect(hdr.Get("Authorization")).To(Equal("Bearer token"))
+	g.Expect(hdr.Get(notifications.SignatureHeader)).To(Equal(notifications.Sign([]byte("s3cr3t"), (*rcv.bodies)[0])))
+	g.Expect(hdr.Get(notifications.SignatureHeader)).To(HavePrefix("sha256="))
+
+	status := n.Status()
+	g.Expect(status).To(HaveLen(1))
+	g.Expect(status[0].Endpoint).To(Equal("ci"))
+	g.Expect(status[0].Sent).To(BeEquivalentTo(2))
+	g.Expect(status[0].Dropped).To(BeZero())
+	g.Expect(status[0].LastSuccess).NotTo(BeNil())
+}
+
+func TestFilters(t *testing.T) {
+	g := NewWithT(t)
+
+	rcv := newReceiver(t)
+	n := newNotifier(t, notifications.Options{}, notifications.Endpoint{
+		Name:              "ci",
+		URL:               rcv.URL,
+		Include:           []string{"team/*"},
+		Exclude:           []string{"*/scratch"},
+		Actions:           []string{notifications.ActionPush},
+		IgnoredMediaTypes: []string{"application/vnd.oci.image.index.v1+json"},
+	})
+	run(t, n)
+
+	n.Notify(event(notifications.ActionPull, "team/app"))
+	n.Notify(event(notifications.ActionPush, "team/scratch"))
+	n.Notify(event(notifications.ActionPush, "other/app"))
+	idx := event(notifications.ActionPush, "team/app")
+	idx.Target.MediaType = "application/vnd.oci.image.index.v1+json"
+	n.Notify(idx)
+	n.Notify(event(notifications.ActionPush, "team/app"))
+
+	g.Eventually(rcv.received).Should(HaveLen(1))
+	g.Consistently(rcv.received, 100*time.Millisecond).Should(HaveLen(1))
+	g.Expect(rcv.received()[0].Target.Repository).To(Equal("team/app"))
+	g.Expect(rcv.received()[0].Target.MediaType).To(Equal("application/octet-stream"))
+}
+
+func TestRetriesAndDrops(t *testing.T) {
+	g := NewWithT(t)
+
+	rcv := newReceiver(t)
+	n := newNotifier(t, notifications.Options{MaxRetries: 2}, notifications.Endpoint{Name: "ci", URL: rcv.URL})
+	run(t, n)
+
+	// the first event succeeds on its last attempt.
+	rcv.fail.Store(2)
+	n.Notify(event(notifications.ActionPush, "team/first"))
+	g.Eventually(rcv.received).Should(HaveLen(1))
+
+	// the second event is dropped after all attempts failed.
+	rcv.fail.Store(3)
+	n.Notify(event(notifications.ActionPush, "team/second"))
+	n.Notify(event(notifications.ActionPush, "team/third"))
+	g.Eventually(rcv.received).Should(HaveLen(2))
+	g.Expect(rcv.received()[1].Target.Repository).To(Equal("team/third"))
+
+	status := n.Status()[0]
+	g.Expect(status.Sent).To(BeEquivalentTo(2))
+	g.Expect(status.Failures).To(BeEquivalentTo(5))
+	g.Expect(status.Dropped).To(BeEquivalentTo(1))
+	g.Expect(status.LastError).To(Equal("unexpected status 503"))
+	g.Expect(status.Pending).To(BeZero())
+}
+
+func TestDropsEventsWhenQueueIsFull(t *testing.T) {
+	g := NewWithT(t)
+
+	n := newNotifier(t, notifications.Options{QueueSize: 2}, notifications.Endpoint{Name: "ci", URL: "http://127.0.0.1:1"})
+
+	for range 5 {
+		n.Notify(event(notifications.ActionPush, "team/app"))
+	}
+
+	status := n.Status()[0]
+	g.Expect(status.Pending).To(Equal(2))
+	g.Expect(status.Dropped).To(BeEquivalentTo(3))
+}
+
+func TestNewValidatesEndpoints(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints []notifications.Endpoint
+		err       string
+	}{
+		{"invalid name", []notifications.Endpoint{{Name: "a/b", URL: "http://a"}}, `invalid endpoint name "a/b"`},
+		{"duplicate name", []notifications.Endpoint{{Name: "a", URL: "http://a"}, {Name: "a", URL: "http://b"}}, `duplicate endpoint name "a"`},
+		{"invalid scheme", []notifications.Endpoint{{Name: "a", URL: "ftp://a"}}, `unsupported scheme "ftp" in URL of endpoint "a"`},
+		{"invalid pattern", []notifications.Endpoint{{Name: "a", URL: "http://a", Exclude: []string{"["}}}, `invalid repository pattern "["`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := notifications.New(tc.endpoints, notifications.Options{}, logr.Discard())
+			NewWithT(t).Expect(err).To(MatchError(ContainSubstring(tc.err)))
+		})
+	}
+}
+
+func TestPullEventsAreOptIn(t *testing.T) {
+	g := NewWithT(t)
+
+	rcv := newReceiver(t)
+	n := newNotifier(t, notifications.Options{}, notifications.Endpoint{Name: "ci", URL: rcv.URL})
+	run(t, n)
+
+	n.Notify(event(notifications.ActionPull, "team/app"))
+	n.Notify(event(notifications.ActionPush, "team/app"))
+
+	g.Eventually(rcv.received).Should(HaveLen(1))
+	g.Consistently(rcv.received, 100*time.Millisecond).Should(HaveLen(1))
+	g.Expect(rcv.received()[0].Action).To(Equal(notifications.ActionPush))
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/auth"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// accessFunc derives the access a request requires from its context.
+type accessFunc func(c *fiber.Ctx) []auth.Access
+
+// repoAccess requires the given actions on the repository addressed by the request.
+func repoAccess(actions ...string) accessFunc {
+	return func(c *fiber.Ctx) []auth.Access {
+		return []auth.Access{{
+			Type:    auth.TypeRepository,
+			Name:    repoName(c),
+			Actions: actions,
+		}}
+	}
+}
+
+func catalogAccess(_ *fiber.Ctx) []auth.Access {
+	return []auth.Access{{
+		Type:    auth.TypeRegistry,
+		Name:    auth.CatalogName,
+		Actions: []string{auth.ActionAll},
+	}}
+}
+
+// repoName returns the name of the repository addressed by the request. It must be called after the request path
+// has been validated.
+func repoName(c *fiber.Ctx) string {
+	if bid, ok := c.UserContext().Value(bidCtxKey).(types.BlobID); ok {
+		return fmt.Sprintf("%s/%s", bid.Namespace, bid.Repo)
+	}
+	if mid, ok := c.UserContext().Value(midCtxKey{}).(types.ManifestID); ok {
+		return fmt.Sprintf("%s/%s", mid.Namespace, mid.Repo)
+	}
+	return ""
+}
+
+// authorize returns a handler that only passes requests on to the next handler when their credentials permit the
+// access derived by af and the registry's authorizer permits that access for the authenticated user. All requests are
+// passed on if the registry has neither an authenticator nor an authorizer configured.
+func (r Registry) authorize(af accessFunc) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if r.authn == nil && r.authz == nil {
+			return c.Next()
+		}
+
+		var access []auth.Access
+		if af != nil {
+			access = af(c)
+		}
+
+		var user string
+		if r.authn != nil {
+			var err error
+			user, err = r.authn.Authenticate(c.Get(fiber.HeaderAuthorization), access)
+			if err != nil {
+				r.log.V(5).Info("request not authorized", "path", c.Path(), "error", err.Error())
+				c.Set(fiber.HeaderWWWAuthenticate, r.authn.Challenge(access, err))
+				return newError(fiber.StatusUnauthorized, ErrCodeUnauthorized, "authentication required", access)
+			}
+		}
+
+		if r.authz != nil && !auth.Covers(r.authz.Permitted(user, access), access) {
+			r.log.V(5).Info("request denied by policy", "path", c.Path(), "user", user)
+			return newError(fiber.StatusForbidden, ErrCodeDenied, "requested access to the resource is denied", access)
+		}
+
+		c.SetUserContext(context.WithValue(c.UserContext(), userCtxKey, user))
+
+		return c.Next()
+	}
+}
+
+// permits reports whether the credentials of the request and the authorizer permit the given access.
+func (r Registry) permits(c *fiber.Ctx, access ...auth.Access) bool {
+	if r.authn != nil {
+		if _, err := r.authn.Authenticate(c.Get(fiber.HeaderAuthorization), access); err != nil {
+			return false
+		}
+	}
+	if r.authz != nil {
+		return auth.Covers(r.authz.Permitted(requestUser(c), access), access)
+	}
+	return true
+}
+
+// requestUser returns the name of the user that has been authenticated for the request.
+func requestUser(c *fiber.Ctx) string {
+	user, _ := c.UserContext().Value(userCtxKey).(string)
+	return user
+}
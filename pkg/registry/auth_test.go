@@ -0,0 +1,296 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+	"github.com/makkes/garage/pkg/registry"
+)
+
+// testUsers contains the user alice with the password "secret".
+const testUsers = "alice:$2a$04$sCOj5Z24PjgEJu5ZhdAU8.09CnratC1BDbvv4uOFDHtR94y61HK8C"
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func newTokenAuthRegistry(t *testing.T) registry.Registry {
+	t.Helper()
+	g := NewWithT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred(), "failed generating key")
+
+	users, err := auth.ParseHtpasswd(strings.NewReader(testUsers))
+	g.Expect(err).NotTo(HaveOccurred(), "failed parsing users")
+
+	ti, err := auth.NewTokenIssuer("garage", "garage", key, time.Minute, users)
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating token issuer")
+
+	ta, err := auth.NewTokenAuthenticator("http://example.org/token", "garage", "garage", key.Public())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating token authenticator")
+
+	return newFileRegistry(t, registry.WithTokenIssuer(ti), registry.WithAuthenticator(ta))
+}
+
+func fetchToken(t *testing.T, r registry.Registry, authHdr string, scope string) string {
+	t.Helper()
+	g := NewWithT(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/token?service=garage&scope="+url.QueryEscape(scope), nil)
+	if authHdr != "" {
+		req.Header.Set("Authorization", authHdr)
+	}
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "fetching token failed")
+
+	var tr struct {
+		Token string `json:"token"`
+	}
+	g.Expect(json.NewDecoder(resp.Body).Decode(&tr)).To(Succeed(), "failed decoding token response")
+	g.Expect(tr.Token).NotTo(BeEmpty())
+
+	return tr.Token
+}
+
+func TestTokenAuthChallenges(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		expChallenge string
+	}{
+		{
+			name:         "base endpoint",
+			method:       http.MethodGet,
+			path:         "/v2/",
+			expChallenge: `Bearer realm="http://example.org/token",service="garage"`,
+		},
+		{
+			name:         "tag list",
+			method:       http.MethodGet,
+			path:         "/v2/ns/repo/tags/list",
+			expChallenge: `Bearer realm="http://example.org/token",service="garage",scope="repository:ns/repo:pull"`,
+		},
+		{
+			name:         "manifest push",
+			method:       http.MethodPut,
+			path:         "/v2/ns/repo/manifests/latest",
+			expChallenge: `Bearer realm="http://example.org/token",service="garage",scope="repository:ns/repo:pull,push"`,
+		},
+		{
+			name:         "blob delete",
+			method:       http.MethodDelete,
+			path:         "/v2/ns/repo/blobs/sha256:7a38bf81f383f69433ad6e900d35b3e2385593f76a7b7ab5d4355b8ba41ee24b",
+			expChallenge: `Bearer realm="http://example.org/token",service="garage",scope="repository:ns/repo:delete"`,
+		},
+		{
+			name:         "catalog",
+			method:       http.MethodGet,
+			path:         "/v2/_catalog",
+			expChallenge: `Bearer realm="http://example.org/token",service="garage",scope="registry:catalog:*"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newTokenAuthRegistry(t)
+
+			resp, err := r.Test(httptest.NewRequest(tt.method, tt.path, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("WWW-Authenticate", tt.expChallenge))
+		})
+	}
+}
+
+func TestTokenAuthFlow(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newTokenAuthRegistry(t)
+
+	tok := fetchToken(t, r, basicAuth("alice", "secret"), "repository:ns/repo:pull")
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/ns/repo/tags/list", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "request should have passed authentication")
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	req = httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", bytes.NewReader([]byte(`{"mediaType":"`+mt+`"}`)))
+	req.Header.Set("Content-Type", mt)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized), "push should have been denied with pull-only token")
+	g.Expect(resp.Header.Get("WWW-Authenticate")).To(ContainSubstring(`error="insufficient_scope"`))
+
+	tok = fetchToken(t, r, basicAuth("alice", "secret"), "repository:ns/repo:pull,push")
+	req = httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", bytes.NewReader(testManifest(t, r, "ns/repo", "Bearer "+tok)))
+	req.Header.Set("Content-Type", mt)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newTokenAuthRegistry(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/token?service=garage&scope=repository:ns/repo:pull", nil)
+	req.Header.Set("Authorization", basicAuth("alice", "wrong"))
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized), "wrong password should be rejected")
+	g.Expect(resp).To(HaveHTTPHeaderWithValue("WWW-Authenticate", `Basic realm="garage"`))
+	var errResp registry.ErrorResponse
+	g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+	g.Expect(errResp.Errors).To(HaveLen(1))
+	g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeUnauthorized))
+
+	for _, tc := range []struct {
+		query string
+		msg   string
+	}{
+		{query: "service=another&scope=repository:ns/repo:pull", msg: "unknown service should be rejected"},
+		{query: "service=garage&scope=repository:ns/repo", msg: "malformed scope should be rejected"},
+	} {
+		req = httptest.NewRequest(http.MethodGet, "/token?"+tc.query, nil)
+		req.Header.Set("Authorization", basicAuth("alice", "secret"))
+		resp, err = r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusBadRequest), tc.msg)
+		var errResp registry.ErrorResponse
+		g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), tc.msg)
+		g.Expect(errResp.Errors).To(HaveLen(1))
+		g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeUnsupported), tc.msg)
+	}
+
+	anonTok := fetchToken(t, r, "", "repository:ns/repo:pull")
+	req = httptest.NewRequest(http.MethodGet, "/v2/ns/repo/tags/list", nil)
+	req.Header.Set("Authorization", "Bearer "+anonTok)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized), "anonymous token shouldn't grant any access")
+}
+
+func TestBasicAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	users, err := auth.ParseHtpasswd(strings.NewReader(testUsers))
+	g.Expect(err).NotTo(HaveOccurred(), "failed parsing users")
+
+	r := newFileRegistry(t, registry.WithAuthenticator(auth.NewBasicAuthenticator("garage", users)))
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized))
+	g.Expect(resp).To(HaveHTTPHeaderWithValue("WWW-Authenticate", `Basic realm="garage"`))
+
+	for _, path := range []string{"/v2/", "/v2/ns/repo/tags/list", "/v2/_catalog"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", basicAuth("alice", "wrong"))
+		resp, err = r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusUnauthorized), "wrong password should be rejected for %s", path)
+
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", basicAuth("alice", "secret"))
+		resp, err = r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp.StatusCode).NotTo(Equal(http.StatusUnauthorized), "valid credentials should be accepted for %s", path)
+	}
+}
+
+func TestPolicyDeniesAccess(t *testing.T) {
+	g := NewWithT(t)
+
+	users, err := auth.ParseHtpasswd(strings.NewReader(testUsers))
+	g.Expect(err).NotTo(HaveOccurred(), "failed parsing users")
+
+	policy, err := auth.ParsePolicy(strings.NewReader(`
+rules:
+  - users: [alice]
+    repositories: ["team-a/*"]
+    actions: [pull, push, list]
+  - users: ["*"]
+    repositories: ["public/*"]
+    actions: [pull]
+`))
+	g.Expect(err).NotTo(HaveOccurred(), "failed parsing policy")
+
+	r := newFileRegistry(t,
+		registry.WithAuthenticator(auth.NewBasicAuthenticator("garage", users)),
+		registry.WithAuthorizer(policy),
+	)
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	mf := testManifest(t, r, "team-a/app", basicAuth("alice", "secret"))
+	for _, repo := range []string{"team-a/app", "public/app"} {
+		req := httptest.NewRequest(http.MethodPut, "/v2/"+repo+"/manifests/latest", bytes.NewReader(mf))
+		req.Header.Set("Content-Type", mt)
+		req.Header.Set("Authorization", basicAuth("alice", "secret"))
+		resp, err := r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		if repo == "public/app" {
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusForbidden), "push to %s should have been denied", repo)
+			var errResp registry.ErrorResponse
+			g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			g.Expect(errResp.Errors).To(HaveLen(1))
+			g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeDenied))
+			continue
+		}
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "push to %s should have been permitted", repo)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/team-a/app/manifests/latest", nil)
+	req.Header.Set("Authorization", basicAuth("alice", "secret"))
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+
+	req = httptest.NewRequest(http.MethodDelete, "/v2/team-a/app/manifests/latest", nil)
+	req.Header.Set("Authorization", basicAuth("alice", "secret"))
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusForbidden), "delete should have been denied")
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/_catalog", nil)
+	req.Header.Set("Authorization", basicAuth("alice", "secret"))
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	var cat struct {
+		Repositories []string `json:"repositories"`
+	}
+	g.Expect(json.NewDecoder(resp.Body).Decode(&cat)).To(Succeed())
+	g.Expect(cat.Repositories).To(Equal([]string{"team-a/app"}), "catalog should only list permitted repositories")
+}
@@ -4,14 +4,19 @@
 package registry
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 
+	"github.com/makkes/garage/pkg/auth"
 	"github.com/makkes/garage/pkg/features"
+	"github.com/makkes/garage/pkg/notifications"
 	"github.com/makkes/garage/pkg/storage"
 	"github.com/makkes/garage/pkg/types"
 )
@@ -21,41 +26,121 @@ func (r Registry) handleBlobSessionPost(c *fiber.Ctx) error {
 		r.log.V(8).Info("POST request with non-zero content length", "content-length", c.Request().Header.ContentLength())
 	}
 
-	sid, err := r.store.StartSession()
+	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
+
+	if dig := c.Query("digest"); dig != "" {
+		return r.handleBlobMonolithicPost(c, bid, dig)
+	}
+
+	if mount := c.Query("mount"); mount != "" {
+		if dig, ok := r.mountBlob(c, bid, mount, c.Query("from")); ok {
+			bid.Digest = dig
+			r.notifyBlob(c, notifications.ActionMount, bid, -1, c.Query("from"))
+			c.Set(fiber.HeaderLocation, fmt.Sprintf("/v2/%s/%s/blobs/%s", bid.Namespace, bid.Repo, dig))
+			if r.features.Enabled(features.SendLegacyDigestHeader) {
+				c.Set("Docker-Content-Digest", dig.String())
+			}
+			return c.SendStatus(fiber.StatusCreated)
+		}
+	}
+
+	sid, err := r.store.StartSession(bid.Namespace, bid.Repo)
 	if err != nil {
-		r.log.Error(err, "failed starting session")
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed starting session")
+		return fmt.Errorf("failed starting session: %w", err)
 	}
 
-	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
 	sids := sid.String()
 
 	c.Location(fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", bid.Namespace, bid.Repo, sids))
 	return c.SendStatus(fiber.StatusAccepted)
 }
 
+// handleBlobMonolithicPost stores a blob that is uploaded in the body of a single POST request.
+func (r Registry) handleBlobMonolithicPost(c *fiber.Ctx, bid types.BlobID, digP string) error {
+	dig, err := types.ParseDigest(digP)
+	if err != nil {
+		return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": digP})
+	}
+
+	var b io.Reader = c.Request().BodyStream()
+	if b == nil {
+		b = bytes.NewReader(c.Body())
+	}
+	cr := &countingReader{Reader: b}
+
+	bid.Digest = dig
+	if _, err := r.store.StoreBlob(bid, cr); err != nil {
+		if errors.As(err, &storage.ErrDigestMismatch{}) {
+			return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": dig.String()})
+		}
+		return fmt.Errorf("failed storing blob: %w", err)
+	}
+	r.notifyBlob(c, notifications.ActionPush, bid, cr.n, "")
+
+	c.Set(fiber.HeaderLocation, fmt.Sprintf("/v2/%s/%s/blobs/%s", bid.Namespace, bid.Repo, dig))
+	if r.features.Enabled(features.SendLegacyDigestHeader) {
+		c.Set("Docker-Content-Digest", dig.String())
+	}
+
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// mountBlob tries to link the blob with the given digest from the repository named by from into the repository
+// identified by bid. It reports whether the blob has been mounted. If it hasn't, the client is expected to upload the
+// blob in a regular upload session.
+func (r Registry) mountBlob(c *fiber.Ctx, bid types.BlobID, mount, from string) (types.Digest, bool) {
+	log := r.log.WithValues("namespace", bid.Namespace, "repo", bid.Repo, "mount", mount, "from", from)
+
+	dig, err := types.ParseDigest(mount)
+	if err != nil {
+		log.V(5).Info("not mounting blob with invalid digest", "error", err.Error())
+		return types.Digest{}, false
+	}
+
+	if !r.nsRE.MatchString(from) {
+		log.V(5).Info("not mounting blob from invalid repository")
+		return types.Digest{}, false
+	}
+
+	fromNs, fromRepo, err := parseName(from)
+	if err != nil {
+		log.V(5).Info("not mounting blob from invalid repository", "error", err.Error())
+		return types.Digest{}, false
+	}
+
+	if !r.permits(c, auth.Access{Type: auth.TypeRepository, Name: from, Actions: []string{auth.ActionPull}}) {
+		log.V(5).Info("not mounting blob from repository without pull access")
+		return types.Digest{}, false
+	}
+
+	bid.Digest = dig
+	if err := r.store.MountBlob(bid, fromNs, fromRepo); err != nil {
+		if !errors.As(err, &storage.ErrNotFound{}) {
+			log.Error(err, "failed mounting blob")
+		}
+		return types.Digest{}, false
+	}
+
+	return dig, true
+}
+
 func (r Registry) handleBlobGet(c *fiber.Ctx) error {
 	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
 	sid, err := uuid.Parse(c.Params("uuid"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).
-			SendString(fmt.Sprintf("invalid session ID %q", c.Params("uuid")))
+		return uploadUnknown(c.Params("uuid"))
 	}
 
-	size, err := r.store.GetSessionInfo(sid)
+	info, err := r.sessionInfo(sid, bid)
 	if err != nil {
 		if errors.As(err, &storage.ErrSessionNotFound{}) {
-			return c.Status(fiber.StatusNotFound).
-				SendString("session not found")
+			return uploadUnknown(sid.String())
 		}
-		r.log.Error(err, "failed retrieving session data", "session", sid)
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed retrieving session data")
+		return fmt.Errorf("failed retrieving session data: %w", err)
 	}
 
 	c.Location(fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", bid.Namespace, bid.Repo, sid.String()))
-	c.Response().Header.Add("Range", fmt.Sprintf("0-%d", size-1))
+	c.Response().Header.Add("Range", fmt.Sprintf("0-%d", info.Size-1))
 
 	return c.SendStatus(fiber.StatusNoContent)
 }
@@ -63,36 +148,37 @@ func (r Registry) handleBlobGet(c *fiber.Ctx) error {
 func (r Registry) handleBlobPatch(c *fiber.Ctx) error {
 	ct := c.Request().Header.ContentType()
 	if len(ct) != 0 && string(ct) != "application/octet-stream" {
-		r.log.V(8).Info("POST request with invalid content type", "content-type", ct)
-		return c.Status(fiber.StatusBadRequest).
-			SendString(fmt.Sprintf("content-type must be 'application/octet-stream' but is %q", string(ct)))
+		return newError(fiber.StatusBadRequest, ErrCodeBlobUploadInvalid, "content-type must be 'application/octet-stream'",
+			map[string]string{"contentType": string(ct)})
 	}
 
 	b := c.Request().BodyStream()
 	if b == nil {
-		return c.Status(fiber.StatusBadRequest).
-			SendString("no data in request body")
+		return newError(fiber.StatusBadRequest, ErrCodeBlobUploadInvalid, "no data in request body", nil)
 	}
 
 	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
 	sid, err := uuid.Parse(c.Params("uuid"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).
-			SendString(fmt.Sprintf("invalid session ID %q", c.Params("uuid")))
+		return uploadUnknown(c.Params("uuid"))
+	}
+
+	if _, err := r.sessionInfo(sid, bid); err != nil {
+		if errors.As(err, &storage.ErrSessionNotFound{}) {
+			return uploadUnknown(sid.String())
+		}
+		return fmt.Errorf("failed retrieving session data: %w", err)
 	}
 
 	eor, err := r.store.StoreSessionData(sid, b, c.Get(fiber.HeaderContentRange))
 	if err != nil {
 		if errors.As(err, &storage.ErrSessionNotFound{}) {
-			return c.Status(fiber.StatusNotFound).
-				SendString("session not found")
+			return uploadUnknown(sid.String())
 		} else if errors.As(err, &storage.ErrOutOfOrderChunk{}) {
-			r.log.Error(err, "out-of-order chunk received")
-			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+			return newError(fiber.StatusRequestedRangeNotSatisfiable, ErrCodeBlobUploadInvalid, err.Error(),
+				map[string]string{"uuid": sid.String(), "range": c.Get(fiber.HeaderContentRange)})
 		}
-		r.log.Error(err, "failed storing session data", "session", sid)
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed storing session data")
+		return fmt.Errorf("failed storing session data: %w", err)
 	}
 
 	c.Location(fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", bid.Namespace, bid.Repo, sid.String()))
@@ -102,43 +188,56 @@ func (r Registry) handleBlobPatch(c *fiber.Ctx) error {
 }
 
 func (r Registry) handleBlobPut(c *fiber.Ctx) error {
-	dig := c.Queries()["digest"]
-	if dig == "" {
-		return c.Status(fiber.StatusBadRequest).
-			SendString("'digest' query parameter missing")
+	digP := c.Queries()["digest"]
+	if digP == "" {
+		return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, "'digest' query parameter missing", nil)
+	}
+
+	dig, err := types.ParseDigest(digP)
+	if err != nil {
+		return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": digP})
 	}
 
 	sid, err := uuid.Parse(c.Params("uuid"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).
-			SendString(fmt.Sprintf("invalid session ID %q", c.Params("uuid")))
+		return uploadUnknown(c.Params("uuid"))
 	}
 
+	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
+	info, err := r.sessionInfo(sid, bid)
+	if err != nil {
+		if errors.As(err, &storage.ErrSessionNotFound{}) {
+			return uploadUnknown(sid.String())
+		}
+		return fmt.Errorf("failed retrieving session data: %w", err)
+	}
+
+	size := info.Size
 	b := c.Request().BodyStream()
 	if b != nil {
-		_, err := r.store.StoreSessionData(sid, b, c.Get(fiber.HeaderContentRange))
+		eor, err := r.store.StoreSessionData(sid, b, c.Get(fiber.HeaderContentRange))
 		if err != nil {
 			if errors.As(err, &storage.ErrSessionNotFound{}) {
-				return c.Status(fiber.StatusNotFound).
-					SendString("session not found")
+				return uploadUnknown(sid.String())
 			}
-			r.log.Error(err, "failed storing session data", "session", sid)
-			return c.Status(http.StatusInternalServerError).
-				SendString("failed storing session data")
+			return fmt.Errorf("failed storing session data: %w", err)
 		}
+		size = eor + 1
 	}
 
-	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
+	bid.Digest = dig
 	resDig, err := r.store.CloseSession(sid, bid)
 	if err != nil {
 		if errors.As(err, &storage.ErrSessionNotFound{}) {
-			return c.Status(fiber.StatusNotFound).
-				SendString("session not found")
+			return uploadUnknown(sid.String())
+		}
+		if errors.As(err, &storage.ErrDigestMismatch{}) {
+			return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": dig.String()})
 		}
-		r.log.Error(err, "failed closing session", "session", sid)
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed closing session")
+		return fmt.Errorf("failed closing session: %w", err)
 	}
+	bid.Digest = resDig
+	r.notifyBlob(c, notifications.ActionPush, bid, size, "")
 
 	c.Set(fiber.HeaderLocation, fmt.Sprintf("/v2/%s/%s/blobs/%s", bid.Namespace, bid.Repo, resDig))
 	if r.features.Enabled(features.SendLegacyDigestHeader) {
@@ -147,3 +246,87 @@ func (r Registry) handleBlobPut(c *fiber.Ctx) error {
 
 	return c.SendStatus(fiber.StatusCreated)
 }
+
+// handleBlobSessionDelete cancels an upload session, discarding all data uploaded so far.
+func (r Registry) handleBlobSessionDelete(c *fiber.Ctx) error {
+	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
+	sid, err := uuid.Parse(c.Params("uuid"))
+	if err != nil {
+		return uploadUnknown(c.Params("uuid"))
+	}
+
+	if _, err := r.sessionInfo(sid, bid); err != nil {
+		if errors.As(err, &storage.ErrSessionNotFound{}) {
+			return uploadUnknown(sid.String())
+		}
+		return fmt.Errorf("failed retrieving session data: %w", err)
+	}
+
+	if err := r.store.CancelSession(sid); err != nil {
+		if errors.As(err, &storage.ErrSessionNotFound{}) {
+			return uploadUnknown(sid.String())
+		}
+		return fmt.Errorf("failed cancelling session: %w", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// sessionInfo returns information about the upload session. Sessions that have been started for another repository
+// than the one identified by bid are reported as not found so that clients can't hijack them. The same goes for expired
+// sessions even if the janitor hasn't removed them, yet.
+func (r Registry) sessionInfo(sid uuid.UUID, bid types.BlobID) (storage.SessionInfo, error) {
+	info, err := r.store.GetSessionInfo(sid)
+	if err != nil {
+		return info, err
+	}
+
+	if info.Namespace != bid.Namespace || info.Repo != bid.Repo {
+		return info, storage.ErrSessionNotFound{Err: fmt.Errorf("session belongs to another repository")}
+	}
+
+	if r.sessionTTL > 0 && time.Since(info.LastActivity) > r.sessionTTL {
+		return info, storage.ErrSessionNotFound{Err: fmt.Errorf("session expired at %s", info.LastActivity.Add(r.sessionTTL))}
+	}
+
+	return info, nil
+}
+
+// RunSessionJanitor removes expired upload sessions from the store every interval until ctx is done. It returns
+// immediately if sessions don't expire.
+func (r Registry) RunSessionJanitor(ctx context.Context, interval time.Duration) {
+	if r.sessionTTL == 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := r.store.ExpireSessions(time.Now().Add(-r.sessionTTL))
+			if err != nil {
+				r.log.Error(err, "failed expiring upload sessions")
+				continue
+			}
+			if n > 0 {
+				r.log.V(3).Info("expired upload sessions", "count", n)
+			}
+		}
+	}
+}
+
+// countingReader counts the bytes read from the wrapped reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,323 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func newFileRegistry(t *testing.T, opts ...registry.Opt) registry.Registry {
+	t.Helper()
+	g := NewWithT(t)
+
+	s, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed initializing file storage backend")
+
+	r, err := registry.New(append([]registry.Opt{registry.WithStorage(s), registry.WithLogger(logr.Discard())}, opts...)...)
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+
+	return r
+}
+
+func uploadBlob(t *testing.T, r registry.Registry, name string, blob []byte) types.Digest {
+	t.Helper()
+	g := NewWithT(t)
+
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(blob))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/"+name+"/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+
+	req := httptest.NewRequest(http.MethodPut, resp.Header.Get("Location")+"?digest="+dig.String(), bytes.NewReader(blob))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "closing upload session failed")
+
+	return dig
+}
+
+func TestMountBlob(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+	dig := uploadBlob(t, r, "staging/app", []byte("some layer"))
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/prod/app/blobs/uploads/?mount="+dig.String()+"&from=staging/app", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "mounting blob failed")
+	g.Expect(resp).To(HaveHTTPHeaderWithValue("Location", "/v2/prod/app/blobs/"+dig.String()))
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodGet, "/v2/prod/app/blobs/"+dig.String(), nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "fetching mounted blob failed")
+	g.Expect(resp).To(HaveHTTPBody([]byte("some layer")))
+}
+
+func TestMountBlobFallsBackToUploadSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{
+			name:  "unknown source repository",
+			query: "?mount=sha256:4e2ef6d8c6b6d66b4b6bf8ac9ba9c4cde5e1e2e4df9e8bb9e8d06d4b4e6d4a11&from=does-not/exist",
+		},
+		{
+			name:  "invalid digest",
+			query: "?mount=foo&from=staging/app",
+		},
+		{
+			name:  "path traversal in digest",
+			query: "?mount=sha256:..%2F..%2F..%2F..%2F..%2F..%2Fescaped&from=staging/app",
+		},
+		{
+			name:  "uppercase digest encoding",
+			query: "?mount=sha256:4E2EF6D8C6B6D66B4B6BF8AC9BA9C4CDE5E1E2E4DF9E8BB9E8D06D4B4E6D4A11&from=staging/app",
+		},
+		{
+			name:  "invalid source repository",
+			query: "?mount=sha256:4e2ef6d8c6b6d66b4b6bf8ac9ba9c4cde5e1e2e4df9e8bb9e8d06d4b4e6d4a11&from=-invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newFileRegistry(t)
+
+			resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/prod/app/blobs/uploads/"+tt.query, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted))
+			g.Expect(resp.Header.Get("Location")).To(HavePrefix("/v2/prod/app/blobs/uploads/"))
+		})
+	}
+}
+
+func TestMonolithicBlobUpload(t *testing.T) {
+	blob := []byte("some config")
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("failed calculating digest: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		digest        string
+		expStatusCode int
+		expLocation   string
+	}{
+		{
+			name:          "matching digest",
+			digest:        dig.String(),
+			expStatusCode: http.StatusCreated,
+			expLocation:   "/v2/ns/repo/blobs/" + dig.String(),
+		},
+		{
+			name:          "mismatching digest",
+			digest:        "sha256:4e2ef6d8c6b6d66b4b6bf8ac9ba9c4cde5e1e2e4df9e8bb9e8d06d4b4e6d4a11",
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "unsupported digest algorithm",
+			digest:        "md5:0c7c5c0e0e2b8a1d4e1d3b3f2e4e6a8b",
+			expStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newFileRegistry(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/v2/ns/repo/blobs/uploads/?digest="+tt.digest, bytes.NewReader(blob))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			resp, err := r.Test(req)
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(tt.expStatusCode))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Location", tt.expLocation))
+
+			expPullStatus := http.StatusNotFound
+			if tt.expStatusCode == http.StatusCreated {
+				expPullStatus = http.StatusOK
+			}
+			resp, err = r.Test(httptest.NewRequest(http.MethodGet, "/v2/ns/repo/blobs/"+dig.String(), nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(expPullStatus))
+		})
+	}
+}
+
+func TestCloseSessionWithWrongDigest(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/ns/repo/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+	loc := resp.Header.Get("Location")
+
+	req := httptest.NewRequest(http.MethodPut, loc+"?digest=sha512:"+strings.Repeat("ab", 64), bytes.NewReader([]byte("some layer")))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusBadRequest))
+
+	var errResp registry.ErrorResponse
+	g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+	g.Expect(errResp.Errors).To(HaveLen(1))
+	g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeDigestInvalid))
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodGet, loc, nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "session should have been discarded")
+}
+
+func TestUploadAndPullSHA512Blob(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	blob := []byte("some layer")
+	dig, err := types.NewDigest(types.AlgoSHA512, bytes.NewReader(blob))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+
+	for _, repo := range []string{"monolithic", "session"} {
+		var resp *http.Response
+		if repo == "monolithic" {
+			resp, err = r.Test(httptest.NewRequest(http.MethodPost, "/v2/ns/"+repo+"/blobs/uploads/?digest="+dig.String(), bytes.NewReader(blob)))
+		} else {
+			resp, err = r.Test(httptest.NewRequest(http.MethodPost, "/v2/ns/"+repo+"/blobs/uploads/", nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+			resp, err = r.Test(httptest.NewRequest(http.MethodPut, resp.Header.Get("Location")+"?digest="+dig.String(), bytes.NewReader(blob)))
+		}
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "%s upload failed", repo)
+		g.Expect(resp).To(HaveHTTPHeaderWithValue("Location", "/v2/ns/"+repo+"/blobs/"+dig.String()))
+
+		resp, err = r.Test(httptest.NewRequest(http.MethodGet, "/v2/ns/"+repo+"/blobs/"+dig.String(), nil))
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "%s pull failed", repo)
+		g.Expect(resp).To(HaveHTTPBody(blob))
+	}
+}
+
+func TestExpiredSessionIsUnknown(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t, registry.WithSessionTTL(100*time.Millisecond))
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/ns/repo/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+	loc := resp.Header.Get("Location")
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodGet, loc, nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNoContent), "fresh session should be known")
+
+	time.Sleep(200 * time.Millisecond)
+
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodPut} {
+		req := httptest.NewRequest(method, loc+"?digest=sha256:7a38bf81f383f69433ad6e900d35b3e2385593f76a7b7ab5d4355b8ba41ee24b",
+			bytes.NewReader([]byte("some layer")))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err = r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "%s on expired session should fail", method)
+
+		var errResp registry.ErrorResponse
+		g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+		g.Expect(errResp.Errors).To(HaveLen(1))
+		g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeBlobUploadUnknown))
+	}
+}
+
+func TestSessionIsBoundToRepository(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	blob := []byte("some layer")
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(blob))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/a/b/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+	loc := resp.Header.Get("Location")
+	foreignLoc := strings.Replace(loc, "/v2/a/b/", "/v2/x/y/", 1)
+
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodPut} {
+		req := httptest.NewRequest(method, foreignLoc+"?digest="+dig.String(), bytes.NewReader(blob))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err = r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "%s via other repository should fail", method)
+
+		var errResp registry.ErrorResponse
+		g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+		g.Expect(errResp.Errors).To(HaveLen(1))
+		g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeBlobUploadUnknown))
+	}
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodGet, "/v2/x/y/blobs/"+dig.String(), nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "blob shouldn't have been linked into other repository")
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodPut, loc+"?digest="+dig.String(), bytes.NewReader(blob)))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "closing session in its own repository failed")
+}
+
+func TestCancelSession(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	resp, err := r.Test(httptest.NewRequest(http.MethodPost, "/v2/ns/repo/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "starting upload session failed")
+	loc := resp.Header.Get("Location")
+
+	req := httptest.NewRequest(http.MethodPatch, loc, bytes.NewReader([]byte("some data")))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted), "uploading chunk failed")
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodDelete, loc, nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNoContent), "cancelling session failed")
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		resp, err = r.Test(httptest.NewRequest(method, loc, nil))
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), "%s on cancelled session should fail", method)
+
+		var errResp registry.ErrorResponse
+		g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+		g.Expect(errResp.Errors).To(HaveLen(1))
+		g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeBlobUploadUnknown))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of bytes with inclusive first and last positions as used in Range and Content-Range headers.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// parseByteRange parses the value of a Range header for content of the given size. It returns nil if the whole
+// content is to be served, i.e. if there is no header, it's malformed or it requests multiple ranges which aren't
+// supported. errRangeNotSatisfiable is returned if the range doesn't overlap with the content.
+func parseByteRange(hdr string, size int64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(hdr, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	if startStr == "" {
+		// a suffix range requesting the last n bytes.
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		return &byteRange{start: max(size-n, 0), end: size - 1}, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+	}
+
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+
+	return &byteRange{start: start, end: min(end, size-1)}, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/auth"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func (r Registry) handleCatalog(c *fiber.Ctx) error {
+	repos, err := r.store.Repositories()
+	if err != nil {
+		return fmt.Errorf("failed fetching repositories from storage: %w", err)
+	}
+
+	if r.authz != nil {
+		user := requestUser(c)
+		listable := make([]string, 0, len(repos))
+		for _, repo := range repos {
+			if len(r.authz.Permitted(user, []auth.Access{{
+				Type:    auth.TypeRepository,
+				Name:    repo,
+				Actions: []string{auth.ActionList},
+			}})) > 0 {
+				listable = append(listable, repo)
+			}
+		}
+		repos = listable
+	}
+
+	return c.JSON(types.Catalog{
+		Repositories: paginate(c, repos, "/v2/_catalog"),
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+func TestCatalog(t *testing.T) {
+	r := newFileRegistry(t)
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	for _, name := range []string{"team-b/app", "team-a/app", "team-a/sub/tool"} {
+		req := httptest.NewRequest(http.MethodPut, "/v2/"+name+"/manifests/latest", bytes.NewReader(testManifest(t, r, name, "")))
+		req.Header.Add("Content-Type", mt)
+		resp, err := r.Test(req)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("failed pushing manifest to %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expRepos []string
+		expLink  string
+	}{
+		{
+			name:     "all repositories",
+			expRepos: []string{"team-a/app", "team-a/sub/tool", "team-b/app"},
+		},
+		{
+			name:     "first page",
+			query:    "?n=2",
+			expRepos: []string{"team-a/app", "team-a/sub/tool"},
+			expLink:  `</v2/_catalog?n=2&last=team-a%2Fsub%2Ftool>; rel="next"`,
+		},
+		{
+			name:     "last page",
+			query:    "?n=2&last=team-a%2Fsub%2Ftool",
+			expRepos: []string{"team-b/app"},
+		},
+		{
+			name:     "unknown marker",
+			query:    "?last=team-a%2Fb",
+			expRepos: []string{"team-a/sub/tool", "team-b/app"},
+		},
+		{
+			name:     "empty page",
+			query:    "?n=0",
+			expRepos: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			resp, err := r.Test(httptest.NewRequest(http.MethodGet, "/v2/_catalog"+tt.query, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Link", tt.expLink))
+
+			var cat types.Catalog
+			g.Expect(json.NewDecoder(resp.Body).Decode(&cat)).To(Succeed(), "failed decoding response body")
+			g.Expect(cat.Repositories).To(Equal(tt.expRepos))
+		})
+	}
+}
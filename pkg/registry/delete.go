@@ -5,9 +5,11 @@ package registry
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/gofiber/fiber/v2"
 
+	"github.com/makkes/garage/pkg/notifications"
 	"github.com/makkes/garage/pkg/storage"
 	"github.com/makkes/garage/pkg/types"
 )
@@ -15,16 +17,13 @@ import (
 func (r Registry) handleManifestDelete(c *fiber.Ctx) error {
 	mid := c.UserContext().Value(midCtxKey{}).(types.ManifestID)
 
-	log := r.log.WithValues("namespace", mid.Namespace, "repo", mid.Repo, "tag", mid.Tag, "digest", mid.Digest)
-
 	if err := r.store.DeleteManifest(mid); err != nil {
 		if errors.As(err, &storage.ErrNotFound{}) {
-			return c.SendStatus(fiber.StatusNotFound)
+			return manifestUnknown(mid)
 		}
-		log.Error(err, "failed deleting manifest")
-		return c.Status(fiber.StatusInternalServerError).
-			SendString("failed deleting manifest from storage")
+		return fmt.Errorf("failed deleting manifest from storage: %w", err)
 	}
+	r.notifyManifest(c, notifications.ActionDelete, mid, "", 0)
 
 	return c.SendStatus(fiber.StatusAccepted)
 }
@@ -32,16 +31,13 @@ func (r Registry) handleManifestDelete(c *fiber.Ctx) error {
 func (r Registry) handleBlobDelete(c *fiber.Ctx) error {
 	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
 
-	log := r.log.WithValues("namespace", bid.Namespace, "repo", bid.Repo, "digest", bid.Digest)
-
 	if err := r.store.DeleteBlob(bid); err != nil {
 		if errors.As(err, &storage.ErrNotFound{}) {
-			return c.SendStatus(fiber.StatusNotFound)
+			return blobUnknown(bid.Digest)
 		}
-		log.Error(err, "failed deleting blob")
-		return c.Status(fiber.StatusInternalServerError).
-			SendString("failed deleting blob from storage")
+		return fmt.Errorf("failed deleting blob from storage: %w", err)
 	}
+	r.notifyBlob(c, notifications.ActionDelete, bid, 0, "")
 
 	return c.SendStatus(fiber.StatusAccepted)
 }
@@ -3,16 +3,139 @@
 
 package registry
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+// Error codes as defined by the OCI distribution spec.
 const (
-	ErrCodeBlobUnknown     = "BLOB_UNKNOWN"
-	ErrCodeManifestInvalid = "MANIFEST_INVALID"
+	ErrCodeBlobUnknown         = "BLOB_UNKNOWN"
+	ErrCodeBlobUploadInvalid   = "BLOB_UPLOAD_INVALID"
+	ErrCodeBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	ErrCodeDenied              = "DENIED"
+	ErrCodeDigestInvalid       = "DIGEST_INVALID"
+	ErrCodeManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	ErrCodeManifestInvalid     = "MANIFEST_INVALID"
+	ErrCodeManifestUnknown     = "MANIFEST_UNKNOWN"
+	ErrCodeNameInvalid         = "NAME_INVALID"
+	ErrCodeNameUnknown         = "NAME_UNKNOWN"
+	ErrCodeSizeInvalid         = "SIZE_INVALID"
+	ErrCodeTooManyRequests     = "TOOMANYREQUESTS"
+	ErrCodeUnauthorized        = "UNAUTHORIZED"
+	ErrCodeUnsupported         = "UNSUPPORTED"
+	// ErrCodeUnknown is sent for internal server errors. It is not part of the spec but used by the reference
+	// implementation of the distribution API.
+	ErrCodeUnknown = "UNKNOWN"
 )
 
 type Error struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
 }
 
 type ErrorResponse struct {
 	Errors []Error `json:"errors"`
 }
+
+// apiError is returned by handlers to have the error handler send the errors to the client with the given HTTP
+// status.
+type apiError struct {
+	status int
+	errors []Error
+}
+
+func (e apiError) Error() string {
+	msgs := make([]string, len(e.errors))
+	for idx, err := range e.errors {
+		msgs[idx] = err.Code + ": " + err.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// newError returns an error that is sent to the client as a single error with the given code, message and detail.
+func newError(status int, code, msg string, detail interface{}) error {
+	return apiError{
+		status: status,
+		errors: []Error{{Code: code, Message: msg, Detail: detail}},
+	}
+}
+
+// uploadUnknown returns the error for requests referencing an upload session that doesn't exist.
+func uploadUnknown(sid string) error {
+	return newError(fiber.StatusNotFound, ErrCodeBlobUploadUnknown, "blob upload unknown to registry",
+		map[string]string{"uuid": sid})
+}
+
+// fiberErrorCodes maps the status of errors returned by fiber itself, e.g. for unknown routes, to error codes.
+var fiberErrorCodes = map[int]string{
+	fiber.StatusUnauthorized:          ErrCodeUnauthorized,
+	fiber.StatusForbidden:             ErrCodeDenied,
+	fiber.StatusNotFound:              ErrCodeNameUnknown,
+	fiber.StatusMethodNotAllowed:      ErrCodeUnsupported,
+	fiber.StatusRequestEntityTooLarge: ErrCodeSizeInvalid,
+	fiber.StatusTooManyRequests:       ErrCodeTooManyRequests,
+}
+
+// fiberErrorCode returns the error code for an error with the given status returned by fiber itself. Bad requests
+// are reported as invalid manifests on manifest routes and as invalid names everywhere else.
+func fiberErrorCode(c *fiber.Ctx, status int) string {
+	if status == fiber.StatusBadRequest {
+		if strings.Contains(c.Path(), "/manifests/") {
+			return ErrCodeManifestInvalid
+		}
+		return ErrCodeNameInvalid
+	}
+	if code, ok := fiberErrorCodes[status]; ok {
+		return code
+	}
+	return ErrCodeUnknown
+}
+
+// handleError is the error handler of the registry's fiber app. It sends every error returned by a handler to the
+// client as an ErrorResponse. Errors other than apiErrors and fiber errors are treated as internal server errors.
+func (r Registry) handleError(c *fiber.Ctx, err error) error {
+	var ae apiError
+	if errors.As(err, &ae) {
+		return c.Status(ae.status).JSON(ErrorResponse{Errors: ae.errors})
+	}
+
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return c.Status(fe.Code).JSON(ErrorResponse{Errors: []Error{{
+			Code:    fiberErrorCode(c, fe.Code),
+			Message: fe.Message,
+			Detail:  map[string]string{"method": c.Method(), "path": c.Path()},
+		}}})
+	}
+
+	r.log.Error(err, "request failed", "method", c.Method(), "path", c.Path())
+	return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{Errors: []Error{{
+		Code:    ErrCodeUnknown,
+		Message: "internal server error",
+		Detail:  map[string]string{"method": c.Method(), "path": c.Path()},
+	}}})
+}
+
+// nameInvalid returns the error for requests addressing a repository by an invalid name.
+func nameInvalid(status int, name, msg string) error {
+	return newError(status, ErrCodeNameInvalid, msg, map[string]string{"name": name})
+}
+
+// blobUnknown returns the error for requests referencing a blob that doesn't exist.
+func blobUnknown(dig types.Digest) error {
+	return newError(fiber.StatusNotFound, ErrCodeBlobUnknown, "blob unknown to registry",
+		map[string]string{"digest": dig.String()})
+}
+
+// manifestUnknown returns the error for requests referencing a manifest that doesn't exist.
+func manifestUnknown(mid types.ManifestID) error {
+	return newError(fiber.StatusNotFound, ErrCodeManifestUnknown, "manifest unknown to registry",
+		map[string]string{"name": fmt.Sprintf("%s/%s", mid.Namespace, mid.Repo), "reference": mid.Ref()})
+}
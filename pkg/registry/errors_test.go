@@ -0,0 +1,180 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/registry"
+)
+
+func TestErrorResponses(t *testing.T) {
+	const unknownDigest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           []byte
+		contentType    string
+		expectedStatus int
+		expectedCode   string
+		expectedDetail map[string]interface{}
+	}{
+		{
+			name:           "unknown blob",
+			method:         http.MethodGet,
+			path:           "/v2/ns/repo/blobs/" + unknownDigest,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeBlobUnknown,
+			expectedDetail: map[string]interface{}{"digest": unknownDigest},
+		},
+		{
+			name:           "unknown manifest",
+			method:         http.MethodGet,
+			path:           "/v2/ns/repo/manifests/v1",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeManifestUnknown,
+			expectedDetail: map[string]interface{}{"name": "ns/repo", "reference": "v1"},
+		},
+		{
+			name:           "deleting unknown manifest",
+			method:         http.MethodDelete,
+			path:           "/v2/ns/repo/manifests/" + unknownDigest,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeManifestUnknown,
+			expectedDetail: map[string]interface{}{"name": "ns/repo", "reference": unknownDigest},
+		},
+		{
+			name:           "deleting unknown blob",
+			method:         http.MethodDelete,
+			path:           "/v2/ns/repo/blobs/" + unknownDigest,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeBlobUnknown,
+			expectedDetail: map[string]interface{}{"digest": unknownDigest},
+		},
+		{
+			name:           "unknown repository tags",
+			method:         http.MethodGet,
+			path:           "/v2/ns/repo/tags/list",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeNameUnknown,
+			expectedDetail: map[string]interface{}{"name": "ns/repo"},
+		},
+		{
+			name:           "invalid repository name",
+			method:         http.MethodPost,
+			path:           "/v2/ns-/repo/blobs/uploads/",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   registry.ErrCodeNameInvalid,
+			expectedDetail: map[string]interface{}{"name": "ns-/repo"},
+		},
+		{
+			name:           "invalid upload session ID",
+			method:         http.MethodGet,
+			path:           "/v2/ns/repo/blobs/uploads/foo",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeBlobUploadUnknown,
+			expectedDetail: map[string]interface{}{"uuid": "foo"},
+		},
+		{
+			name:           "invalid digest",
+			method:         http.MethodPost,
+			path:           "/v2/ns/repo/blobs/uploads/?digest=sha256:foo",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   registry.ErrCodeDigestInvalid,
+			expectedDetail: map[string]interface{}{"digest": "sha256:foo"},
+		},
+		{
+			name:           "mismatching manifest content type",
+			method:         http.MethodPut,
+			path:           "/v2/ns/repo/manifests/v1",
+			body:           []byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`),
+			contentType:    "application/json",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   registry.ErrCodeManifestInvalid,
+			expectedDetail: map[string]interface{}{
+				"contentType": "application/json",
+				"mediaType":   "application/vnd.oci.image.manifest.v1+json",
+			},
+		},
+		{
+			name:           "unknown route",
+			method:         http.MethodGet,
+			path:           "/v2/ns/repo/foo",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   registry.ErrCodeNameUnknown,
+			expectedDetail: map[string]interface{}{"method": http.MethodGet, "path": "/v2/ns/repo/foo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newFileRegistry(t)
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := r.Test(req)
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(tt.expectedStatus))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+
+			var errResp registry.ErrorResponse
+			g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+			g.Expect(errResp.Errors).To(HaveLen(1))
+			g.Expect(errResp.Errors[0].Code).To(Equal(tt.expectedCode))
+			g.Expect(errResp.Errors[0].Message).NotTo(BeEmpty())
+			g.Expect(errResp.Errors[0].Detail).To(Equal(tt.expectedDetail))
+		})
+	}
+}
+
+func TestFiberErrorCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		err          error
+		expectedCode string
+	}{
+		{"bad request on manifest route", "/test/ns/repo/manifests/v1", fiber.ErrBadRequest, registry.ErrCodeManifestInvalid},
+		{"bad request on blob route", "/test/ns/repo/blobs/uploads/", fiber.ErrBadRequest, registry.ErrCodeNameInvalid},
+		{"not found", "/test/ns/repo/tags/list", fiber.ErrNotFound, registry.ErrCodeNameUnknown},
+		{"method not allowed", "/test/ns/repo/referrers/foo", fiber.ErrMethodNotAllowed, registry.ErrCodeUnsupported},
+		{"request entity too large", "/test/ns/repo/blobs/foo", fiber.ErrRequestEntityTooLarge, registry.ErrCodeSizeInvalid},
+		{"unmapped status", "/test/ns/repo/blobs/bar", fiber.ErrTeapot, registry.ErrCodeUnknown},
+	}
+
+	r := newFileRegistry(t)
+	for _, tt := range tests {
+		r.App.Get(tt.path, func(*fiber.Ctx) error {
+			return tt.err
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			resp, err := r.Test(httptest.NewRequest(http.MethodGet, tt.path, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(tt.err.(*fiber.Error).Code))
+
+			var errResp registry.ErrorResponse
+			g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+			g.Expect(errResp.Errors).To(HaveLen(1))
+			g.Expect(errResp.Errors[0].Code).To(Equal(tt.expectedCode))
+		})
+	}
+}
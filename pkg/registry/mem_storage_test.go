@@ -0,0 +1,98 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// TestConcurrentTagPushesWithMemStorage pushes many tags in parallel over HTTP so that the server reuses request
+// buffers while the in-memory storage still holds on to the tags and digests of earlier requests.
+func TestConcurrentTagPushesWithMemStorage(t *testing.T) {
+	g := NewWithT(t)
+
+	r, err := registry.New(registry.WithMemStorage(), registry.WithLogger(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred(), "failed listening")
+	go func() {
+		_ = r.App.Listener(ln)
+	}()
+	defer func() {
+		_ = r.App.Shutdown()
+	}()
+	base := "http://" + ln.Addr().String() + "/v2/ns/repo"
+
+	cfg := testManifest(t, r, "ns/repo", "")
+	const n = 50
+	manifests := make([][]byte, n)
+	digests := make([]types.Digest, n)
+	for i := range manifests {
+		manifests[i] = append(bytes.TrimSuffix(cfg, []byte("}")), []byte(fmt.Sprintf(`,"annotations":{"i":"%d"}}`, i))...)
+		digests[i], err = types.NewDigest(types.AlgoSHA256, bytes.NewReader(manifests[i]))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range manifests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/manifests/tag-%d", base, i), bytes.NewReader(manifests[i]))
+			if err != nil {
+				errs <- err
+				return
+			}
+			req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				errs <- fmt.Errorf("pushing tag-%d returned %d", i, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	for i := range manifests {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/manifests/tag-%d", base, i), nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Accept", types.MediaTypeImageManifest)
+		resp, err := http.DefaultClient.Do(req)
+		g.Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "tag-%d is missing", i)
+		g.Expect(body).To(Equal(manifests[i]), "tag-%d points to the wrong manifest", i)
+
+		req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/manifests/%s", base, digests[i]), nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Accept", types.MediaTypeImageManifest)
+		resp, err = http.DefaultClient.Do(req)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "manifest of tag-%d is missing", i)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// notifyManifest emits an event about the manifest identified by mid if notifications are enabled.
+func (r Registry) notifyManifest(c *fiber.Ctx, action string, mid types.ManifestID, mediaType string, size int64) {
+	if r.notifier == nil {
+		return
+	}
+
+	t := notifications.Target{
+		MediaType:  mediaType,
+		Size:       size,
+		Length:     size,
+		Repository: mid.Namespace + "/" + mid.Repo,
+		URL:        fmt.Sprintf("%s/v2/%s/%s/manifests/%s", c.BaseURL(), mid.Namespace, mid.Repo, mid.Ref()),
+	}
+	if mid.Digest != nil {
+		t.Digest = mid.Digest.String()
+	}
+	if mid.Tag != nil {
+		t.Tag = *mid.Tag
+	}
+
+	r.notify(c, action, t)
+}
+
+// notifyBlob emits an event about the blob identified by bid if notifications are enabled. The blob's size is looked
+// up in the storage if size is negative which is only necessary for mounted blobs as no data has been transferred for
+// them. from is the repository that a mounted blob has been mounted from.
+func (r Registry) notifyBlob(c *fiber.Ctx, action string, bid types.BlobID, size int64, from string) {
+	if r.notifier == nil {
+		return
+	}
+
+	t := notifications.Target{
+		Digest:         bid.Digest.String(),
+		Repository:     bid.Namespace + "/" + bid.Repo,
+		FromRepository: from,
+		URL:            fmt.Sprintf("%s/v2/%s/%s/blobs/%s", c.BaseURL(), bid.Namespace, bid.Repo, bid.Digest),
+	}
+	if action != notifications.ActionDelete {
+		t.MediaType = "application/octet-stream"
+		if size < 0 {
+			if rdr, bs, err := r.store.FetchBlob(bid); err == nil {
+				rdr.Close()
+				size = bs.Size
+			}
+		}
+		t.Size = size
+		t.Length = size
+	}
+
+	r.notify(c, action, t)
+}
+
+func (r Registry) notify(c *fiber.Ctx, action string, t notifications.Target) {
+	// strings obtained from the request are only valid until the handler returns so they're copied as the event is
+	// sent asynchronously.
+	r.notifier.Notify(notifications.Event{
+		Action: action,
+		Target: notifications.Target{
+			MediaType:      strings.Clone(t.MediaType),
+			Size:           t.Size,
+			Digest:         strings.Clone(t.Digest),
+			Length:         t.Length,
+			Repository:     strings.Clone(t.Repository),
+			FromRepository: strings.Clone(t.FromRepository),
+			URL:            strings.Clone(t.URL),
+			Tag:            strings.Clone(t.Tag),
+		},
+		Request: notifications.Request{
+			ID:        strconv.FormatUint(c.Context().ID(), 10),
+			Addr:      strings.Clone(c.IP()),
+			Host:      strings.Clone(c.Hostname()),
+			Method:    strings.Clone(c.Method()),
+			UserAgent: strings.Clone(c.Get(fiber.HeaderUserAgent)),
+		},
+		Actor: notifications.Actor{
+			Name: strings.Clone(requestUser(c)),
+		},
+	})
+}
+
+func (r Registry) handleNotificationStatus(c *fiber.Ctx) error {
+	return c.JSON(r.notifier.Status())
+}
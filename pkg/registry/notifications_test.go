@@ -0,0 +1,150 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func TestEmitsEvents(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var events []notifications.Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env notifications.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, env.Events...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	received := func() []notifications.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]notifications.Event{}, events...)
+	}
+
+	// pull events are only sent to endpoints asking for them.
+	noop := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer noop.Close()
+	n, err := notifications.New([]notifications.Endpoint{
+		{
+			Name:    "ci",
+			URL:     srv.URL,
+			Actions: []string{notifications.ActionPush, notifications.ActionPull, notifications.ActionMount, notifications.ActionDelete},
+		},
+		{Name: "default", URL: noop.URL},
+	}, notifications.Options{}, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating notifier")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	r := newFileRegistry(t, registry.WithNotifier(n))
+
+	manifest := testManifest(t, r, "team/app", "")
+	mfDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(manifest))
+	g.Expect(err).NotTo(HaveOccurred())
+	req := httptest.NewRequest(http.MethodPut, "/v2/team/app/manifests/v1", bytes.NewReader(manifest))
+	req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+
+	resp, _ = get(t, r, "/v2/team/app/manifests/v1", "Accept", types.MediaTypeImageManifest)
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+
+	req = httptest.NewRequest(http.MethodPost, "/v2/team/other/blobs/uploads/?from=team/app&mount="+emptyConfigDigest, nil)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodDelete, "/v2/team/app/manifests/"+mfDig.String(), nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted))
+
+	resp, err = r.Test(httptest.NewRequest(http.MethodPost, "/v2/team/app/blobs/uploads/", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted))
+	loc := resp.Header.Get("Location")
+	chunk := []byte("chunked layer")
+	chunkDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(chunk))
+	g.Expect(err).NotTo(HaveOccurred())
+	req = httptest.NewRequest(http.MethodPatch, loc, bytes.NewReader(chunk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted))
+	resp, err = r.Test(httptest.NewRequest(http.MethodPut, loc+"?digest="+chunkDig.String(), nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+
+	g.Eventually(received).Should(HaveLen(6))
+	evs := received()
+
+	g.Expect(evs[0].Action).To(Equal(notifications.ActionPush))
+	g.Expect(evs[0].Target.Digest).To(Equal(emptyConfigDigest))
+	g.Expect(evs[0].Target.Size).To(BeEquivalentTo(2))
+
+	g.Expect(evs[1].Action).To(Equal(notifications.ActionPush))
+	g.Expect(evs[1].Target).To(Equal(notifications.Target{
+		MediaType:  types.MediaTypeImageManifest,
+		Size:       int64(len(manifest)),
+		Length:     int64(len(manifest)),
+		Digest:     mfDig.String(),
+		Repository: "team/app",
+		URL:        "http://example.com/v2/team/app/manifests/v1",
+		Tag:        "v1",
+	}))
+	g.Expect(evs[1].Request.Method).To(Equal(http.MethodPut))
+	g.Expect(evs[1].Request.UserAgent).To(Equal("test-agent"))
+
+	g.Expect(evs[2].Action).To(Equal(notifications.ActionPull))
+	g.Expect(evs[2].Target.Digest).To(Equal(mfDig.String()))
+	g.Expect(evs[2].Target.Tag).To(Equal("v1"))
+
+	g.Expect(evs[3].Action).To(Equal(notifications.ActionMount))
+	g.Expect(evs[3].Target.Repository).To(Equal("team/other"))
+	g.Expect(evs[3].Target.FromRepository).To(Equal("team/app"))
+	g.Expect(evs[3].Target.Size).To(BeEquivalentTo(2))
+
+	g.Expect(evs[4].Action).To(Equal(notifications.ActionDelete))
+	g.Expect(evs[4].Target.Digest).To(Equal(mfDig.String()))
+	g.Expect(evs[4].Target.MediaType).To(BeEmpty())
+
+	g.Expect(evs[5].Action).To(Equal(notifications.ActionPush))
+	g.Expect(evs[5].Target.Digest).To(Equal(chunkDig.String()))
+	g.Expect(evs[5].Target.Size).To(BeEquivalentTo(len(chunk)))
+
+	g.Eventually(func() notifications.Status { return n.Status()[1] }).Should(HaveField("Sent", BeEquivalentTo(5)),
+		"the default endpoint should have received all but the pull event")
+
+	resp, body := get(t, r, "/v2/_notifications")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	var status []notifications.Status
+	g.Expect(json.Unmarshal(body, &status)).To(Succeed())
+	g.Expect(status).To(HaveLen(2))
+	g.Expect(status[0].Endpoint).To(Equal("ci"))
+	g.Expect(status[0].Sent).To(BeEquivalentTo(6))
+	g.Expect(status[1].Endpoint).To(Equal("default"))
+	g.Expect(status[1].Sent).To(BeEquivalentTo(5))
+}
@@ -5,13 +5,19 @@ package registry
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 
+	"github.com/makkes/garage/pkg/auth"
+	"github.com/makkes/garage/pkg/client"
 	"github.com/makkes/garage/pkg/features"
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/replication"
 	"github.com/makkes/garage/pkg/storage"
 )
 
@@ -53,13 +59,21 @@ func WithMaxManifestBytes(b int64) Opt {
 	}
 }
 
-func WithFileStorage(fs storage.Storage) Opt {
+// WithStorage stores all data in s.
+func WithStorage(s storage.Storage) Opt {
 	return func(r *Registry) error {
-		r.store = fs
+		r.store = s
 		return nil
 	}
 }
 
+// WithFileStorage stores all data in fs.
+//
+// Deprecated: use WithStorage which accepts any storage backend.
+func WithFileStorage(fs storage.Storage) Opt {
+	return WithStorage(fs)
+}
+
 func WithMemStorage() Opt {
 	return func(r *Registry) error {
 		r.store = storage.NewMemStorage()
@@ -80,3 +94,75 @@ func WithLogger(log logr.Logger) Opt {
 		return nil
 	}
 }
+
+// WithAuthenticator requires all requests to carry credentials that are accepted by a.
+func WithAuthenticator(a auth.Authenticator) Opt {
+	return func(r *Registry) error {
+		r.authn = a
+		return nil
+	}
+}
+
+// WithTokenIssuer serves the token endpoint at /token, issuing tokens with ti.
+func WithTokenIssuer(ti auth.TokenIssuer) Opt {
+	return func(r *Registry) error {
+		r.tokenIssuer = &ti
+		return nil
+	}
+}
+
+// WithAuthorizer only permits requests whose access is permitted by a.
+func WithAuthorizer(a auth.Authorizer) Opt {
+	return func(r *Registry) error {
+		r.authz = a
+		return nil
+	}
+}
+
+// WithSessionTTL expires upload sessions that haven't received any data for the duration ttl. Sessions never expire if
+// ttl is 0.
+func WithSessionTTL(ttl time.Duration) Opt {
+	return func(r *Registry) error {
+		if ttl < 0 {
+			return fmt.Errorf("session TTL must not be negative")
+		}
+		r.sessionTTL = ttl
+		return nil
+	}
+}
+
+// WithProxy turns the registry into a pull-through cache of the upstream registry. Manifests, blobs and tags missing
+// locally are fetched from upstream and stored. Cached tags are revalidated with the upstream registry once tagTTL has
+// passed since they were last found to be up-to-date.
+func WithProxy(upstream client.Client, tagTTL time.Duration) Opt {
+	return func(r *Registry) error {
+		if tagTTL < 0 {
+			return fmt.Errorf("tag TTL must not be negative")
+		}
+		r.proxy = &proxy{
+			upstream:  upstream,
+			tagTTL:    tagTTL,
+			validated: make(map[string]time.Time),
+			mu:        &sync.Mutex{},
+		}
+		return nil
+	}
+}
+
+// WithReplicator queues every accepted manifest push for replication by rep and serves the replication status at
+// /v2/_replication.
+func WithReplicator(rep replication.Replicator) Opt {
+	return func(r *Registry) error {
+		r.replicator = &rep
+		return nil
+	}
+}
+
+// WithNotifier emits events about pushed, pulled, mounted and deleted manifests and blobs to n and serves the delivery
+// status at /v2/_notifications.
+func WithNotifier(n notifications.Notifier) Opt {
+	return func(r *Registry) error {
+		r.notifier = &n
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// paginate applies the 'n' and 'last' query parameters of the request to the sorted list s. If the result is
+// truncated, a Link header pointing to the next page relative to path is added to the response.
+func paginate(c *fiber.Ctx, s []string, path string) []string {
+	if last := c.Query("last", ""); last != "" {
+		// the marker doesn't need to exist in the list, it's only used for lexical comparison.
+		i := sort.SearchStrings(s, last)
+		if i < len(s) && s[i] == last {
+			i++
+		}
+		s = s[i:]
+	}
+
+	n := c.QueryInt("n", -1)
+	if n >= 0 && n < len(s) {
+		s = s[0:n]
+		if n > 0 {
+			c.Set(fiber.HeaderLink, fmt.Sprintf(`<%s?n=%d&last=%s>; rel="next"`, path, n, url.QueryEscape(s[n-1])))
+		}
+	}
+
+	return s
+}
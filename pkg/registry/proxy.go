@@ -0,0 +1,303 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// proxy fetches content missing from the local storage from an upstream registry, turning the registry into a
+// pull-through cache.
+type proxy struct {
+	upstream client.Client
+	tagTTL   time.Duration
+	// validated holds the times at which tags have last been found to be up-to-date with the upstream registry.
+	validated map[string]time.Time
+	mu        *sync.Mutex
+}
+
+func (p proxy) fresh(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.validated[key]
+	return ok && time.Since(t) < p.tagTTL
+}
+
+func (p proxy) validate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.validated[key] = time.Now()
+}
+
+// upstreamName returns the name of the repository in the upstream registry.
+func upstreamName(ns, repo string) string {
+	return ns + "/" + repo
+}
+
+// syncManifest makes sure that the manifest identified by mid is stored locally if the upstream registry has it.
+// Manifests referenced by digest are immutable so they're only fetched once while tags are revalidated with the
+// upstream registry after the tag TTL has passed. If the upstream registry is unavailable, a cached manifest is served
+// nonetheless.
+func (r Registry) syncManifest(ctx context.Context, mid types.ManifestID, log logr.Logger) error {
+	has, err := r.store.Has(mid)
+	if err != nil {
+		return fmt.Errorf("failed checking manifest existence: %w", err)
+	}
+
+	name := upstreamName(mid.Namespace, mid.Repo)
+	if mid.Tag == nil {
+		if has {
+			return nil
+		}
+		return r.fetchUpstreamManifest(ctx, mid, mid.Digest.String(), log)
+	}
+
+	key := name + ":" + *mid.Tag
+	if has {
+		if r.proxy.fresh(key) {
+			return nil
+		}
+
+		upstreamDig, err := r.proxy.upstream.HeadManifest(ctx, name, *mid.Tag)
+		if err != nil {
+			log.Error(err, "failed revalidating manifest with upstream registry, serving cached manifest")
+			return nil
+		}
+		localDig, err := r.localManifestDigest(mid, types.SupportedAlgos(upstreamDig.Algo))
+		if err != nil {
+			return err
+		}
+		if upstreamDig == localDig {
+			r.proxy.validate(key)
+			return nil
+		}
+		log.V(5).Info("tag has changed upstream", "cached", localDig, "upstream", upstreamDig)
+	}
+
+	if err := r.fetchUpstreamManifest(ctx, mid, *mid.Tag, log); err != nil {
+		if has {
+			log.Error(err, "failed fetching manifest from upstream registry, serving cached manifest")
+			return nil
+		}
+		return err
+	}
+	r.proxy.validate(key)
+
+	return nil
+}
+
+// fetchUpstreamManifest fetches the manifest identified by ref from the upstream registry and stores it under mid. It
+// doesn't return an error if the upstream registry doesn't have the manifest.
+func (r Registry) fetchUpstreamManifest(ctx context.Context, mid types.ManifestID, ref string, log logr.Logger) error {
+	m, err := r.proxy.upstream.GetManifest(ctx, upstreamName(mid.Namespace, mid.Repo), ref)
+	if err != nil {
+		if errors.As(err, &client.ErrNotFound{}) {
+			log.V(5).Info("manifest unknown to upstream registry")
+			return nil
+		}
+		return fmt.Errorf("failed fetching manifest from upstream registry: %w", err)
+	}
+
+	mid.Digest = &m.Digest
+	// blobs and child manifests are fetched from the upstream registry once they are requested.
+	if err := r.store.StoreManifest(mid, bytes.NewReader(m.Data), storage.References{}); err != nil {
+		return fmt.Errorf("failed storing upstream manifest: %w", err)
+	}
+
+	var mf types.Manifest
+	if err := json.Unmarshal(m.Data, &mf); err != nil {
+		return fmt.Errorf("failed decoding upstream manifest: %w", err)
+	}
+	if mf.Subject != nil {
+		mt := mf.MediaType
+		if mt == "" {
+			mt = m.MediaType
+		}
+		desc := types.Descriptor{
+			MediaType:    mt,
+			Digest:       m.Digest,
+			Size:         int64(len(m.Data)),
+			ArtifactType: mf.EffectiveArtifactType(),
+			Annotations:  mf.Annotations,
+		}
+		if err := r.store.StoreReferrer(mid.Namespace, mid.Repo, mf.Subject.Digest, desc); err != nil {
+			return fmt.Errorf("failed storing referrer: %w", err)
+		}
+	}
+
+	log.V(5).Info("cached manifest from upstream registry", "upstreamDigest", m.Digest)
+
+	return nil
+}
+
+// localManifestDigest returns the digest of the locally stored manifest identified by mid using the given algorithm.
+func (r Registry) localManifestDigest(mid types.ManifestID, algo types.SupportedAlgos) (types.Digest, error) {
+	rdr, err := r.store.FetchManifest(mid)
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed fetching manifest: %w", err)
+	}
+	defer rdr.Close()
+
+	dig, err := types.NewDigest(algo, rdr)
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed calculating manifest digest: %w", err)
+	}
+
+	return dig, nil
+}
+
+// proxyBlob serves a blob that isn't stored locally from the upstream registry. Complete blobs are streamed to the
+// client while being stored. Range requests are only served after the whole blob has been stored.
+func (r Registry) proxyBlob(c *fiber.Ctx, bid types.BlobID) error {
+	if c.Method() == fiber.MethodHead {
+		size, err := r.proxy.upstream.HeadBlob(c.UserContext(), upstreamName(bid.Namespace, bid.Repo), bid.Digest)
+		if err != nil {
+			return upstreamBlobError(err, bid)
+		}
+		c.Response().Header.Add("Content-Type", "application/octet-stream")
+		c.Set(fiber.HeaderAcceptRanges, "bytes")
+		setDigestHeaders(c, bid.Digest)
+		c.Status(fiber.StatusOK)
+		c.Response().Header.SetContentLength(int(size))
+		c.Response().SkipBody = true
+		return nil
+	}
+
+	if c.Get(fiber.HeaderRange) != "" {
+		if err := r.cacheUpstreamBlob(bid); err != nil {
+			return err
+		}
+		blobRdr, bs, err := r.store.FetchBlob(bid)
+		if err != nil {
+			return fmt.Errorf("failed fetching cached blob from store: %w", err)
+		}
+		return sendBlob(c, bid.Digest, blobRdr, bs)
+	}
+
+	c.Response().Header.Add("Content-Type", "application/octet-stream")
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	if setDigestHeaders(c, bid.Digest) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	cr, size, err := r.openUpstreamBlob(bid)
+	if err != nil {
+		return err
+	}
+
+	// the stream is closed by fiber after it has been sent.
+	return c.SendStream(cr, int(size))
+}
+
+// cacheUpstreamBlob fetches the blob from the upstream registry and stores it.
+func (r Registry) cacheUpstreamBlob(bid types.BlobID) error {
+	cr, _, err := r.openUpstreamBlob(bid)
+	if err != nil {
+		return err
+	}
+	if err := cr.Close(); err != nil {
+		return fmt.Errorf("failed caching upstream blob: %w", err)
+	}
+	return nil
+}
+
+// openUpstreamBlob returns a reader for the blob from the upstream registry that stores the blob while it is read.
+func (r Registry) openUpstreamBlob(bid types.BlobID) (*cachingReader, int64, error) {
+	// the stream must outlive the request handler so it isn't bound to the request context.
+	src, size, err := r.proxy.upstream.GetBlob(context.Background(), upstreamName(bid.Namespace, bid.Repo), bid.Digest)
+	if err != nil {
+		return nil, 0, upstreamBlobError(err, bid)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.store.StoreBlob(bid, pr)
+		// unblock the writer if storing failed early.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return &cachingReader{
+		src:  src,
+		w:    pw,
+		done: done,
+		log:  r.log.WithValues("namespace", bid.Namespace, "repo", bid.Repo, "digest", bid.Digest),
+	}, size, nil
+}
+
+func upstreamBlobError(err error, bid types.BlobID) error {
+	if errors.As(err, &client.ErrNotFound{}) {
+		return blobUnknown(bid.Digest)
+	}
+	return fmt.Errorf("failed fetching blob from upstream registry: %w", err)
+}
+
+// cachingReader passes all data read from src on to w. When closed, it reads the rest of src so that the blob is cached
+// completely even if the client went away.
+type cachingReader struct {
+	src     io.ReadCloser
+	w       *io.PipeWriter
+	done    chan error
+	log     logr.Logger
+	wFailed bool
+}
+
+func (cr *cachingReader) Read(p []byte) (int, error) {
+	n, err := cr.src.Read(p)
+	if n > 0 && !cr.wFailed {
+		if _, err := cr.w.Write(p[:n]); err != nil {
+			cr.wFailed = true
+		}
+	}
+	return n, err
+}
+
+// Close finishes caching the blob and returns an error if it couldn't be stored.
+func (cr *cachingReader) Close() error {
+	var err error
+	if !cr.wFailed {
+		_, err = io.Copy(cr.w, cr.src)
+	}
+	cr.src.Close()
+	cr.w.CloseWithError(err)
+
+	if err := <-cr.done; err != nil {
+		cr.log.Error(err, "failed caching blob from upstream registry")
+		return err
+	}
+	cr.log.V(5).Info("cached blob from upstream registry")
+
+	return nil
+}
+
+// upstreamTags returns the tags of the repository in the upstream registry and reports whether the upstream registry
+// knows the repository. It returns nil and false if the upstream registry doesn't know the repository or is
+// unavailable.
+func (r Registry) upstreamTags(ctx context.Context, ns, repo string) ([]string, bool) {
+	tags, err := r.proxy.upstream.Tags(ctx, upstreamName(ns, repo))
+	if err != nil {
+		if !errors.As(err, &client.ErrNotFound{}) {
+			r.log.Error(err, "failed fetching tags from upstream registry, serving cached tags", "namespace", ns, "repo", repo)
+		}
+		return nil, false
+	}
+	return tags, true
+}
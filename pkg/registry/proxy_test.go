@@ -0,0 +1,270 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/auth"
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// upstream is a registry served over HTTP that requires token authentication.
+type upstream struct {
+	registry.Registry
+	url string
+}
+
+func newUpstream(t *testing.T) upstream {
+	t.Helper()
+	g := NewWithT(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred(), "failed listening")
+	u := "http://" + ln.Addr().String()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred(), "failed generating key")
+	users, err := auth.ParseHtpasswd(strings.NewReader(testUsers))
+	g.Expect(err).NotTo(HaveOccurred(), "failed parsing users")
+	ti, err := auth.NewTokenIssuer("garage", "garage", key, time.Minute, users)
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating token issuer")
+	ta, err := auth.NewTokenAuthenticator(u+"/token", "garage", "garage", key.Public())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating token authenticator")
+
+	r := newFileRegistry(t, registry.WithTokenIssuer(ti), registry.WithAuthenticator(ta))
+	go func() {
+		_ = r.App.Listener(ln)
+	}()
+	t.Cleanup(func() {
+		_ = r.App.Shutdown()
+	})
+
+	return upstream{Registry: r, url: u}
+}
+
+// pushImage pushes an image with a single layer to the repository name under tag and returns the manifest.
+func (u upstream) pushImage(t *testing.T, name, tag string, layer []byte) []byte {
+	t.Helper()
+	g := NewWithT(t)
+
+	authHdr := "Bearer " + fetchToken(t, u.Registry, basicAuth("alice", "secret"), "repository:"+name+":pull,push")
+
+	layerDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(layer))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+	req := httptest.NewRequest(http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+layerDig.String(), bytes.NewReader(layer))
+	req.Header.Set("Authorization", authHdr)
+	resp, err := u.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "uploading layer failed")
+
+	var mf map[string]interface{}
+	g.Expect(json.Unmarshal(testManifest(t, u.Registry, name, authHdr), &mf)).To(Succeed())
+	mf["layers"] = []types.Descriptor{{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		Digest:    layerDig,
+		Size:      int64(len(layer)),
+	}}
+	manifest, err := json.Marshal(mf)
+	g.Expect(err).NotTo(HaveOccurred(), "failed encoding manifest")
+
+	req = httptest.NewRequest(http.MethodPut, "/v2/"+name+"/manifests/"+tag, bytes.NewReader(manifest))
+	req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+	req.Header.Set("Authorization", authHdr)
+	resp, err = u.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "pushing manifest failed")
+
+	return manifest
+}
+
+func newProxyRegistry(t *testing.T, up upstream, tagTTL time.Duration) registry.Registry {
+	t.Helper()
+	g := NewWithT(t)
+
+	c, err := client.New(up.url, client.WithBasicAuth("alice", "secret"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating client")
+
+	return newFileRegistry(t, registry.WithProxy(c, tagTTL))
+}
+
+func get(t *testing.T, r registry.Registry, path string, hdrs ...string) (*http.Response, []byte) {
+	t.Helper()
+	g := NewWithT(t)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for idx := 0; idx+1 < len(hdrs); idx += 2 {
+		req.Header.Set(hdrs[idx], hdrs[idx+1])
+	}
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	body, err := io.ReadAll(resp.Body)
+	g.Expect(err).NotTo(HaveOccurred(), "failed reading response body")
+
+	return resp, body
+}
+
+func TestProxyPullsThroughAndCaches(t *testing.T) {
+	g := NewWithT(t)
+
+	up := newUpstream(t)
+	layer := []byte("this is the layer")
+	manifest := up.pushImage(t, "library/alpine", "latest", layer)
+	layerDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(layer))
+	g.Expect(err).NotTo(HaveOccurred())
+	mfDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(manifest))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	r := newProxyRegistry(t, up, time.Hour)
+
+	resp, body := get(t, r, "/v2/library/alpine/manifests/latest")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(manifest))
+	g.Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(mfDig.String()))
+
+	resp, body = get(t, r, "/v2/library/alpine/blobs/"+layerDig.String())
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(layer))
+
+	resp, body = get(t, r, "/v2/library/alpine/tags/list")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	var tl types.TagList
+	g.Expect(json.Unmarshal(body, &tl)).To(Succeed())
+	g.Expect(tl.Tags).To(Equal([]string{"latest"}))
+
+	// everything is served from the cache once the upstream registry is gone.
+	g.Expect(up.App.Shutdown()).To(Succeed())
+
+	resp, body = get(t, r, "/v2/library/alpine/manifests/latest")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(manifest))
+	resp, body = get(t, r, "/v2/library/alpine/manifests/"+mfDig.String())
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(manifest))
+	resp, body = get(t, r, "/v2/library/alpine/blobs/"+layerDig.String())
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(layer))
+	resp, body = get(t, r, "/v2/library/alpine/tags/list")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(json.Unmarshal(body, &tl)).To(Succeed())
+	g.Expect(tl.Tags).To(Equal([]string{"latest"}))
+}
+
+func TestProxyRevalidatesTags(t *testing.T) {
+	g := NewWithT(t)
+
+	up := newUpstream(t)
+	manifest := up.pushImage(t, "ns/repo", "v1", []byte("first"))
+
+	cached := newProxyRegistry(t, up, time.Hour)
+	revalidated := newProxyRegistry(t, up, 0)
+	for _, r := range []registry.Registry{cached, revalidated} {
+		resp, body := get(t, r, "/v2/ns/repo/manifests/v1")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+		g.Expect(body).To(Equal(manifest))
+	}
+
+	updated := up.pushImage(t, "ns/repo", "v1", []byte("second"))
+
+	_, body := get(t, cached, "/v2/ns/repo/manifests/v1")
+	g.Expect(body).To(Equal(manifest), "tag has been revalidated before its TTL passed")
+	_, body = get(t, revalidated, "/v2/ns/repo/manifests/v1")
+	g.Expect(body).To(Equal(updated), "tag hasn't been revalidated after its TTL passed")
+
+	// the cached manifest is served when the upstream registry is unavailable.
+	g.Expect(up.App.Shutdown()).To(Succeed())
+	resp, body := get(t, revalidated, "/v2/ns/repo/manifests/v1")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(updated))
+}
+
+func TestProxyServesRangeOfUncachedBlob(t *testing.T) {
+	g := NewWithT(t)
+
+	up := newUpstream(t)
+	layer := []byte("0123456789")
+	up.pushImage(t, "ns/repo", "v1", layer)
+	layerDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(layer))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	r := newProxyRegistry(t, up, time.Hour)
+
+	resp, body := get(t, r, "/v2/ns/repo/blobs/"+layerDig.String(), "Range", "bytes=2-4")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusPartialContent))
+	g.Expect(string(body)).To(Equal("234"))
+
+	req := httptest.NewRequest(http.MethodHead, "/v2/ns/repo/blobs/"+layerDig.String(), nil)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(resp.ContentLength).To(BeEquivalentTo(len(layer)))
+}
+
+func TestProxyUnknownContent(t *testing.T) {
+	g := NewWithT(t)
+
+	up := newUpstream(t)
+	up.pushImage(t, "ns/repo", "v1", []byte("layer"))
+	r := newProxyRegistry(t, up, time.Hour)
+
+	unknown := "sha256:" + strings.Repeat("0", 64)
+	tests := []struct {
+		path string
+		code string
+	}{
+		{"/v2/ns/repo/manifests/v2", registry.ErrCodeManifestUnknown},
+		{"/v2/ns/repo/manifests/" + unknown, registry.ErrCodeManifestUnknown},
+		{"/v2/ns/repo/blobs/" + unknown, registry.ErrCodeBlobUnknown},
+		{"/v2/ns/other/tags/list", registry.ErrCodeNameUnknown},
+	}
+	for _, tt := range tests {
+		resp, body := get(t, r, tt.path)
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound), tt.path)
+		var er registry.ErrorResponse
+		g.Expect(json.Unmarshal(body, &er)).To(Succeed(), tt.path)
+		g.Expect(er.Errors).To(HaveLen(1), tt.path)
+		g.Expect(er.Errors[0].Code).To(Equal(tt.code), tt.path)
+	}
+}
+
+func TestProxyStoresPulledBlobs(t *testing.T) {
+	g := NewWithT(t)
+
+	up := newUpstream(t)
+	layer := []byte("some layer")
+	up.pushImage(t, "ns/repo", "v1", layer)
+	layerDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(layer))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	c, err := client.New(up.url, client.WithBasicAuth("alice", "secret"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating client")
+	store := storage.NewMemStorage()
+	r, err := registry.New(registry.WithStorage(store), registry.WithLogger(logr.Discard()), registry.WithProxy(c, time.Hour))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+
+	resp, body := get(t, r, "/v2/ns/repo/blobs/"+layerDig.String())
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(Equal(layer))
+
+	rdr, _, err := store.FetchBlob(types.BlobID{Namespace: "ns", Repo: "repo", Digest: layerDig})
+	g.Expect(err).NotTo(HaveOccurred(), "blob hasn't been cached")
+	rdr.Close()
+}
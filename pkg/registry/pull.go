@@ -4,67 +4,110 @@
 package registry
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"net/http"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 
+	"github.com/makkes/garage/pkg/notifications"
 	"github.com/makkes/garage/pkg/storage"
 	"github.com/makkes/garage/pkg/types"
 )
 
 func (r Registry) handleBlobPull(c *fiber.Ctx) error {
 	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
-	log := r.log.WithValues("namespace", bid.Namespace, "repo", bid.Repo, "digest", bid.Digest.String())
 
 	blobRdr, bs, err := r.store.FetchBlob(bid)
-
 	if err != nil {
 		if errors.As(err, &storage.ErrNotFound{}) {
-			return c.SendStatus(fiber.StatusNotFound)
+			if r.proxy != nil {
+				return r.proxyBlob(c, bid)
+			}
+			return blobUnknown(bid.Digest)
 		}
-		log.V(5).Error(err, "failed fetching blob from store")
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return fmt.Errorf("failed fetching blob from store: %w", err)
+	}
+
+	if c.Method() == fiber.MethodGet {
+		r.notifyBlob(c, notifications.ActionPull, bid, bs.Size, "")
 	}
 
+	return sendBlob(c, bid.Digest, blobRdr, bs)
+}
+
+// sendBlob sends the blob or the range of it requested by the client, closing blobRdr when done.
+func sendBlob(c *fiber.Ctx, dig types.Digest, blobRdr io.ReadSeekCloser, bs storage.BlobStat) error {
 	c.Response().Header.Add("Content-Type", "application/octet-stream")
-	return c.SendStream(blobRdr, int(bs.Size))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	if setDigestHeaders(c, dig) {
+		blobRdr.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	rng, err := parseByteRange(c.Get(fiber.HeaderRange), bs.Size)
+	if err != nil {
+		blobRdr.Close()
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", bs.Size))
+		return newError(fiber.StatusRequestedRangeNotSatisfiable, ErrCodeSizeInvalid, err.Error(),
+			map[string]interface{}{"range": c.Get(fiber.HeaderRange), "size": bs.Size})
+	}
+
+	if rng == nil {
+		return c.SendStream(blobRdr, int(bs.Size))
+	}
+
+	if _, err := blobRdr.Seek(rng.start, io.SeekStart); err != nil {
+		blobRdr.Close()
+		return fmt.Errorf("failed seeking to start of requested range: %w", err)
+	}
+
+	c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end, bs.Size))
+	c.Status(fiber.StatusPartialContent)
+
+	// the stream is closed by fiber after it has been sent.
+	return c.SendStream(struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(blobRdr, rng.length()), blobRdr}, int(rng.length()))
 }
 
 func (r Registry) handleManifestPull(c *fiber.Ctx) error {
 	mid := c.UserContext().Value(midCtxKey{}).(types.ManifestID)
 	log := r.log.WithValues("namespace", mid.Namespace, "repo", mid.Repo, "tag", mid.Tag, "digest", mid.Digest)
 
+	if r.proxy != nil {
+		if err := r.syncManifest(c.UserContext(), mid, log); err != nil {
+			return err
+		}
+	}
+
 	has, err := r.store.Has(mid)
 	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return fmt.Errorf("failed checking manifest existence: %w", err)
 	}
 
 	if !has {
 		log.V(5).Info("request for unknown manifest")
-		return fiber.ErrNotFound
+		return manifestUnknown(mid)
 	}
 
 	mfRdr, err := r.store.FetchManifest(mid)
 	if err != nil {
-		log.V(4).Error(err, "failed fetching manifest")
-		return c.SendStatus(fiber.StatusInternalServerError)
+		return fmt.Errorf("failed fetching manifest: %w", err)
 	}
 
 	var mf map[string]interface{}
 	rawMf, err := io.ReadAll(mfRdr)
 	if err != nil {
-		r.log.Error(err, "failed reading manifest from storage")
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed reading manifest from storage")
+		return fmt.Errorf("failed reading manifest from storage: %w", err)
 	}
 
 	if err := json.Unmarshal(rawMf, &mf); err != nil {
-		r.log.Error(err, "failed decoding manifest to JSON object")
-		return c.Status(http.StatusInternalServerError).
-			SendString("failed decoding manifest to JSON object")
+		return fmt.Errorf("failed decoding manifest to JSON object: %w", err)
 	}
 
 	mt := "application/vnd.oci.image.manifest.v1+json" // this is the default content type for manifests.
@@ -76,14 +119,56 @@ func (r Registry) handleManifestPull(c *fiber.Ctx) error {
 	}
 
 	if c.Accepts(mt) == "" {
-		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+		return newError(fiber.StatusUnsupportedMediaType, ErrCodeUnsupported, "manifest media type not accepted",
+			map[string]string{"mediaType": mt})
+	}
+
+	dig := mid.Digest
+	if dig == nil {
+		// manifests are always stored under their SHA-256 digest when pushed by tag.
+		d, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(rawMf))
+		if err != nil {
+			return fmt.Errorf("failed calculating manifest digest: %w", err)
+		}
+		dig = &d
 	}
 
 	c.Context().SetContentType(mt)
+	if setDigestHeaders(c, *dig) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
 
 	if c.Method() == fiber.MethodHead {
-		return c.SendStatus(fiber.StatusOK)
+		c.Status(fiber.StatusOK)
+		c.Response().Header.SetContentLength(len(rawMf))
+		c.Response().SkipBody = true
+		return nil
 	}
 
+	pulled := mid
+	pulled.Digest = dig
+	r.notifyManifest(c, notifications.ActionPull, pulled, mt, int64(len(rawMf)))
+
 	return c.Send(rawMf)
 }
+
+// setDigestHeaders sets the headers identifying content with the digest dig and reports whether the client already
+// has that content as indicated by the If-None-Match header.
+func setDigestHeaders(c *fiber.Ctx, dig types.Digest) bool {
+	etag := fmt.Sprintf("%q", dig.String())
+	c.Set("Docker-Content-Digest", dig.String())
+	c.Set(fiber.HeaderETag, etag)
+
+	inm := c.Get(fiber.HeaderIfNoneMatch)
+	if inm == "" {
+		return false
+	}
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+
+	return false
+}
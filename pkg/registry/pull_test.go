@@ -4,10 +4,12 @@
 package registry_test
 
 import (
+	"bytes"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/go-logr/logr"
@@ -16,6 +18,7 @@ import (
 
 	"github.com/makkes/garage/pkg/registry"
 	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
 )
 
 func TestPullManifest(t *testing.T) {
@@ -90,7 +93,7 @@ func TestPullManifest(t *testing.T) {
 			stdr.SetVerbosity(10)
 
 			r, _ := registry.New(
-				registry.WithFileStorage(s),
+				registry.WithStorage(s),
 				registry.WithLogger(stdr.New(log.New(os.Stdout, "", log.LstdFlags))),
 			)
 
@@ -112,3 +115,133 @@ func TestPullManifest(t *testing.T) {
 		})
 	}
 }
+
+func TestPullBlobRange(t *testing.T) {
+	tests := []struct {
+		name            string
+		rangeHdr        string
+		expStatus       int
+		expContentRange string
+		expBody         string
+	}{
+		{
+			name:      "no range",
+			expStatus: http.StatusOK,
+			expBody:   "0123456789",
+		},
+		{
+			name:            "closed range",
+			rangeHdr:        "bytes=2-5",
+			expStatus:       http.StatusPartialContent,
+			expContentRange: "bytes 2-5/10",
+			expBody:         "2345",
+		},
+		{
+			name:            "open range",
+			rangeHdr:        "bytes=7-",
+			expStatus:       http.StatusPartialContent,
+			expContentRange: "bytes 7-9/10",
+			expBody:         "789",
+		},
+		{
+			name:            "suffix range",
+			rangeHdr:        "bytes=-3",
+			expStatus:       http.StatusPartialContent,
+			expContentRange: "bytes 7-9/10",
+			expBody:         "789",
+		},
+		{
+			name:            "range exceeding content",
+			rangeHdr:        "bytes=8-100",
+			expStatus:       http.StatusPartialContent,
+			expContentRange: "bytes 8-9/10",
+			expBody:         "89",
+		},
+		{
+			name:            "unsatisfiable range",
+			rangeHdr:        "bytes=10-",
+			expStatus:       http.StatusRequestedRangeNotSatisfiable,
+			expContentRange: "bytes */10",
+		},
+		{
+			name:      "multiple ranges are ignored",
+			rangeHdr:  "bytes=0-1,4-5",
+			expStatus: http.StatusOK,
+			expBody:   "0123456789",
+		},
+		{
+			name:      "malformed range is ignored",
+			rangeHdr:  "bytes=5-2",
+			expStatus: http.StatusOK,
+			expBody:   "0123456789",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newFileRegistry(t)
+			dig := uploadBlob(t, r, "ns/repo", []byte("0123456789"))
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/ns/repo/blobs/"+dig.String(), nil)
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			resp, err := r.Test(req)
+
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(tt.expStatus))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Accept-Ranges", "bytes"))
+			g.Expect(resp.Header.Get("Content-Range")).To(Equal(tt.expContentRange))
+			if tt.expBody != "" {
+				g.Expect(resp).To(HaveHTTPBody(tt.expBody))
+			}
+		})
+	}
+}
+
+func TestPullReturnsDigestHeaders(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	blob := []byte("0123456789")
+	blobDig := uploadBlob(t, r, "ns/repo", blob)
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	mf := testManifest(t, r, "ns/repo", "")
+	mfDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(mf))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+	req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", bytes.NewReader(mf))
+	req.Header.Set("Content-Type", mt)
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "pushing manifest failed")
+
+	for _, tc := range []struct {
+		path string
+		dig  types.Digest
+		size int
+	}{
+		{path: "/v2/ns/repo/blobs/" + blobDig.String(), dig: blobDig, size: len(blob)},
+		{path: "/v2/ns/repo/manifests/latest", dig: mfDig, size: len(mf)},
+		{path: "/v2/ns/repo/manifests/" + mfDig.String(), dig: mfDig, size: len(mf)},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			resp, err := r.Test(httptest.NewRequest(method, tc.path, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "%s %s failed", method, tc.path)
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Docker-Content-Digest", tc.dig.String()), "%s %s", method, tc.path)
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("ETag", `"`+tc.dig.String()+`"`), "%s %s", method, tc.path)
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Content-Length", strconv.Itoa(tc.size)), "%s %s", method, tc.path)
+
+			req := httptest.NewRequest(method, tc.path, nil)
+			req.Header.Set("If-None-Match", `"sha256:other", "`+tc.dig.String()+`"`)
+			resp, err = r.Test(req)
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusNotModified), "%s %s with matching ETag", method, tc.path)
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Docker-Content-Digest", tc.dig.String()), "%s %s", method, tc.path)
+		}
+	}
+}
@@ -6,60 +6,49 @@ package registry
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/gofiber/fiber/v2"
 
 	"github.com/makkes/garage/pkg/features"
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/storage"
 	"github.com/makkes/garage/pkg/types"
 )
 
 func (r Registry) handleManifestPush(c *fiber.Ctx) error {
 	b := c.Request().BodyStream()
 	if b == nil {
-		return c.Status(fiber.StatusBadRequest).
-			SendString("no data in request body")
+		return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, "no data in request body", nil)
 	}
 
 	rdr := io.LimitReader(b, r.maxManifestBytes)
 	body, err := io.ReadAll(rdr)
 	if err != nil {
-		r.log.V(5).Error(err, "failed reading body")
-		return fiber.ErrInternalServerError
+		return fmt.Errorf("failed reading body: %w", err)
 	}
 
 	if len(body) == 0 {
-		return c.Status(fiber.StatusBadRequest).
-			JSON(ErrorResponse{
-				Errors: []Error{{
-					Code:    ErrCodeManifestInvalid,
-					Message: "manifest is empty",
-				}},
-			})
+		return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, "manifest is empty", nil)
 	}
 
 	// Check if the body contains unread data and if so, return appropriate status code.
 	rem := make([]byte, 1)
 	read, err := b.Read(rem)
 	if err != nil && err != io.EOF {
-		r.log.V(5).Error(err, "failed reading another byte from body")
-		return fiber.ErrInternalServerError
+		return fmt.Errorf("failed reading another byte from body: %w", err)
 	}
 	if read >= 1 {
-		return fiber.ErrRequestEntityTooLarge
+		return newError(fiber.StatusRequestEntityTooLarge, ErrCodeSizeInvalid, "manifest too large",
+			map[string]int64{"limit": r.maxManifestBytes})
 	}
 
 	var manifest map[string]interface{}
-	if err := json.Unmarshal(body, &manifest); err != nil {
-		r.log.V(5).Error(err, "failed unmarshaling body")
-		return c.Status(fiber.StatusBadRequest).
-			JSON(ErrorResponse{
-				Errors: []Error{{
-					Code:    ErrCodeManifestInvalid,
-					Message: "failed unmarshaling body",
-				}},
-			})
+	var mf types.Manifest
+	if err := errors.Join(json.Unmarshal(body, &manifest), json.Unmarshal(body, &mf)); err != nil {
+		return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, "failed unmarshaling body", err.Error())
 	}
 
 	// "mediaType", if it exists, must match Content-Type header.
@@ -68,15 +57,18 @@ func (r Registry) handleManifestPush(c *fiber.Ctx) error {
 	if ok {
 		mt, ok := mtIf.(string)
 		if !ok || ct != mt {
-			return c.Status(fiber.StatusBadRequest).
-				SendString("Content-Type doesn't match mediaType")
+			return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, "Content-Type doesn't match mediaType",
+				map[string]interface{}{"contentType": ct, "mediaType": mtIf})
 		}
 		ct = mt
 	}
 
 	if ct == "" {
-		return c.Status(fiber.StatusBadRequest).
-			SendString("no content-type set")
+		return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, "no content-type set", nil)
+	}
+
+	if err := checkManifest(ct, mf); err != nil {
+		return newError(fiber.StatusBadRequest, ErrCodeManifestInvalid, err.Error(), nil)
 	}
 
 	mid := c.UserContext().Value(midCtxKey{}).(types.ManifestID)
@@ -84,19 +76,60 @@ func (r Registry) handleManifestPush(c *fiber.Ctx) error {
 	var dig types.Digest
 	if mid.Digest != nil {
 		dig = *mid.Digest
+		if _, err := types.ParseDigest(dig.String()); err != nil {
+			return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": dig.String()})
+		}
 	} else {
-		dig, err = types.NewDigest("sha256", bytes.NewReader(body))
+		dig, err = types.NewDigest(types.AlgoSHA256, bytes.NewReader(body))
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).
-				SendString("failed creating digest")
+			return fmt.Errorf("failed creating digest: %w", err)
 		}
 		mid.Digest = &dig
 	}
 
-	if err := r.store.StoreManifest(mid, bytes.NewReader(body)); err != nil {
+	if err := r.store.StoreManifest(mid, bytes.NewReader(body), manifestReferences(ct, mf)); err != nil {
+		if errors.As(err, &storage.ErrDigestMismatch{}) {
+			return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, err.Error(), map[string]string{"digest": dig.String()})
+		}
+		var unknown storage.ErrReferencesUnknown
+		if errors.As(err, &unknown) {
+			errs := make([]Error, len(unknown.Digests))
+			for idx, dig := range unknown.Digests {
+				errs[idx] = Error{
+					Code:    ErrCodeManifestBlobUnknown,
+					Message: "blob unknown to registry",
+					Detail:  map[string]string{"digest": dig.String()},
+				}
+			}
+			return apiError{status: fiber.StatusBadRequest, errors: errs}
+		}
 		return fmt.Errorf("failed storing manifest: %w", err)
 	}
 
+	if mf.Subject != nil {
+		desc := types.Descriptor{
+			MediaType:    ct,
+			Digest:       *mid.Digest,
+			Size:         int64(len(body)),
+			ArtifactType: mf.EffectiveArtifactType(),
+			Annotations:  mf.Annotations,
+		}
+		if err := r.store.StoreReferrer(mid.Namespace, mid.Repo, mf.Subject.Digest, desc); err != nil {
+			return fmt.Errorf("failed storing referrer: %w", err)
+		}
+		c.Set("OCI-Subject", mf.Subject.Digest.String())
+	}
+
+	if r.replicator != nil {
+		// the push has been accepted at this point so failing to queue it for replication doesn't fail the request.
+		if err := r.replicator.Enqueue(mid); err != nil {
+			r.log.Error(err, "failed queueing manifest for replication", "namespace", mid.Namespace, "repo", mid.Repo,
+				"ref", mid.Ref())
+		}
+	}
+
+	r.notifyManifest(c, notifications.ActionPush, mid, ct, int64(len(body)))
+
 	c.Set(fiber.HeaderLocation, fmt.Sprintf("/v2/%s/%s/manifests/%s", mid.Namespace, mid.Repo, mid.Ref()))
 	if r.features.Enabled(features.SendLegacyDigestHeader) {
 		c.Set("Docker-Content-Digest", mid.Digest.String())
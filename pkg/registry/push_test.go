@@ -5,15 +5,42 @@ package registry_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/go-logr/logr"
 	. "github.com/onsi/gomega"
 
 	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
 )
 
+// emptyConfigDigest is the digest of the empty JSON object that OCI artifacts without a config use as config blob.
+const emptyConfigDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+
+// testManifest uploads an empty config blob to the repository name and returns an OCI image manifest referencing it.
+// The upload request carries the given Authorization header unless it's empty.
+func testManifest(t *testing.T, r registry.Registry, name, authHdr string) []byte {
+	t.Helper()
+	g := NewWithT(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+emptyConfigDigest, strings.NewReader("{}"))
+	if authHdr != "" {
+		req.Header.Set("Authorization", authHdr)
+	}
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "uploading config blob failed")
+
+	return []byte(`{"schemaVersion":2,"mediaType":"` + types.MediaTypeImageManifest + `",` +
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"` + emptyConfigDigest + `","size":2}}`)
+}
+
 func TestPushManifests(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -74,12 +101,20 @@ func TestPushManifests(t *testing.T) {
 		},
 		{
 			name:            "push by digest",
-			ref:             "sha256:foobar",
+			ref:             "sha256:78261144944958a4b5403c020f2034ccf37268cb7f85f384d3db0852a90bbff0",
 			body:            []byte(`{"mediaType":"foo/bar"}`),
 			maxManifestSize: 99,
 			contentType:     "foo/bar",
 			expStatusCode:   http.StatusCreated,
-			expLocation:     "/v2/ns/repo/manifests/sha256:foobar",
+			expLocation:     "/v2/ns/repo/manifests/sha256:78261144944958a4b5403c020f2034ccf37268cb7f85f384d3db0852a90bbff0",
+		},
+		{
+			name:            "push by mismatching digest",
+			ref:             "sha256:foobar",
+			body:            []byte(`{"mediaType":"foo/bar"}`),
+			maxManifestSize: 99,
+			contentType:     "foo/bar",
+			expStatusCode:   http.StatusBadRequest,
 		},
 	}
 
@@ -108,3 +143,180 @@ func TestPushManifests(t *testing.T) {
 		})
 	}
 }
+
+func TestPushAndPullManifestBySHA512Digest(t *testing.T) {
+	g := NewWithT(t)
+
+	s, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed initializing file storage backend")
+	r, _ := registry.New(
+		registry.WithStorage(s),
+	)
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	manifest := testManifest(t, r, "ns/repo", "")
+	dig, err := types.NewDigest(types.AlgoSHA512, bytes.NewReader(manifest))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+
+	req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/"+dig.String(), bytes.NewReader(manifest))
+	req.Header.Add("Content-Type", mt)
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "manifest push failed")
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/ns/repo/manifests/"+dig.String(), nil)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK), "manifest pull failed")
+	g.Expect(resp).To(HaveHTTPBody(manifest), "manifest pull returned unexpected body")
+
+	req = httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/sha512:"+strings.Repeat("ab", 64), bytes.NewReader(manifest))
+	req.Header.Add("Content-Type", mt)
+	resp, err = r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusBadRequest), "pushing manifest with wrong digest should fail")
+}
+
+func TestPushValidatesManifests(t *testing.T) {
+	missing1 := "sha256:" + strings.Repeat("1", 64)
+	missing2 := "sha256:" + strings.Repeat("2", 64)
+	config := `"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"` + emptyConfigDigest + `","size":2}`
+
+	tests := []struct {
+		name       string
+		mediaType  string
+		body       string
+		expStatus  int
+		expCode    string
+		expMissing []string
+		withChild  bool
+	}{
+		{
+			name:      "valid image manifest",
+			mediaType: types.MediaTypeImageManifest,
+			body:      `{"schemaVersion":2,` + config + `}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			name:      "valid Docker manifest",
+			mediaType: types.MediaTypeDockerManifest,
+			body:      `{"schemaVersion":2,"mediaType":"` + types.MediaTypeDockerManifest + `",` + config + `}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			name:      "unsupported schema version",
+			mediaType: types.MediaTypeImageManifest,
+			body:      `{"schemaVersion":1,` + config + `}`,
+			expStatus: http.StatusBadRequest,
+			expCode:   registry.ErrCodeManifestInvalid,
+		},
+		{
+			name:      "missing config",
+			mediaType: types.MediaTypeDockerManifest,
+			body:      `{"schemaVersion":2}`,
+			expStatus: http.StatusBadRequest,
+			expCode:   registry.ErrCodeManifestInvalid,
+		},
+		{
+			name:      "layer without media type",
+			mediaType: types.MediaTypeImageManifest,
+			body:      `{"schemaVersion":2,` + config + `,"layers":[{"digest":"` + emptyConfigDigest + `","size":2}]}`,
+			expStatus: http.StatusBadRequest,
+			expCode:   registry.ErrCodeManifestInvalid,
+		},
+		{
+			name:      "missing layers",
+			mediaType: types.MediaTypeImageManifest,
+			body: `{"schemaVersion":2,` + config + `,"layers":[` +
+				`{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"` + missing1 + `","size":1},` +
+				`{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"` + missing2 + `","size":1}]}`,
+			expStatus:  http.StatusBadRequest,
+			expCode:    registry.ErrCodeManifestBlobUnknown,
+			expMissing: []string{missing1, missing2},
+		},
+		{
+			name:      "missing foreign layer",
+			mediaType: types.MediaTypeDockerManifest,
+			body: `{"schemaVersion":2,` + config + `,"layers":[` +
+				`{"mediaType":"` + types.MediaTypeDockerForeignLayer + `","digest":"` + missing1 + `","size":1,"urls":["https://example.org"]}]}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			name:       "index with missing manifest",
+			mediaType:  types.MediaTypeImageIndex,
+			body:       `{"schemaVersion":2,"manifests":[{"mediaType":"` + types.MediaTypeImageManifest + `","digest":"` + missing1 + `","size":1}]}`,
+			expStatus:  http.StatusBadRequest,
+			expCode:    registry.ErrCodeManifestBlobUnknown,
+			expMissing: []string{missing1},
+		},
+		{
+			name:      "valid index",
+			mediaType: types.MediaTypeImageIndex,
+			body:      `{"schemaVersion":2,"manifests":[{"mediaType":"` + types.MediaTypeImageManifest + `","digest":"%s","size":1}]}`,
+			expStatus: http.StatusCreated,
+			withChild: true,
+		},
+		{
+			name:      "valid Docker manifest list",
+			mediaType: types.MediaTypeDockerManifestList,
+			body:      `{"schemaVersion":2,"manifests":[{"mediaType":"` + types.MediaTypeImageManifest + `","digest":"%s","size":1}]}`,
+			expStatus: http.StatusCreated,
+			withChild: true,
+		},
+		{
+			name:      "index with config",
+			mediaType: types.MediaTypeImageIndex,
+			body:      `{"schemaVersion":2,` + config + `}`,
+			expStatus: http.StatusBadRequest,
+			expCode:   registry.ErrCodeManifestInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := newFileRegistry(t)
+			child := testManifest(t, r, "ns/repo", "")
+
+			body := tt.body
+			if tt.withChild {
+				childDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(child))
+				g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+				req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/"+childDig.String(), bytes.NewReader(child))
+				req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+				resp, err := r.Test(req)
+				g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+				g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "pushing child manifest failed")
+				body = fmt.Sprintf(body, childDig)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", strings.NewReader(body))
+			req.Header.Set("Content-Type", tt.mediaType)
+			resp, err := r.Test(req)
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(tt.expStatus))
+
+			if tt.expCode == "" {
+				return
+			}
+
+			var errResp struct {
+				Errors []struct {
+					Code   string            `json:"code"`
+					Detail map[string]string `json:"detail"`
+				} `json:"errors"`
+			}
+			g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+			g.Expect(errResp.Errors).NotTo(BeEmpty())
+			var missing []string
+			for _, e := range errResp.Errors {
+				g.Expect(e.Code).To(Equal(tt.expCode))
+				if e.Detail != nil {
+					missing = append(missing, e.Detail["digest"])
+				}
+			}
+			g.Expect(missing).To(Equal(tt.expMissing))
+		})
+	}
+}
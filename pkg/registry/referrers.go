@@ -0,0 +1,43 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+func (r Registry) handleReferrers(c *fiber.Ctx) error {
+	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
+
+	refs, err := r.store.Referrers(bid.Namespace, bid.Repo, bid.Digest)
+	if err != nil {
+		return fmt.Errorf("failed fetching referrers from storage: %w", err)
+	}
+
+	if at := c.Query("artifactType"); at != "" {
+		filtered := make([]types.Descriptor, 0, len(refs))
+		for _, ref := range refs {
+			if ref.ArtifactType == at {
+				filtered = append(filtered, ref)
+			}
+		}
+		refs = filtered
+		c.Set("OCI-Filters-Applied", "artifactType")
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Digest.String() < refs[j].Digest.String()
+	})
+
+	return c.JSON(types.Index{
+		SchemaVersion: 2,
+		MediaType:     types.MediaTypeImageIndex,
+		Manifests:     refs,
+	}, types.MediaTypeImageIndex)
+}
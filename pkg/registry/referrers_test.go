@@ -0,0 +1,125 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func TestReferrers(t *testing.T) {
+	g := NewWithT(t)
+
+	r, _ := registry.New(
+		registry.WithMemStorage(),
+	)
+
+	push := func(ref string, manifest []byte) *http.Response {
+		req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/"+ref, bytes.NewReader(manifest))
+		req.Header.Add("Content-Type", types.MediaTypeImageManifest)
+		resp, err := r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated), "manifest push failed")
+		return resp
+	}
+
+	subject := testManifest(t, r, "ns/repo", "")
+	subjectDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(subject))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+	resp := push("subject", subject)
+	g.Expect(resp.Header.Get("OCI-Subject")).To(BeEmpty(), "unexpected OCI-Subject header on manifest without subject")
+
+	sbom := []byte(`{"schemaVersion":2,"mediaType":"` + types.MediaTypeImageManifest + `","artifactType":"application/spdx+json",` +
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"` + emptyConfigDigest + `","size":2},` +
+		`"subject":{"mediaType":"` + types.MediaTypeImageManifest + `","digest":"` + subjectDig.String() + `","size":` +
+		`60}}`)
+	resp = push("sbom", sbom)
+	g.Expect(resp).To(HaveHTTPHeaderWithValue("OCI-Subject", subjectDig.String()))
+
+	sig := []byte(`{"schemaVersion":2,"mediaType":"` + types.MediaTypeImageManifest + `","config":{"mediaType":"application/vnd.dev.cosign",` +
+		`"digest":"` + subjectDig.String() + `","size":1},"subject":{"mediaType":"` + types.MediaTypeImageManifest +
+		`","digest":"` + subjectDig.String() + `","size":60}}`)
+	push("sig", sig)
+
+	fetch := func(path string) types.Index {
+		resp, err := r.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+		g.Expect(resp).To(HaveHTTPHeaderWithValue("Content-Type", types.MediaTypeImageIndex))
+		b, err := io.ReadAll(resp.Body)
+		g.Expect(err).NotTo(HaveOccurred(), "failed reading response body")
+		var idx types.Index
+		g.Expect(json.Unmarshal(b, &idx)).To(Succeed(), "failed decoding response body")
+		return idx
+	}
+
+	idx := fetch("/v2/ns/repo/referrers/" + subjectDig.String())
+	g.Expect(idx.SchemaVersion).To(Equal(2))
+	g.Expect(idx.MediaType).To(Equal(types.MediaTypeImageIndex))
+	g.Expect(idx.Manifests).To(HaveLen(2))
+
+	artifactTypes := []string{idx.Manifests[0].ArtifactType, idx.Manifests[1].ArtifactType}
+	g.Expect(artifactTypes).To(ConsistOf("application/spdx+json", "application/vnd.dev.cosign"))
+
+	idx = fetch("/v2/ns/repo/referrers/" + subjectDig.String() + "?artifactType=" + url.QueryEscape("application/spdx+json"))
+	g.Expect(idx.Manifests).To(HaveLen(1))
+	g.Expect(idx.Manifests[0].ArtifactType).To(Equal("application/spdx+json"))
+	g.Expect(idx.Manifests[0].Size).To(Equal(int64(len(sbom))))
+
+	idx = fetch("/v2/ns/other/referrers/" + subjectDig.String())
+	g.Expect(idx.Manifests).To(BeEmpty())
+}
+
+func TestPushRejectsSubjectWithPathTraversal(t *testing.T) {
+	g := NewWithT(t)
+
+	tmp := t.TempDir()
+	s, err := storage.NewFileStorage(filepath.Join(tmp, "data"), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed initializing file storage backend")
+	r, err := registry.New(registry.WithStorage(s), registry.WithLogger(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+
+	config := testManifest(t, r, "ns/repo", "")
+	for _, mt := range []string{types.MediaTypeImageManifest, "application/vnd.example.unknown+json"} {
+		for _, enc := range []string{"../../../../../../escaped", strings.Repeat("A", 64), strings.Repeat("a", 63)} {
+			manifest := append(bytes.TrimSuffix(config, []byte("}")),
+				[]byte(`,"subject":{"mediaType":"`+types.MediaTypeImageManifest+`","digest":"sha256:`+enc+`","size":2}}`)...)
+			req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", bytes.NewReader(manifest))
+			req.Header.Set("Content-Type", mt)
+			resp, err := r.Test(req)
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusBadRequest), "subject %q of %s has been accepted", enc, mt)
+			g.Expect(resp.Header.Get("OCI-Subject")).To(BeEmpty())
+
+			var errResp struct {
+				Errors []struct {
+					Code string `json:"code"`
+				} `json:"errors"`
+			}
+			g.Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed(), "failed decoding error response")
+			g.Expect(errResp.Errors).To(HaveLen(1))
+			g.Expect(errResp.Errors[0].Code).To(Equal(registry.ErrCodeManifestInvalid))
+		}
+	}
+
+	entries, err := os.ReadDir(tmp)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entries).To(HaveLen(1), "files have been created outside the storage root")
+	g.Expect(entries[0].Name()).To(Equal("data"))
+}
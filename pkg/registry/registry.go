@@ -9,12 +9,16 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 
+	"github.com/makkes/garage/pkg/auth"
 	"github.com/makkes/garage/pkg/features"
+	"github.com/makkes/garage/pkg/notifications"
+	"github.com/makkes/garage/pkg/replication"
 	"github.com/makkes/garage/pkg/storage"
 	"github.com/makkes/garage/pkg/types"
 )
@@ -22,7 +26,7 @@ import (
 const (
 	NamespaceRegex = `^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`
 	TagRegex       = `^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`
-	DigestRegex    = `^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+`
+	DigestRegex    = `^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`
 )
 
 type Opt func(r *Registry) error
@@ -33,6 +37,7 @@ type ctxKey int
 
 const (
 	bidCtxKey ctxKey = iota
+	userCtxKey
 )
 
 type Registry struct {
@@ -43,19 +48,29 @@ type Registry struct {
 	digRE            *regexp.Regexp
 	maxManifestBytes int64
 	store            storage.Storage
-	uploadSessions   map[string]string
+	sessionTTL       time.Duration
 	features         features.Features
+	authn            auth.Authenticator
+	authz            auth.Authorizer
+	tokenIssuer      *auth.TokenIssuer
+	proxy            *proxy
+	replicator       *replication.Replicator
+	notifier         *notifications.Notifier
 }
 
 func New(opts ...Opt) (Registry, error) {
-	r := Registry{
+	var r Registry
+	r = Registry{
 		App: fiber.New(fiber.Config{
 			DisableStartupMessage: true,
+			// the closure makes sure that the handler sees the registry with all options applied.
+			ErrorHandler: func(c *fiber.Ctx, err error) error {
+				return r.handleError(c, err)
+			},
 		}),
-		nsRE:           regexp.MustCompile(NamespaceRegex),
-		tagRE:          regexp.MustCompile(TagRegex),
-		digRE:          regexp.MustCompile(DigestRegex),
-		uploadSessions: make(map[string]string),
+		nsRE:  regexp.MustCompile(NamespaceRegex),
+		tagRE: regexp.MustCompile(TagRegex),
+		digRE: regexp.MustCompile(DigestRegex),
 	}
 	r.App.Server().StreamRequestBody = true
 	r.App.Use(recover.New())
@@ -70,25 +85,42 @@ func New(opts ...Opt) (Registry, error) {
 		return r, fmt.Errorf("failed applying default config: %w", err)
 	}
 
+	if r.tokenIssuer != nil {
+		r.App.Get("/token", r.handleToken)
+	}
+
+	pull := repoAccess(auth.ActionPull)
+	push := repoAccess(auth.ActionPull, auth.ActionPush)
+	del := repoAccess(auth.ActionDelete)
+
 	v2 := r.App.Group("/v2")
-	v2.Get("/", func(c *fiber.Ctx) error {
+	v2.Get("/", r.authorize(nil), func(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusOK)
 	})
 
-	v2.Get("/+/tags/list", r.validateNamespacePath, r.handleTagList)
+	v2.Get("/_catalog", r.authorize(catalogAccess), r.handleCatalog)
+	if r.replicator != nil {
+		v2.Get("/_replication", r.authorize(catalogAccess), r.handleReplicationStatus)
+	}
+	if r.notifier != nil {
+		v2.Get("/_notifications", r.authorize(catalogAccess), r.handleNotificationStatus)
+	}
+	v2.Get("/+/tags/list", r.validateNamespacePath, r.authorize(pull), r.handleTagList)
+	v2.Get("/+/referrers/:dig", r.validateBlobPath, r.authorize(pull), r.handleReferrers)
 
 	mr := v2.Group("/+/manifests/:ref", r.validateManifestPath)
-	mr.Get("", r.handleManifestPull)
-	mr.Put("", r.handleManifestPush)
-	mr.Delete("", r.handleManifestDelete)
+	mr.Get("", r.authorize(pull), r.handleManifestPull)
+	mr.Put("", r.authorize(push), r.handleManifestPush)
+	mr.Delete("", r.authorize(del), r.handleManifestDelete)
 
 	br := v2.Group("/+/blobs/")
-	br.Post("uploads/", r.validateNamespacePath, r.handleBlobSessionPost)
-	br.Patch("uploads/:uuid", r.validateNamespacePath, r.handleBlobPatch)
-	br.Put("uploads/:uuid", r.validateNamespacePath, r.handleBlobPut)
-	br.Get("uploads/:uuid", r.validateNamespacePath, r.handleBlobGet)
-	br.Get(":dig", r.validateBlobPath, r.handleBlobPull)
-	br.Delete(":dig", r.validateBlobPath, r.handleBlobDelete)
+	br.Post("uploads/", r.validateNamespacePath, r.authorize(push), r.handleBlobSessionPost)
+	br.Patch("uploads/:uuid", r.validateNamespacePath, r.authorize(push), r.handleBlobPatch)
+	br.Put("uploads/:uuid", r.validateNamespacePath, r.authorize(push), r.handleBlobPut)
+	br.Get("uploads/:uuid", r.validateNamespacePath, r.authorize(push), r.handleBlobGet)
+	br.Delete("uploads/:uuid", r.validateNamespacePath, r.authorize(push), r.handleBlobSessionDelete)
+	br.Get(":dig", r.validateBlobPath, r.authorize(pull), r.handleBlobPull)
+	br.Delete(":dig", r.validateBlobPath, r.authorize(del), r.handleBlobDelete)
 
 	return r, nil
 }
@@ -108,12 +140,12 @@ func (r Registry) Test(req *http.Request) (*http.Response, error) {
 func (r Registry) validateNamespacePath(c *fiber.Ctx) error {
 	nameP := c.Params("+1")
 	if !r.nsRE.MatchString(nameP) {
-		return fiber.NewError(fiber.StatusBadRequest, "wrong path")
+		return nameInvalid(fiber.StatusBadRequest, nameP, "invalid repository name")
 	}
 
 	ns, repo, err := parseName(nameP)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("failed parsing name: %s", err))
+		return nameInvalid(fiber.StatusBadRequest, nameP, fmt.Sprintf("failed parsing name: %s", err))
 	}
 
 	c.SetUserContext(context.WithValue(c.UserContext(), bidCtxKey, types.BlobID{
@@ -127,8 +159,11 @@ func (r Registry) validateNamespacePath(c *fiber.Ctx) error {
 func (r Registry) validateBlobPath(c *fiber.Ctx) error {
 	nameP := c.Params("+1")
 	digP := c.Params("dig")
-	if !r.nsRE.MatchString(nameP) || !r.digRE.MatchString(digP) {
-		return fiber.NewError(fiber.StatusBadRequest, "wrong path")
+	if !r.nsRE.MatchString(nameP) {
+		return nameInvalid(fiber.StatusBadRequest, nameP, "invalid repository name")
+	}
+	if !r.digRE.MatchString(digP) {
+		return newError(fiber.StatusBadRequest, ErrCodeDigestInvalid, "invalid digest", map[string]string{"digest": digP})
 	}
 
 	var dig types.Digest
@@ -138,7 +173,7 @@ func (r Registry) validateBlobPath(c *fiber.Ctx) error {
 
 	ns, repo, err := parseName(nameP)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("failed parsing name: %s", err))
+		return nameInvalid(fiber.StatusBadRequest, nameP, fmt.Sprintf("failed parsing name: %s", err))
 	}
 
 	c.SetUserContext(context.WithValue(c.UserContext(), bidCtxKey, types.BlobID{
@@ -154,7 +189,7 @@ func (r Registry) validateManifestPath(c *fiber.Ctx) error {
 	name := c.Params("+1")
 	ref := c.Params("ref")
 	if !r.nsRE.MatchString(name) {
-		return fiber.NewError(fiber.StatusNotFound, "wrong name path")
+		return nameInvalid(fiber.StatusNotFound, name, "invalid repository name")
 	}
 
 	var tag string
@@ -167,12 +202,12 @@ func (r Registry) validateManifestPath(c *fiber.Ctx) error {
 		dig.Algo = sp[0]
 		dig.Enc = sp[1]
 	default:
-		return fiber.NewError(fiber.StatusNotFound, "wrong reference path")
+		return newError(fiber.StatusNotFound, ErrCodeManifestUnknown, "invalid reference", map[string]string{"reference": ref})
 	}
 
 	ns, repo, err := parseName(name)
 	if err != nil {
-		return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("failed parsing name: %s", err))
+		return nameInvalid(fiber.StatusNotFound, name, fmt.Sprintf("failed parsing name: %s", err))
 	}
 
 	mid := types.ManifestID{
@@ -14,6 +14,7 @@ import (
 
 	"github.com/makkes/garage/pkg/features"
 	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/types"
 )
 
 func TestPushManifestWithLegacyHeader(t *testing.T) {
@@ -29,7 +30,7 @@ func TestPushManifestWithLegacyHeader(t *testing.T) {
 	)
 
 	mt := "application/vnd.oci.image.manifest.v1+json"
-	manifest := []byte(`{"mediaType":"` + mt + `"}`)
+	manifest := testManifest(t, r, "ns/repo", "")
 
 	req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/new-ref", bytes.NewReader(manifest))
 	req.Header.Add("Content-Type", mt)
@@ -39,7 +40,9 @@ func TestPushManifestWithLegacyHeader(t *testing.T) {
 	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
 	g.Expect(resp.StatusCode).To(Equal(http.StatusCreated), "received unexpected status code")
 
-	g.Expect(resp.Header["Docker-Content-Digest"]).To(Equal([]string{"sha256:0a1b17bf6d39f56897a7e8a056d930cf2bde38841a187aeb083d7487e2224573"}))
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(manifest))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+	g.Expect(resp.Header["Docker-Content-Digest"]).To(Equal([]string{dig.String()}))
 }
 
 func TestPushAndPullManifest(t *testing.T) {
@@ -50,7 +53,7 @@ func TestPushAndPullManifest(t *testing.T) {
 	)
 
 	mt := "application/vnd.oci.image.manifest.v1+json"
-	manifest := []byte(`{"mediaType":"` + mt + `"}`)
+	manifest := testManifest(t, r, "ns/repo", "")
 
 	req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/new-ref", bytes.NewReader(manifest))
 	req.Header.Add("Content-Type", mt)
@@ -0,0 +1,18 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (r Registry) handleReplicationStatus(c *fiber.Ctx) error {
+	status, err := r.replicator.Status()
+	if err != nil {
+		return fmt.Errorf("failed fetching replication status: %w", err)
+	}
+	return c.JSON(status)
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/replication"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func TestReplicatesPushedManifests(t *testing.T) {
+	g := NewWithT(t)
+
+	target := newUpstream(t)
+	s := storage.NewMemStorage()
+	rep, err := replication.New(s, []replication.Target{{
+		Name:     "dr",
+		URL:      target.url,
+		Username: "alice",
+		Password: "secret",
+		Exclude:  []string{"*/scratch"},
+	}}, replication.Options{QueueDir: t.TempDir()}, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating replicator")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rep.Run(ctx)
+
+	r, err := registry.New(registry.WithStorage(s), registry.WithLogger(logr.Discard()), registry.WithReplicator(rep))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+
+	for _, name := range []string{"team/app", "team/scratch"} {
+		req := httptest.NewRequest(http.MethodPut, "/v2/"+name+"/manifests/v1", bytes.NewReader(testManifest(t, r, name, "")))
+		req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+		resp, err := r.Test(req)
+		g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+	}
+
+	var status []replication.Status
+	g.Eventually(func(g Gomega) {
+		resp, body := get(t, r, "/v2/_replication")
+		g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+		g.Expect(json.Unmarshal(body, &status)).To(Succeed())
+		g.Expect(status).To(HaveLen(1))
+		g.Expect(status[0].Pending).To(BeZero())
+	}).Should(Succeed())
+	g.Expect(status[0].Target).To(Equal("dr"))
+	g.Expect(status[0].URL).To(Equal(target.url))
+	g.Expect(status[0].Replicated).To(BeEquivalentTo(1))
+
+	c, err := client.New(target.url, client.WithBasicAuth("alice", "secret"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating client")
+	_, err = c.HeadManifest(context.Background(), "team/app", "v1")
+	g.Expect(err).NotTo(HaveOccurred(), "manifest hasn't been replicated")
+	_, err = c.HeadManifest(context.Background(), "team/scratch", "v1")
+	g.Expect(err).To(BeAssignableToTypeOf(client.ErrNotFound{}), "excluded repository has been replicated")
+}
+
+func TestReplicationStatusRequiresReplicator(t *testing.T) {
+	g := NewWithT(t)
+
+	resp, _ := get(t, newFileRegistry(t), "/v2/_replication")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusNotFound))
+}
+
+func TestReplicationFailureDoesNotFailPush(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	rep, err := replication.New(s, []replication.Target{{Name: "dr", URL: "http://127.0.0.1:1"}},
+		replication.Options{QueueDir: t.TempDir(), MinBackoff: time.Hour}, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating replicator")
+	r, err := registry.New(registry.WithStorage(s), registry.WithLogger(logr.Discard()), registry.WithReplicator(rep))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+
+	req := httptest.NewRequest(http.MethodPut, "/v2/team/app/manifests/v1", bytes.NewReader(testManifest(t, r, "team/app", "")))
+	req.Header.Set("Content-Type", types.MediaTypeImageManifest)
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+
+	status, err := rep.Status()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status[0].Pending).To(Equal(1))
+}
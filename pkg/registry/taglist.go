@@ -16,47 +16,44 @@ import (
 
 func (r Registry) handleTagList(c *fiber.Ctx) error {
 	bid := c.UserContext().Value(bidCtxKey).(types.BlobID)
-	n := c.QueryInt("n", -1)
 
 	tags, err := r.store.Tags(bid.Namespace, bid.Repo)
-	if err != nil {
-		if errors.As(err, &storage.ErrNotFound{}) {
-			return c.SendStatus(fiber.StatusNotFound)
-		}
-		r.log.Error(err, "failed fetching tags from storage")
-		return c.Status(fiber.StatusInternalServerError).
-			SendString("failed fetching tags from storage")
+	known := err == nil
+	if err != nil && !errors.As(err, &storage.ErrNotFound{}) {
+		return fmt.Errorf("failed fetching tags from storage: %w", err)
 	}
 
-	sort.Strings(tags)
-
-	if last := c.Query("last", ""); last != "" {
-		i := indexOf(last, tags)
-		if i == -1 {
-			tags = []string{}
-		} else {
-			tags = tags[i+1:]
-		}
+	if r.proxy != nil {
+		// the upstream registry usually has more tags than have been pulled through the proxy.
+		upstream, upstreamKnown := r.upstreamTags(c.UserContext(), bid.Namespace, bid.Repo)
+		tags = union(tags, upstream)
+		known = known || upstreamKnown
 	}
 
-	if n >= 0 {
-		if n >= len(tags) {
-			n = len(tags)
-		}
-		tags = tags[0:n]
+	if !known {
+		return newError(fiber.StatusNotFound, ErrCodeNameUnknown, "repository name not known to registry",
+			map[string]string{"name": fmt.Sprintf("%s/%s", bid.Namespace, bid.Repo)})
 	}
 
+	sort.Strings(tags)
+
+	name := fmt.Sprintf("%s/%s", bid.Namespace, bid.Repo)
+
 	return c.JSON(types.TagList{
-		Name: fmt.Sprintf("%s/%s", bid.Namespace, bid.Repo),
-		Tags: tags,
+		Name: name,
+		Tags: paginate(c, tags, fmt.Sprintf("/v2/%s/tags/list", name)),
 	})
 }
 
-func indexOf(of string, s []string) int {
-	for idx, e := range s {
-		if e == of {
-			return idx
+// union returns all distinct elements of a and b.
+func union(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	res := make([]string, 0, len(a)+len(b))
+	for _, s := range append(a, b...) {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			res = append(res, s)
 		}
 	}
-	return -1
+	return res
 }
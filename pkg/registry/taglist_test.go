@@ -0,0 +1,108 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+func TestTagList(t *testing.T) {
+	r := newFileRegistry(t)
+
+	mt := "application/vnd.oci.image.manifest.v1+json"
+	for _, tag := range []string{"v3", "v1", "v2", "v4", "deleted"} {
+		req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/"+tag, bytes.NewReader(testManifest(t, r, "ns/repo", "")))
+		req.Header.Add("Content-Type", mt)
+		resp, err := r.Test(req)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("failed pushing tag %s: %v", tag, err)
+		}
+	}
+	resp, err := r.Test(httptest.NewRequest(http.MethodDelete, "/v2/ns/repo/manifests/deleted", nil))
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("failed deleting tag: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		expTags []string
+		expLink string
+	}{
+		{
+			name:    "all tags",
+			expTags: []string{"v1", "v2", "v3", "v4"},
+		},
+		{
+			name:    "first page",
+			query:   "?n=2",
+			expTags: []string{"v1", "v2"},
+			expLink: `</v2/ns/repo/tags/list?n=2&last=v2>; rel="next"`,
+		},
+		{
+			name:    "middle page",
+			query:   "?n=1&last=v2",
+			expTags: []string{"v3"},
+			expLink: `</v2/ns/repo/tags/list?n=1&last=v3>; rel="next"`,
+		},
+		{
+			name:    "last page",
+			query:   "?n=2&last=v2",
+			expTags: []string{"v3", "v4"},
+		},
+		{
+			name:    "deleted marker",
+			query:   "?last=v2-deleted",
+			expTags: []string{"v3", "v4"},
+		},
+		{
+			name:    "marker after all tags",
+			query:   "?last=zzz",
+			expTags: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			resp, err := r.Test(httptest.NewRequest(http.MethodGet, "/v2/ns/repo/tags/list"+tt.query, nil))
+			g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+			g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+			g.Expect(resp).To(HaveHTTPHeaderWithValue("Link", tt.expLink))
+
+			var tl types.TagList
+			g.Expect(json.NewDecoder(resp.Body).Decode(&tl)).To(Succeed(), "failed decoding response body")
+			g.Expect(tl.Name).To(Equal("ns/repo"))
+			g.Expect(tl.Tags).To(Equal(tt.expTags))
+		})
+	}
+}
+
+func TestTagListOfRepositoryWithoutTags(t *testing.T) {
+	g := NewWithT(t)
+
+	r := newFileRegistry(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/v2/ns/repo/manifests/latest", bytes.NewReader(testManifest(t, r, "ns/repo", "")))
+	req.Header.Add("Content-Type", types.MediaTypeImageManifest)
+	resp, err := r.Test(req)
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusCreated))
+	resp, err = r.Test(httptest.NewRequest(http.MethodDelete, "/v2/ns/repo/manifests/latest", nil))
+	g.Expect(err).NotTo(HaveOccurred(), "test request failed unexpectedly")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusAccepted))
+
+	resp, body := get(t, r, "/v2/ns/repo/tags/list")
+	g.Expect(resp).To(HaveHTTPStatus(http.StatusOK))
+	g.Expect(body).To(MatchJSON(`{"name":"ns/repo","tags":[]}`))
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/makkes/garage/pkg/auth"
+)
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// handleToken issues tokens as specified by the Docker registry token authentication specification. If the registry
+// has an authorizer, the token only grants the requested access permitted by it. Otherwise anonymous clients receive a
+// token that doesn't grant any access.
+func (r Registry) handleToken(c *fiber.Ctx) error {
+	var user string
+	if hdr := c.Get(fiber.HeaderAuthorization); hdr != "" {
+		u, p, ok := auth.ParseBasicAuth(hdr)
+		if !ok || !r.tokenIssuer.Verify(u, p) {
+			c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf("Basic realm=%q", r.tokenIssuer.Service()))
+			return newError(fiber.StatusUnauthorized, ErrCodeUnauthorized, "invalid credentials", nil)
+		}
+		user = u
+	}
+
+	if svc := c.Query("service"); svc != "" && svc != r.tokenIssuer.Service() {
+		return newError(fiber.StatusBadRequest, ErrCodeUnsupported, "unknown service", map[string]string{"service": svc})
+	}
+
+	var access []auth.Access
+	for _, scope := range c.Context().QueryArgs().PeekMulti("scope") {
+		a, err := auth.ParseScope(string(scope))
+		if err != nil {
+			return newError(fiber.StatusBadRequest, ErrCodeUnsupported, err.Error(), map[string]string{"scope": string(scope)})
+		}
+		access = append(access, a...)
+	}
+
+	switch {
+	case r.authz != nil:
+		access = r.authz.Permitted(user, access)
+	case user == "":
+		access = nil
+	}
+
+	now := time.Now()
+	tok, err := r.tokenIssuer.Issue(user, access, now)
+	if err != nil {
+		return fmt.Errorf("failed issuing token for user %q: %w", user, err)
+	}
+
+	return c.JSON(tokenResponse{
+		Token:       tok,
+		AccessToken: tok,
+		ExpiresIn:   int(r.tokenIssuer.TTL().Seconds()),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// checkManifest verifies that the manifest with media type mt contains all required fields. Manifests of unknown
+// media types are accepted as is apart from their subject.
+func checkManifest(mt string, mf types.Manifest) error {
+	switch mt {
+	case types.MediaTypeImageManifest, types.MediaTypeDockerManifest:
+		if mf.SchemaVersion != 2 {
+			return fmt.Errorf("unsupported schemaVersion %d", mf.SchemaVersion)
+		}
+		if mf.Config == nil {
+			return fmt.Errorf("config is missing")
+		}
+		if err := checkDescriptor("config", *mf.Config); err != nil {
+			return err
+		}
+		for idx, l := range mf.Layers {
+			if err := checkDescriptor(fmt.Sprintf("layers[%d]", idx), l); err != nil {
+				return err
+			}
+		}
+		if len(mf.Manifests) > 0 {
+			return fmt.Errorf("image manifest must not contain manifests")
+		}
+	case types.MediaTypeImageIndex, types.MediaTypeDockerManifestList:
+		if mf.SchemaVersion != 2 {
+			return fmt.Errorf("unsupported schemaVersion %d", mf.SchemaVersion)
+		}
+		for idx, m := range mf.Manifests {
+			if err := checkDescriptor(fmt.Sprintf("manifests[%d]", idx), m); err != nil {
+				return err
+			}
+		}
+		if mf.Config != nil || len(mf.Layers) > 0 {
+			return fmt.Errorf("index must not contain config or layers")
+		}
+	}
+
+	// the subject is checked for manifests of all media types as it is stored as a referrer.
+	if mf.Subject != nil {
+		if err := checkDescriptor("subject", *mf.Subject); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkDescriptor(field string, d types.Descriptor) error {
+	if d.MediaType == "" {
+		return fmt.Errorf("%s: mediaType is missing", field)
+	}
+	if d.Digest == (types.Digest{}) {
+		return fmt.Errorf("%s: digest is missing", field)
+	}
+	if _, err := types.ParseDigest(d.Digest.String()); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	if d.Size < 0 {
+		return fmt.Errorf("%s: size must not be negative", field)
+	}
+	return nil
+}
+
+// manifestReferences returns all blobs and child manifests referenced by the manifest with media type mt that need to
+// exist in its repository. The subject of a manifest is allowed to be missing.
+func manifestReferences(mt string, mf types.Manifest) storage.References {
+	var refs storage.References
+
+	switch mt {
+	case types.MediaTypeImageManifest, types.MediaTypeDockerManifest:
+		for _, desc := range append([]types.Descriptor{*mf.Config}, mf.Layers...) {
+			if desc.Distributable() {
+				refs.Blobs = append(refs.Blobs, desc.Digest)
+			}
+		}
+	case types.MediaTypeImageIndex, types.MediaTypeDockerManifestList:
+		for _, desc := range mf.Manifests {
+			refs.Manifests = append(refs.Manifests, desc.Digest)
+		}
+	}
+
+	return refs
+}
@@ -0,0 +1,602 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package replication mirrors manifests pushed to the registry to other registries.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+	// maxIndexDepth limits the nesting of indexes that are replicated.
+	maxIndexDepth = 4
+	// corruptJobSuffix is appended to the names of job files that can't be read.
+	corruptJobSuffix = ".corrupt"
+)
+
+var targetNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Target is a registry that pushes are replicated to.
+type Target struct {
+	// Name identifies the target in the replication status and names its queue directory.
+	Name     string `mapstructure:"name"`
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Include and Exclude are glob patterns as understood by path.Match that repository names are matched against.
+	// Only repositories matching any of the Include patterns (or all if there are none) and none of the Exclude
+	// patterns are replicated to the target.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+}
+
+func (t Target) matches(repo string) bool {
+	if len(t.Include) > 0 && !matchesAny(t.Include, repo) {
+		return false
+	}
+	return !matchesAny(t.Exclude, repo)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configure a Replicator.
+type Options struct {
+	// QueueDir is the directory that pending replication jobs are persisted in.
+	QueueDir string
+	// MinBackoff and MaxBackoff bound the exponentially growing delay between attempts to replicate a manifest.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// Status describes the replication state of a target.
+type Status struct {
+	Target string `json:"target"`
+	URL    string `json:"url"`
+	// Pending is the number of manifests waiting to be replicated.
+	Pending int `json:"pending"`
+	// OldestPending is the time the oldest pending manifest has been pushed.
+	OldestPending *time.Time `json:"oldestPending,omitempty"`
+	// Replicated is the number of manifests replicated since the registry has been started.
+	Replicated uint64 `json:"replicated"`
+	// Failures is the number of failed attempts to replicate a manifest since the registry has been started.
+	Failures      uint64     `json:"failures"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Replicator replicates manifests and the blobs they reference to all matching targets. Manifests are queued on disk so
+// that replication resumes after a restart, and failed attempts are retried with exponential backoff.
+type Replicator struct {
+	store   storage.Storage
+	targets []*target
+	opts    Options
+	log     logr.Logger
+}
+
+// New creates a Replicator that replicates manifests from store to targets. It doesn't replicate anything until Run
+// is called.
+func New(store storage.Storage, targets []Target, opts Options, log logr.Logger) (Replicator, error) {
+	if opts.QueueDir == "" {
+		return Replicator{}, fmt.Errorf("queue directory must not be empty")
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+
+	r := Replicator{
+		store: store,
+		opts:  opts,
+		log:   log,
+	}
+
+	names := make(map[string]struct{}, len(targets))
+	for _, t := range targets {
+		if !targetNameRE.MatchString(t.Name) {
+			return Replicator{}, fmt.Errorf("invalid target name %q", t.Name)
+		}
+		if _, ok := names[t.Name]; ok {
+			return Replicator{}, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		for _, p := range append(append([]string{}, t.Include...), t.Exclude...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return Replicator{}, fmt.Errorf("invalid repository pattern %q for target %q: %w", p, t.Name, err)
+			}
+		}
+
+		c, err := client.New(t.URL, client.WithBasicAuth(t.Username, t.Password))
+		if err != nil {
+			return Replicator{}, fmt.Errorf("failed creating client for target %q: %w", t.Name, err)
+		}
+
+		dir := filepath.Join(opts.QueueDir, t.Name)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return Replicator{}, fmt.Errorf("failed creating queue directory for target %q: %w", t.Name, err)
+		}
+
+		r.targets = append(r.targets, &target{
+			Target: t,
+			client: c,
+			dir:    dir,
+			wake:   make(chan struct{}, 1),
+			mounts: make(map[types.Digest]string),
+		})
+	}
+
+	return r, nil
+}
+
+// job is a manifest waiting to be replicated to a target.
+type job struct {
+	Namespace   string       `json:"namespace"`
+	Repo        string       `json:"repo"`
+	Tag         string       `json:"tag,omitempty"`
+	Digest      types.Digest `json:"digest"`
+	Created     time.Time    `json:"created"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"nextAttempt"`
+	LastError   string       `json:"lastError,omitempty"`
+}
+
+func (j job) ref() string {
+	if j.Tag != "" {
+		return j.Tag
+	}
+	return j.Digest.String()
+}
+
+// target holds the queue and state of a single replication target.
+type target struct {
+	Target
+	client client.Client
+	dir    string
+	// wake is signaled when a job has been enqueued.
+	wake chan struct{}
+
+	// mu guards the queue directory and all fields below.
+	mu     sync.Mutex
+	status Status
+	// mounts maps blobs to the repository on the target they have last been pushed to so that they can be mounted
+	// into other repositories.
+	mounts map[types.Digest]string
+}
+
+var jobSeq atomic.Uint64
+
+// Enqueue queues the manifest identified by mid, which must have a digest, for replication to all targets whose
+// filters match its repository.
+func (r Replicator) Enqueue(mid types.ManifestID) error {
+	if mid.Digest == nil {
+		return fmt.Errorf("manifest digest must not be nil")
+	}
+
+	j := job{
+		Namespace: mid.Namespace,
+		Repo:      mid.Repo,
+		Digest:    *mid.Digest,
+		Created:   time.Now(),
+	}
+	if mid.Tag != nil {
+		j.Tag = *mid.Tag
+	}
+
+	repo := mid.Namespace + "/" + mid.Repo
+	var errs []error
+	for _, t := range r.targets {
+		if !t.matches(repo) {
+			continue
+		}
+		if err := t.enqueue(j); err != nil {
+			errs = append(errs, fmt.Errorf("failed queueing manifest for target %q: %w", t.Name, err))
+			continue
+		}
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *target) enqueue(j job) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// a pending job for the same tag is superseded so that an older manifest can't overwrite a newer one on retry.
+	if j.Tag != "" {
+		files, err := t.jobFiles()
+		if err != nil {
+			return err
+		}
+		for _, fn := range files {
+			old, err := t.readJob(fn)
+			if err != nil {
+				continue
+			}
+			if old.Namespace == j.Namespace && old.Repo == j.Repo && old.Tag == j.Tag {
+				if err := os.Remove(filepath.Join(t.dir, fn)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return fmt.Errorf("failed removing superseded job: %w", err)
+				}
+			}
+		}
+	}
+
+	return t.writeJob(fmt.Sprintf("%020d-%08d.json", j.Created.UnixNano(), jobSeq.Add(1)), j)
+}
+
+// jobFiles returns the names of all queued job files in the order they have been queued. The caller needs to hold t.mu.
+func (t *target) jobFiles() ([]string, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading queue directory: %w", err)
+	}
+
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".json") {
+			res = append(res, e.Name())
+		}
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (t *target) readJob(fn string) (job, error) {
+	var j job
+	b, err := os.ReadFile(filepath.Join(t.dir, fn))
+	if err != nil {
+		return j, fmt.Errorf("failed reading job: %w", err)
+	}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return j, fmt.Errorf("failed decoding job %s: %w", fn, err)
+	}
+	return j, nil
+}
+
+// writeJob atomically writes the job to the file fn. The caller needs to hold t.mu.
+func (t *target) writeJob(fn string, j job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("failed encoding job: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(t.dir, ".job-")
+	if err != nil {
+		return fmt.Errorf("failed creating job file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing job file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed closing job file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(t.dir, fn)); err != nil {
+		return fmt.Errorf("failed moving job file into place: %w", err)
+	}
+
+	return nil
+}
+
+// Run replicates queued manifests to all targets until ctx is done.
+func (r Replicator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range r.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.runTarget(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+func (r Replicator) runTarget(ctx context.Context, t *target) {
+	log := r.log.WithValues("target", t.Name)
+	for {
+		next, err := r.processDue(ctx, t, log)
+		if err != nil {
+			log.Error(err, "failed processing replication queue")
+			next = time.Now().Add(r.opts.MinBackoff)
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.wake:
+		case <-timer:
+		}
+	}
+}
+
+// processDue attempts all jobs of the target that are due and returns the time the next job is due or the zero time if
+// there are no jobs left.
+func (r Replicator) processDue(ctx context.Context, t *target, log logr.Logger) (time.Time, error) {
+	t.mu.Lock()
+	files, err := t.jobFiles()
+	t.mu.Unlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	for _, fn := range files {
+		if ctx.Err() != nil {
+			return next, nil
+		}
+
+		t.mu.Lock()
+		j, err := t.readJob(fn)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// a broken job file is moved aside so that it doesn't block the jobs queued after it.
+			log.Error(err, "failed reading job, moving it aside", "file", fn+corruptJobSuffix)
+			if err := os.Rename(filepath.Join(t.dir, fn), filepath.Join(t.dir, fn+corruptJobSuffix)); err != nil {
+				log.Error(err, "failed moving aside unreadable job", "file", fn)
+			}
+		}
+		t.mu.Unlock()
+		if err != nil {
+			// the job has been superseded in the meantime or is broken.
+			continue
+		}
+
+		if time.Now().Before(j.NextAttempt) {
+			if next.IsZero() || j.NextAttempt.Before(next) {
+				next = j.NextAttempt
+			}
+			continue
+		}
+
+		jlog := log.WithValues("namespace", j.Namespace, "repo", j.Repo, "ref", j.ref())
+		replErr := r.replicate(ctx, t, j)
+		if replErr != nil && ctx.Err() != nil {
+			// the attempt has been interrupted by shutting down so it isn't counted as a failure.
+			return next, nil
+		}
+
+		t.mu.Lock()
+		now := time.Now()
+		if replErr == nil {
+			if err := os.Remove(filepath.Join(t.dir, fn)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				jlog.Error(err, "failed removing replicated job")
+			}
+			t.status.Replicated++
+			t.status.LastSuccess = &now
+			t.mu.Unlock()
+			jlog.V(5).Info("replicated manifest")
+			continue
+		}
+
+		t.status.Failures++
+		t.status.LastError = replErr.Error()
+		t.status.LastErrorTime = &now
+		j.Attempts++
+		j.LastError = replErr.Error()
+		j.NextAttempt = now.Add(r.backoff(j.Attempts))
+		// the job is only updated if it hasn't been superseded while it was attempted.
+		if _, err := os.Stat(filepath.Join(t.dir, fn)); err == nil {
+			if err := t.writeJob(fn, j); err != nil {
+				jlog.Error(err, "failed updating job")
+			}
+		}
+		t.mu.Unlock()
+
+		jlog.Error(replErr, "failed replicating manifest", "attempts", j.Attempts, "nextAttempt", j.NextAttempt)
+		if next.IsZero() || j.NextAttempt.Before(next) {
+			next = j.NextAttempt
+		}
+	}
+
+	return next, nil
+}
+
+// backoff returns the delay before the next attempt after the given number of failed attempts.
+func (r Replicator) backoff(attempts int) time.Duration {
+	d := r.opts.MinBackoff
+	for i := 1; i < attempts && d < r.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.opts.MaxBackoff)
+}
+
+// replicate pushes the job's manifest with all blobs and child manifests it references to the target.
+func (r Replicator) replicate(ctx context.Context, t *target, j job) error {
+	data, err := r.fetchManifest(j.Namespace, j.Repo, j.Digest)
+	if err != nil {
+		if errors.As(err, &storage.ErrNotFound{}) {
+			// there's nothing to replicate if the manifest has been deleted in the meantime. Anything else that is
+			// missing fails the job so that it is retried.
+			r.log.V(5).Info("not replicating deleted manifest", "target", t.Name, "namespace", j.Namespace, "repo", j.Repo,
+				"digest", j.Digest)
+			return nil
+		}
+		return err
+	}
+	return r.replicateManifestData(ctx, t, j.Namespace, j.Repo, j.Digest, data, j.ref(), 0)
+}
+
+func (r Replicator) fetchManifest(ns, repo string, dig types.Digest) ([]byte, error) {
+	rdr, err := r.store.FetchManifest(types.ManifestID{Namespace: ns, Repo: repo, Digest: &dig})
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching manifest %s: %w", dig, err)
+	}
+	defer rdr.Close()
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading manifest %s: %w", dig, err)
+	}
+	return data, nil
+}
+
+func (r Replicator) replicateManifest(ctx context.Context, t *target, ns, repo string, dig types.Digest, ref string, depth int) error {
+	data, err := r.fetchManifest(ns, repo, dig)
+	if err != nil {
+		return err
+	}
+	return r.replicateManifestData(ctx, t, ns, repo, dig, data, ref, depth)
+}
+
+// replicateManifestData pushes the manifest with the digest dig and the given content to the target under ref after
+// pushing all blobs and child manifests it references.
+func (r Replicator) replicateManifestData(ctx context.Context, t *target, ns, repo string, dig types.Digest, data []byte, ref string, depth int) error {
+	if depth > maxIndexDepth {
+		return fmt.Errorf("indexes nested too deeply")
+	}
+
+	var mf types.Manifest
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return fmt.Errorf("failed decoding manifest %s: %w", dig, err)
+	}
+
+	mt := mf.MediaType
+	if mt == "" {
+		mt = types.MediaTypeImageManifest
+		if len(mf.Manifests) > 0 {
+			mt = types.MediaTypeImageIndex
+		}
+	}
+
+	switch mt {
+	case types.MediaTypeImageIndex, types.MediaTypeDockerManifestList:
+		for _, desc := range mf.Manifests {
+			if err := r.replicateManifest(ctx, t, ns, repo, desc.Digest, desc.Digest.String(), depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		var blobs []types.Descriptor
+		if mf.Config != nil {
+			blobs = append(blobs, *mf.Config)
+		}
+		for _, desc := range append(blobs, mf.Layers...) {
+			if !desc.Distributable() {
+				continue
+			}
+			if err := r.replicateBlob(ctx, t, ns, repo, desc.Digest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := t.client.PutManifest(ctx, ns+"/"+repo, ref, mt, data); err != nil {
+		return fmt.Errorf("failed pushing manifest %s: %w", dig, err)
+	}
+
+	return nil
+}
+
+func (r Replicator) replicateBlob(ctx context.Context, t *target, ns, repo string, dig types.Digest) error {
+	name := ns + "/" + repo
+	exists, err := t.client.BlobExists(ctx, name, dig)
+	if err != nil {
+		return fmt.Errorf("failed checking blob %s: %w", dig, err)
+	}
+	if exists {
+		return nil
+	}
+
+	rdr, bs, err := r.store.FetchBlob(types.BlobID{Namespace: ns, Repo: repo, Digest: dig})
+	if err != nil {
+		return fmt.Errorf("failed fetching blob %s: %w", dig, err)
+	}
+	defer rdr.Close()
+
+	t.mu.Lock()
+	from := t.mounts[dig]
+	t.mu.Unlock()
+	if from == name {
+		from = ""
+	}
+
+	mounted, err := t.client.PushBlob(ctx, name, dig, bs.Size, rdr, from)
+	if err != nil {
+		return fmt.Errorf("failed pushing blob %s: %w", dig, err)
+	}
+	if mounted {
+		r.log.V(7).Info("mounted blob", "target", t.Name, "repo", name, "from", from, "digest", dig)
+	}
+
+	t.mu.Lock()
+	t.mounts[dig] = name
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Status returns the replication status of all targets.
+func (r Replicator) Status() ([]Status, error) {
+	res := make([]Status, 0, len(r.targets))
+	for _, t := range r.targets {
+		s, err := t.currentStatus()
+		if err != nil {
+			return nil, fmt.Errorf("failed gathering status of target %q: %w", t.Name, err)
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func (t *target) currentStatus() (Status, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.status
+	s.Target = t.Name
+	s.URL = t.client.URL()
+
+	files, err := t.jobFiles()
+	if err != nil {
+		return s, err
+	}
+	s.Pending = len(files)
+	if len(files) > 0 {
+		if j, err := t.readJob(files[0]); err == nil {
+			s.OldestPending = &j.Created
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,406 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replication_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/client"
+	"github.com/makkes/garage/pkg/registry"
+	"github.com/makkes/garage/pkg/replication"
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// target is a registry served over HTTP that records the requests it receives.
+type target struct {
+	url string
+	mu  *sync.Mutex
+	// requests holds the method, path and query of every request.
+	requests *[]string
+}
+
+func newTarget(t *testing.T) target {
+	t.Helper()
+	g := NewWithT(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred(), "failed listening")
+	r, err := registry.New(registry.WithMemStorage(), registry.WithLogger(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred(), "failed creating registry")
+	go func() {
+		_ = r.App.Listener(ln)
+	}()
+	t.Cleanup(func() {
+		_ = r.App.Shutdown()
+	})
+
+	u, err := url.Parse("http://" + ln.Addr().String())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tgt := target{mu: &sync.Mutex{}, requests: &[]string{}}
+	rp := httputil.NewSingleHostReverseProxy(u)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tgt.mu.Lock()
+		*tgt.requests = append(*tgt.requests, req.Method+" "+req.URL.RequestURI())
+		tgt.mu.Unlock()
+		rp.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	tgt.url = srv.URL
+
+	return tgt
+}
+
+func (tgt target) recorded() []string {
+	tgt.mu.Lock()
+	defer tgt.mu.Unlock()
+	return append([]string{}, *tgt.requests...)
+}
+
+func (tgt target) client(t *testing.T) client.Client {
+	t.Helper()
+	c, err := client.New(tgt.url)
+	NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed creating client")
+	return c
+}
+
+// storeImage stores an image with a single layer in the repository ns/repo under tag and returns the manifest and its
+// digest.
+func storeImage(t *testing.T, s storage.Storage, ns, repo, tag string, layer []byte) ([]byte, types.Digest) {
+	t.Helper()
+	g := NewWithT(t)
+
+	var descs []types.Descriptor
+	for _, b := range [][]byte{[]byte("{}"), layer} {
+		dig, err := s.StoreBlob(types.BlobID{Namespace: ns, Repo: repo}, bytes.NewReader(b))
+		g.Expect(err).NotTo(HaveOccurred(), "failed storing blob")
+		descs = append(descs, types.Descriptor{MediaType: "application/octet-stream", Digest: dig, Size: int64(len(b))})
+	}
+	descs[0].MediaType = "application/vnd.oci.image.config.v1+json"
+
+	mf, err := json.Marshal(types.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.MediaTypeImageManifest,
+		Config:        &descs[0],
+		Layers:        descs[1:],
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed encoding manifest")
+
+	return mf, storeManifest(t, s, ns, repo, tag, mf)
+}
+
+func storeManifest(t *testing.T, s storage.Storage, ns, repo, tag string, mf []byte) types.Digest {
+	t.Helper()
+	g := NewWithT(t)
+
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(mf))
+	g.Expect(err).NotTo(HaveOccurred(), "failed calculating digest")
+	mid := types.ManifestID{Namespace: ns, Repo: repo, Digest: &dig}
+	if tag != "" {
+		mid.Tag = &tag
+	}
+	g.Expect(s.StoreManifest(mid, bytes.NewReader(mf), storage.References{})).To(Succeed(), "failed storing manifest")
+
+	return dig
+}
+
+func enqueue(t *testing.T, rep replication.Replicator, ns, repo, tag string, dig types.Digest) {
+	t.Helper()
+	mid := types.ManifestID{Namespace: ns, Repo: repo, Digest: &dig}
+	if tag != "" {
+		mid.Tag = &tag
+	}
+	NewWithT(t).Expect(rep.Enqueue(mid)).To(Succeed(), "failed queueing manifest")
+}
+
+func run(t *testing.T, rep replication.Replicator) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rep.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func newReplicator(t *testing.T, s storage.Storage, dir string, targets ...replication.Target) replication.Replicator {
+	t.Helper()
+	rep, err := replication.New(s, targets, replication.Options{
+		QueueDir:   dir,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}, logr.Discard())
+	NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed creating replicator")
+	return rep
+}
+
+func pending(t *testing.T, rep replication.Replicator) []int {
+	t.Helper()
+	status, err := rep.Status()
+	NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed fetching status")
+	res := make([]int, 0, len(status))
+	for _, s := range status {
+		res = append(res, s.Pending)
+	}
+	return res
+}
+
+func TestReplicatesImageAndMountsBlobs(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	tgt := newTarget(t)
+	rep := newReplicator(t, s, t.TempDir(), replication.Target{Name: "dr", URL: tgt.url})
+	run(t, rep)
+
+	layer := []byte("this is the layer")
+	mf, dig := storeImage(t, s, "team", "app", "v1", layer)
+	enqueue(t, rep, "team", "app", "v1", dig)
+	g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+
+	c := tgt.client(t)
+	m, err := c.GetManifest(context.Background(), "team/app", "v1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(m.Data).To(Equal(mf))
+	g.Expect(m.Digest).To(Equal(dig))
+	layerDig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(layer))
+	g.Expect(err).NotTo(HaveOccurred())
+	rdr, _, err := c.GetBlob(context.Background(), "team/app", layerDig)
+	g.Expect(err).NotTo(HaveOccurred())
+	b, err := io.ReadAll(rdr)
+	rdr.Close()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(b).To(Equal(layer))
+
+	status, err := rep.Status()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status).To(HaveLen(1))
+	g.Expect(status[0].Target).To(Equal("dr"))
+	g.Expect(status[0].Replicated).To(BeEquivalentTo(1))
+	g.Expect(status[0].Failures).To(BeZero())
+	g.Expect(status[0].LastSuccess).NotTo(BeNil())
+
+	// the same image in another repository has its blobs mounted instead of uploaded.
+	_, dig = storeImage(t, s, "team", "other", "", layer)
+	enqueue(t, rep, "team", "other", "", dig)
+	g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+	g.Expect(c.HeadManifest(context.Background(), "team/other", dig.String())).To(Equal(dig))
+	g.Expect(tgt.recorded()).To(ContainElement(
+		"POST /v2/team/other/blobs/uploads/?from=team%2Fapp&mount=" + url.QueryEscape(layerDig.String())))
+	g.Expect(tgt.recorded()).NotTo(ContainElement(HavePrefix("PUT /v2/team/other/blobs/")))
+}
+
+func TestReplicatesIndex(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	tgt := newTarget(t)
+	rep := newReplicator(t, s, t.TempDir(), replication.Target{Name: "dr", URL: tgt.url})
+	run(t, rep)
+
+	var descs []types.Descriptor
+	for _, layer := range []string{"amd64", "arm64"} {
+		mf, dig := storeImage(t, s, "team", "app", "", []byte(layer))
+		descs = append(descs, types.Descriptor{MediaType: types.MediaTypeImageManifest, Digest: dig, Size: int64(len(mf))})
+	}
+	idx, err := json.Marshal(types.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.MediaTypeImageIndex,
+		Manifests:     descs,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	dig := storeManifest(t, s, "team", "app", "latest", idx)
+	enqueue(t, rep, "team", "app", "latest", dig)
+	g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+
+	c := tgt.client(t)
+	m, err := c.GetManifest(context.Background(), "team/app", "latest")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(m.Data).To(Equal(idx))
+	g.Expect(m.MediaType).To(Equal(types.MediaTypeImageIndex))
+	for _, desc := range descs {
+		g.Expect(c.HeadManifest(context.Background(), "team/app", desc.Digest.String())).To(Equal(desc.Digest))
+	}
+}
+
+func TestFilters(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	rep := newReplicator(t, s, t.TempDir(),
+		replication.Target{Name: "all", URL: "http://127.0.0.1:1"},
+		replication.Target{Name: "team", URL: "http://127.0.0.1:1", Include: []string{"team/*"}, Exclude: []string{"*/scratch"}},
+	)
+
+	dig := types.Digest{Algo: "sha256", Enc: "abc"}
+	enqueue(t, rep, "team", "app", "", dig)
+	enqueue(t, rep, "team", "scratch", "", dig)
+	enqueue(t, rep, "other", "app", "", dig)
+	g.Expect(pending(t, rep)).To(Equal([]int{3, 1}))
+
+	_, err := replication.New(s, []replication.Target{{Name: "a", URL: "http://a", Include: []string{"["}}},
+		replication.Options{QueueDir: t.TempDir()}, logr.Discard())
+	g.Expect(err).To(MatchError(ContainSubstring(`invalid repository pattern "["`)))
+	_, err = replication.New(s, []replication.Target{{Name: "a", URL: "http://a"}, {Name: "a", URL: "http://b"}},
+		replication.Options{QueueDir: t.TempDir()}, logr.Discard())
+	g.Expect(err).To(MatchError(`duplicate target name "a"`))
+	_, err = replication.New(s, []replication.Target{{Name: "../a", URL: "http://a"}},
+		replication.Options{QueueDir: t.TempDir()}, logr.Discard())
+	g.Expect(err).To(MatchError(`invalid target name "../a"`))
+}
+
+func TestRetriesFromPersistentQueue(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	dir := t.TempDir()
+
+	// the target is unreachable at first.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+	unreachable := "http://" + ln.Addr().String()
+	g.Expect(ln.Close()).To(Succeed())
+
+	rep := newReplicator(t, s, dir, replication.Target{Name: "dr", URL: unreachable})
+	_, dig1 := storeImage(t, s, "team", "app", "v1", []byte("first"))
+	enqueue(t, rep, "team", "app", "v1", dig1)
+	mf, dig2 := storeImage(t, s, "team", "app", "v1", []byte("second"))
+	enqueue(t, rep, "team", "app", "v1", dig2)
+	// pushing the same tag again supersedes the pending manifest.
+	g.Expect(pending(t, rep)).To(Equal([]int{1}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rep.Run(ctx)
+		close(done)
+	}()
+	g.Eventually(func() uint64 {
+		status, err := rep.Status()
+		g.Expect(err).NotTo(HaveOccurred())
+		return status[0].Failures
+	}).Should(BeNumerically(">=", 2))
+	cancel()
+	<-done
+
+	status, err := rep.Status()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(status[0].Pending).To(Equal(1))
+	g.Expect(status[0].LastError).To(ContainSubstring("connection refused"))
+	g.Expect(status[0].LastErrorTime).NotTo(BeNil())
+	g.Expect(status[0].OldestPending).NotTo(BeNil())
+
+	// a new replicator picks up the queued manifest once the target is reachable.
+	tgt := newTarget(t)
+	rep = newReplicator(t, s, dir, replication.Target{Name: "dr", URL: tgt.url})
+	g.Expect(pending(t, rep)).To(Equal([]int{1}))
+	run(t, rep)
+	g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+
+	m, err := tgt.client(t).GetManifest(context.Background(), "team/app", "v1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(m.Data).To(Equal(mf))
+}
+
+func TestOnlyDropsDeletedManifests(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		newStore func(t *testing.T) storage.Storage
+	}{
+		{
+			name: "memory",
+			newStore: func(t *testing.T) storage.Storage {
+				return storage.NewMemStorage()
+			},
+		},
+		{
+			name: "file",
+			newStore: func(t *testing.T) storage.Storage {
+				s, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+				NewWithT(t).Expect(err).NotTo(HaveOccurred(), "failed creating storage")
+				return s
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			s := tc.newStore(t)
+			tgt := newTarget(t)
+			rep := newReplicator(t, s, t.TempDir(), replication.Target{Name: "dr", URL: tgt.url})
+
+			// the index references a manifest that isn't stored at first.
+			childMf, childDig := storeImage(t, s, "team", "app", "", []byte("layer"))
+			g.Expect(s.DeleteManifest(types.ManifestID{Namespace: "team", Repo: "app", Digest: &childDig})).To(Succeed())
+			idx, err := json.Marshal(types.Manifest{
+				SchemaVersion: 2,
+				MediaType:     types.MediaTypeImageIndex,
+				Manifests:     []types.Descriptor{{MediaType: types.MediaTypeImageManifest, Digest: childDig, Size: int64(len(childMf))}},
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			dig := storeManifest(t, s, "team", "app", "latest", idx)
+			enqueue(t, rep, "team", "app", "latest", dig)
+			enqueue(t, rep, "team", "deleted", "", types.Digest{Algo: "sha256", Enc: strings.Repeat("0", 64)})
+			run(t, rep)
+
+			g.Eventually(func() uint64 {
+				status, err := rep.Status()
+				g.Expect(err).NotTo(HaveOccurred())
+				return status[0].Failures
+			}).Should(BeNumerically(">=", 1))
+			g.Expect(pending(t, rep)).To(Equal([]int{1}), "the index should have been kept for retrying")
+
+			storeManifest(t, s, "team", "app", "", childMf)
+			g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+			m, err := tgt.client(t).GetManifest(context.Background(), "team/app", "latest")
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(m.Data).To(Equal(idx))
+		})
+	}
+}
+
+func TestMovesAsideCorruptJobs(t *testing.T) {
+	g := NewWithT(t)
+
+	s := storage.NewMemStorage()
+	tgt := newTarget(t)
+	dir := t.TempDir()
+	rep := newReplicator(t, s, dir, replication.Target{Name: "dr", URL: tgt.url})
+
+	// the truncated job is queued before the valid one.
+	corrupt := filepath.Join(dir, "dr", "00000000000000000000-00000000.json")
+	g.Expect(os.WriteFile(corrupt, []byte(`{"namespace":"te`), 0o600)).To(Succeed())
+	mf, dig := storeImage(t, s, "team", "app", "v1", []byte("layer"))
+	enqueue(t, rep, "team", "app", "v1", dig)
+	run(t, rep)
+
+	g.Eventually(func() []int { return pending(t, rep) }).Should(Equal([]int{0}))
+	m, err := tgt.client(t).GetManifest(context.Background(), "team/app", "v1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(m.Data).To(Equal(mf))
+	g.Expect(corrupt).NotTo(BeAnExistingFile(), "corrupt job should have been moved aside")
+	g.Expect(corrupt+".corrupt").To(BeARegularFile(), "corrupt job should have been kept")
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// Names of the built-in storage drivers.
+const (
+	DriverFile   = "file"
+	DriverMemory = "memory"
+	DriverS3     = "s3"
+)
+
+// DriverConfig provides the options of a storage driver. Keys are relative to the driver's own configuration sub-tree,
+// e.g. the S3 driver reads its bucket from "bucket". *viper.Viper satisfies this interface.
+type DriverConfig interface {
+	GetString(key string) string
+	GetBool(key string) bool
+	GetInt64(key string) int64
+}
+
+// Driver creates a Storage from its configuration.
+type Driver func(cfg DriverConfig, log logr.Logger) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Driver{
+		DriverFile:   newFileDriver,
+		DriverMemory: newMemDriver,
+		DriverS3:     newS3Driver,
+	}
+)
+
+// RegisterDriver makes the driver d available under name, allowing other packages to provide their own storage
+// backends. It returns an error if a driver with the same name is already registered.
+func RegisterDriver(name string, d Driver) error {
+	if name == "" {
+		return fmt.Errorf("driver name must not be empty")
+	}
+	if d == nil {
+		return fmt.Errorf("driver %q must not be nil", name)
+	}
+
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if _, ok := drivers[name]; ok {
+		return fmt.Errorf("driver %q is already registered", name)
+	}
+	drivers[name] = d
+
+	return nil
+}
+
+// Drivers returns the sorted names of all registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	res := make([]string, 0, len(drivers))
+	for name := range drivers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// New creates a Storage using the driver registered under name.
+func New(name string, cfg DriverConfig, log logr.Logger) (Storage, error) {
+	driversMu.RLock()
+	d, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %q", name)
+	}
+
+	s, err := d(cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating %q storage: %w", name, err)
+	}
+
+	return s, nil
+}
+
+func newFileDriver(cfg DriverConfig, log logr.Logger) (Storage, error) {
+	return NewFileStorage(cfg.GetString("dir"), log)
+}
+
+func newMemDriver(_ DriverConfig, _ logr.Logger) (Storage, error) {
+	return NewMemStorage(), nil
+}
+
+func newS3Driver(cfg DriverConfig, log logr.Logger) (Storage, error) {
+	return NewS3Storage(S3Options{
+		Endpoint:  cfg.GetString("endpoint"),
+		Region:    cfg.GetString("region"),
+		Bucket:    cfg.GetString("bucket"),
+		Prefix:    cfg.GetString("prefix"),
+		PathStyle: cfg.GetBool("path-style"),
+		Insecure:  cfg.GetBool("insecure"),
+		AccessKey: cfg.GetString("access-key"),
+		SecretKey: cfg.GetString("secret-key"),
+		PartSize:  cfg.GetInt64("part-size"),
+	}, log)
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/storage"
+)
+
+// mapConfig is a storage.DriverConfig backed by a map.
+type mapConfig map[string]string
+
+func (c mapConfig) GetString(key string) string {
+	return c[key]
+}
+
+func (c mapConfig) GetBool(key string) bool {
+	return c[key] == "true"
+}
+
+func (c mapConfig) GetInt64(_ string) int64 {
+	return 0
+}
+
+func TestBuiltinDrivers(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(storage.Drivers()).To(ContainElements(storage.DriverFile, storage.DriverMemory, storage.DriverS3))
+
+	dir := t.TempDir()
+	s, err := storage.New(storage.DriverFile, mapConfig{"dir": dir}, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s).To(BeAssignableToTypeOf(storage.FileStorage{}))
+	g.Expect(s.(storage.FileStorage).Dir()).To(Equal(dir))
+
+	s, err = storage.New(storage.DriverMemory, mapConfig{}, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s).To(BeAssignableToTypeOf(storage.MemStorage{}))
+
+	_, err = storage.New(storage.DriverS3, mapConfig{}, logr.Discard())
+	g.Expect(err).To(MatchError(ContainSubstring("bucket must not be empty")))
+}
+
+func TestUnknownDriver(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := storage.New("does-not-exist", mapConfig{}, logr.Discard())
+	g.Expect(err).To(MatchError(`unknown storage driver "does-not-exist"`))
+}
+
+func TestRegisterDriver(t *testing.T) {
+	g := NewWithT(t)
+
+	var got storage.DriverConfig
+	g.Expect(storage.RegisterDriver("test-custom", func(cfg storage.DriverConfig, _ logr.Logger) (storage.Storage, error) {
+		got = cfg
+		if cfg.GetBool("fail") {
+			return nil, fmt.Errorf("boom")
+		}
+		return storage.NewMemStorage(), nil
+	})).To(Succeed())
+	g.Expect(storage.Drivers()).To(ContainElement("test-custom"))
+
+	cfg := mapConfig{"foo": "bar"}
+	s, err := storage.New("test-custom", cfg, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s).NotTo(BeNil())
+	g.Expect(got.GetString("foo")).To(Equal("bar"))
+
+	_, err = storage.New("test-custom", mapConfig{"fail": "true"}, logr.Discard())
+	g.Expect(err).To(MatchError(`failed creating "test-custom" storage: boom`))
+
+	err = storage.RegisterDriver("test-custom", func(storage.DriverConfig, logr.Logger) (storage.Storage, error) {
+		return nil, nil
+	})
+	g.Expect(err).To(MatchError(`driver "test-custom" is already registered`))
+
+	g.Expect(storage.RegisterDriver(storage.DriverFile, func(storage.DriverConfig, logr.Logger) (storage.Storage, error) {
+		return nil, nil
+	})).To(MatchError(`driver "file" is already registered`))
+	g.Expect(storage.RegisterDriver("", nil)).To(MatchError("driver name must not be empty"))
+	g.Expect(storage.RegisterDriver("test-nil", nil)).To(MatchError(`driver "test-nil" must not be nil`))
+}
@@ -0,0 +1,10 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage
+
+// WithMinPartSize returns opts with the minimum part size lowered to size so that tests can use tiny parts.
+func WithMinPartSize(opts S3Options, size int64) S3Options {
+	opts.minPartSize = size
+	return opts
+}
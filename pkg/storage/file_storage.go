@@ -4,12 +4,18 @@
 package storage
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/uuid"
@@ -20,6 +26,8 @@ import (
 const (
 	blobDirName       = "_blobs"
 	tagDirName        = "_tags"
+	referrerDirName   = "_referrers"
+	sessionInfoSuffix = ".info"
 	contentRangeRegex = `^([0-9]+)-([0-9]+)$`
 )
 
@@ -27,6 +35,8 @@ type FileStorage struct {
 	baseDir string
 	log     logr.Logger
 	crRE    *regexp.Regexp
+	// gcLock is held for reading while blobs and links are created and for writing while garbage is collected.
+	gcLock *sync.RWMutex
 }
 
 var _ Storage = FileStorage{}
@@ -40,9 +50,15 @@ func NewFileStorage(baseDir string, log logr.Logger) (FileStorage, error) {
 		baseDir: baseDir,
 		log:     log,
 		crRE:    regexp.MustCompile(contentRangeRegex),
+		gcLock:  &sync.RWMutex{},
 	}, nil
 }
 
+// Dir returns the directory all data is stored in.
+func (fs FileStorage) Dir() string {
+	return fs.baseDir
+}
+
 func (fs FileStorage) Tags(ns, repo string) ([]string, error) {
 	p := filepath.Join(fs.baseDir, ns, repo, tagDirName)
 	_, err := os.Stat(p)
@@ -67,7 +83,105 @@ func (fs FileStorage) Tags(ns, repo string) ([]string, error) {
 	return res, nil
 }
 
-func (fs FileStorage) StoreManifest(mid types.ManifestID, data io.Reader) (retErr error) {
+// Repositories returns the sorted names of all repositories in the store. A repository is identified by the
+// directories the store creates inside of it for blobs, tags and referrers.
+func (fs FileStorage) Repositories() ([]string, error) {
+	repos := make(map[string]struct{})
+	err := filepath.WalkDir(fs.baseDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == fs.baseDir {
+			return nil
+		}
+
+		name := d.Name()
+		if !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") {
+			return nil
+		}
+
+		if name == blobDirName || name == tagDirName || name == referrerDirName {
+			rel, err := filepath.Rel(fs.baseDir, filepath.Dir(p))
+			if err != nil {
+				return fmt.Errorf("failed deriving repository name: %w", err)
+			}
+			if rel = filepath.ToSlash(rel); strings.Contains(rel, "/") {
+				repos[rel] = struct{}{}
+			}
+		}
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed walking storage directory: %w", err)
+	}
+
+	res := make([]string, 0, len(repos))
+	for repo := range repos {
+		res = append(res, repo)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (fs FileStorage) StoreReferrer(ns, repo string, subject types.Digest, desc types.Descriptor) error {
+	p := filepath.Join(fs.baseDir, ns, repo, referrerDirName, subject.String())
+	if err := ensureDir(p); err != nil {
+		return fmt.Errorf("failed ensuring referrers directory: %w", err)
+	}
+
+	b, err := json.Marshal(desc)
+	if err != nil {
+		return fmt.Errorf("failed encoding descriptor: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(p, desc.Digest.String()), b, 0600); err != nil {
+		return fmt.Errorf("failed writing referrer file: %w", err)
+	}
+
+	return nil
+}
+
+func (fs FileStorage) Referrers(ns, repo string, subject types.Digest) ([]types.Descriptor, error) {
+	p := filepath.Join(fs.baseDir, ns, repo, referrerDirName, subject.String())
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []types.Descriptor{}, nil
+		}
+		return nil, fmt.Errorf("failed listing referrers directory: %w", err)
+	}
+
+	res := make([]types.Descriptor, 0, len(entries))
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(p, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading referrer file: %w", err)
+		}
+
+		var desc types.Descriptor
+		if err := json.Unmarshal(b, &desc); err != nil {
+			return nil, fmt.Errorf("failed decoding referrer file %q: %w", e.Name(), err)
+		}
+
+		// the referring manifest might have been deleted in the meantime.
+		has, err := fs.Has(types.ManifestID{Namespace: ns, Repo: repo, Digest: &desc.Digest})
+		if err != nil {
+			return nil, fmt.Errorf("failed checking referring manifest: %w", err)
+		}
+		if has {
+			res = append(res, desc)
+		}
+	}
+
+	return res, nil
+}
+
+func (fs FileStorage) StoreManifest(mid types.ManifestID, data io.Reader, refs References) (retErr error) {
+	fs.gcLock.RLock()
+	defer fs.gcLock.RUnlock()
+
 	var rollbacks []func() error
 	defer func() {
 		if retErr == nil {
@@ -85,27 +199,31 @@ func (fs FileStorage) StoreManifest(mid types.ManifestID, data io.Reader) (retEr
 		return
 	}
 
+	// the references are checked while holding the GC lock so that they can't be collected before the manifest is stored.
+	missing, err := missingReferences(mid.Namespace, mid.Repo, refs, fs.HasBlob, fs.Has)
+	if err != nil {
+		retErr = fmt.Errorf("failed checking manifest references: %w", err)
+		return
+	}
+	if len(missing) > 0 {
+		retErr = ErrReferencesUnknown{Digests: missing}
+		return
+	}
+
 	bid := types.BlobID{
 		Namespace: mid.Namespace,
 		Repo:      mid.Repo,
 		Digest:    *mid.Digest,
 	}
-	dig, err := fs.StoreBlob(bid, data)
-	if err != nil {
+	if _, err := fs.storeBlob(bid, data); err != nil {
 		retErr = fmt.Errorf("failed storing manifest file: %w", err)
 		return
 	}
 
 	rollbacks = append(rollbacks, func() error {
-		bid.Digest = dig
 		return fs.DeleteBlob(bid)
 	})
 
-	if dig != *mid.Digest {
-		retErr = fmt.Errorf("digests don't match: provided: %s, expected: %s", mid.Digest, dig)
-		return
-	}
-
 	p := filepath.Join(fs.baseDir, mid.Namespace, mid.Repo)
 	if err := ensureDir(p); err != nil {
 		retErr = fmt.Errorf("failed ensuring repository directory: %w", err)
@@ -161,11 +279,22 @@ func (fs FileStorage) DeleteManifest(mid types.ManifestID) error {
 		return fmt.Errorf("failed deriving manifest file name: %w", err)
 	}
 
-	return os.Remove(fn)
+	return removeFile(fn)
 }
 
 func (fs FileStorage) DeleteBlob(bid types.BlobID) error {
-	return os.Remove(filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName, bid.Digest.String()))
+	return removeFile(filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName, bid.Digest.String()))
+}
+
+// removeFile removes the file fn, returning ErrNotFound if it doesn't exist.
+func removeFile(fn string) error {
+	if err := os.Remove(fn); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound{Err: err}
+		}
+		return err
+	}
+	return nil
 }
 
 func ensureDir(path string) error {
@@ -221,7 +350,11 @@ func (fs FileStorage) FetchManifest(mid types.ManifestID) (io.ReadCloser, error)
 	}
 	linkBytes, err := os.ReadFile(fname)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading manifest link: %w", err)
+		retErr := fmt.Errorf("failed reading manifest link: %w", err)
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound{Err: retErr}
+		}
+		return nil, retErr
 	}
 
 	dig, err := types.ParseDigest(string(linkBytes))
@@ -237,39 +370,162 @@ func (fs FileStorage) FetchManifest(mid types.ManifestID) (io.ReadCloser, error)
 	return b, err
 }
 
-func (fs FileStorage) StartSession() (uuid.UUID, error) {
+func (fs FileStorage) StartSession(ns, repo string) (uuid.UUID, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return uuid.UUID{}, fmt.Errorf("failed generating session ID: %w", err)
 	}
 
-	tmpF, err := os.Create(filepath.Join(fs.baseDir, blobDirName, "_"+id.String()))
+	tmpF, err := os.Create(fs.sessionFile(id))
 	if err != nil {
 		return uuid.UUID{}, fmt.Errorf("failed creating temp file: %w", err)
 	}
 	tmpF.Close()
 
+	b, err := json.Marshal(sessionMeta{
+		Namespace: ns,
+		Repo:      repo,
+		Created:   time.Now(),
+	})
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed encoding session metadata: %w", err)
+	}
+	if err := os.WriteFile(fs.sessionInfoFile(id), b, 0600); err != nil {
+		fs.removeSession(id)
+		return uuid.UUID{}, fmt.Errorf("failed writing session metadata: %w", err)
+	}
+
 	return id, nil
 }
 
-func (fs FileStorage) GetSessionInfo(id uuid.UUID) (int64, error) {
-	fi, err := os.Stat(filepath.Join(fs.baseDir, blobDirName, "_"+id.String()))
+func (fs FileStorage) GetSessionInfo(id uuid.UUID) (SessionInfo, error) {
+	fi, err := os.Stat(fs.sessionFile(id))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, ErrSessionNotFound{Err: err}
+			return SessionInfo{}, ErrSessionNotFound{Err: err}
 		}
-		return 0, fmt.Errorf("failed checking session file: %w", err)
+		return SessionInfo{}, fmt.Errorf("failed checking session file: %w", err)
+	}
+
+	info := SessionInfo{
+		Size:         fi.Size(),
+		Created:      fi.ModTime(),
+		LastActivity: fi.ModTime(),
+	}
+
+	b, err := os.ReadFile(fs.sessionInfoFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the session might have been started by a version that didn't write metadata.
+			return info, nil
+		}
+		return SessionInfo{}, fmt.Errorf("failed reading session metadata: %w", err)
 	}
 
-	return fi.Size(), nil
+	var meta sessionMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return SessionInfo{}, fmt.Errorf("failed decoding session metadata: %w", err)
+	}
+	info.Namespace = meta.Namespace
+	info.Repo = meta.Repo
+	info.Created = meta.Created
+
+	return info, nil
 }
 
-func (fs FileStorage) parseRange(s string) (int64, int64, error) {
+func (fs FileStorage) CancelSession(id uuid.UUID) error {
+	if _, err := os.Stat(fs.sessionFile(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound{Err: err}
+		}
+		return fmt.Errorf("failed checking session file: %w", err)
+	}
+
+	fs.removeSession(id)
+
+	return nil
+}
+
+// ExpireSessions removes the data and metadata of all sessions whose data hasn't been modified since before.
+func (fs FileStorage) ExpireSessions(before time.Time) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(fs.baseDir, blobDirName))
+	if err != nil {
+		return 0, fmt.Errorf("failed listing blob directory: %w", err)
+	}
+
+	var n int
+	for _, e := range entries {
+		name, isMeta := strings.CutSuffix(e.Name(), sessionInfoSuffix)
+		if !strings.HasPrefix(name, "_") {
+			continue
+		}
+		id, err := uuid.Parse(name[1:])
+		if err != nil {
+			continue
+		}
+
+		if isMeta {
+			// metadata is removed together with the session's data unless the data is gone already.
+			if _, err := os.Stat(fs.sessionFile(id)); !os.IsNotExist(err) {
+				continue
+			}
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return n, fmt.Errorf("failed checking session file: %w", err)
+		}
+		if !fi.ModTime().Before(before) {
+			continue
+		}
+
+		fs.log.V(5).Info("expiring upload session", "session", id, "lastActivity", fi.ModTime())
+		fs.removeSession(id)
+		if !isMeta {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// sessionMeta is the content of a session's metadata file.
+type sessionMeta struct {
+	Namespace string    `json:"namespace"`
+	Repo      string    `json:"repo"`
+	Created   time.Time `json:"created"`
+}
+
+// sessionFile returns the name of the file holding the data uploaded to the session.
+func (fs FileStorage) sessionFile(id uuid.UUID) string {
+	return filepath.Join(fs.baseDir, blobDirName, "_"+id.String())
+}
+
+// sessionInfoFile returns the name of the file holding the session's metadata.
+func (fs FileStorage) sessionInfoFile(id uuid.UUID) string {
+	return fs.sessionFile(id) + sessionInfoSuffix
+}
+
+// removeSession removes the session's data and metadata, logging any errors.
+func (fs FileStorage) removeSession(id uuid.UUID) {
+	for _, p := range []string{fs.sessionFile(id), fs.sessionInfoFile(id)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			fs.log.Error(err, "failed removing session file", "session", id, "file", p)
+		}
+	}
+}
+
+// parseRange parses the Content-Range header of an upload chunk using the regular expression crRE compiled from
+// contentRangeRegex.
+func parseRange(crRE *regexp.Regexp, s string) (int64, int64, error) {
 	if s == "" {
 		return 0, 0, nil
 	}
 
-	matches := fs.crRE.FindStringSubmatch(s)
+	matches := crRE.FindStringSubmatch(s)
 	if len(matches) != 3 {
 		return 0, 0, fmt.Errorf("range string %q doesn't match expected format %q", s, contentRangeRegex)
 	}
@@ -289,9 +545,9 @@ func (fs FileStorage) parseRange(s string) (int64, int64, error) {
 }
 
 func (fs FileStorage) StoreSessionData(id uuid.UUID, in io.Reader, cr string) (int64, error) {
-	p := filepath.Join(fs.baseDir, blobDirName, "_"+id.String())
+	p := fs.sessionFile(id)
 
-	crs, cre, err := fs.parseRange(cr)
+	crs, cre, err := parseRange(fs.crRE, cr)
 	if err != nil {
 		return 0, fmt.Errorf("failed parsing content-range: %w", err)
 	}
@@ -306,7 +562,7 @@ func (fs FileStorage) StoreSessionData(id uuid.UUID, in io.Reader, cr string) (i
 
 	if crs >= 0 && cre > 0 && crs != fi.Size() {
 		return 0, ErrOutOfOrderChunk{
-			expected: fi.Size() + 1,
+			expected: fi.Size(),
 			actual:   crs,
 		}
 	}
@@ -327,11 +583,11 @@ func (fs FileStorage) StoreSessionData(id uuid.UUID, in io.Reader, cr string) (i
 
 	fs.log.V(7).Info("wrote data to session", "session", id, "bytes", n)
 
-	return n - 1, nil
+	return fi.Size() + n - 1, nil
 }
 
 func (fs FileStorage) CloseSession(id uuid.UUID, bid types.BlobID) (types.Digest, error) {
-	p := filepath.Join(fs.baseDir, blobDirName, "_"+id.String())
+	p := fs.sessionFile(id)
 	var res types.Digest
 
 	tmpF, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
@@ -343,10 +599,26 @@ func (fs FileStorage) CloseSession(id uuid.UUID, bid types.BlobID) (types.Digest
 	}
 	defer tmpF.Close()
 
-	return fs.finalizeBlob(tmpF.Name(), bid)
+	fs.gcLock.RLock()
+	defer fs.gcLock.RUnlock()
+
+	dig, err := fs.finalizeBlob(tmpF.Name(), bid)
+	if err != nil {
+		if errors.As(err, &ErrDigestMismatch{}) {
+			// the uploaded data is useless so we discard the whole session.
+			fs.removeSession(id)
+		}
+		return res, err
+	}
+
+	if err := os.Remove(fs.sessionInfoFile(id)); err != nil && !os.IsNotExist(err) {
+		fs.log.Error(err, "failed removing session metadata", "session", id)
+	}
+
+	return dig, nil
 }
 
-func (fs FileStorage) FetchBlob(bid types.BlobID) (io.ReadCloser, BlobStat, error) {
+func (fs FileStorage) FetchBlob(bid types.BlobID) (io.ReadSeekCloser, BlobStat, error) {
 	_, err := os.Stat(filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName, bid.Digest.String()))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -364,7 +636,58 @@ func (fs FileStorage) FetchBlob(bid types.BlobID) (io.ReadCloser, BlobStat, erro
 		Size: fi.Size(),
 	}
 	rdr, err := os.OpenFile(filepath.Join(fs.baseDir, blobDirName, bid.Digest.String()), os.O_RDONLY, 0)
-	return rdr, bs, err
+	if err != nil {
+		return nil, BlobStat{}, fmt.Errorf("failed opening blob file: %w", err)
+	}
+	return rdr, bs, nil
+}
+
+func (fs FileStorage) HasBlob(bid types.BlobID) (bool, error) {
+	if _, err := os.Stat(filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName, bid.Digest.String())); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed finding blob link: %w", err)
+	}
+	return true, nil
+}
+
+func (fs FileStorage) MountBlob(bid types.BlobID, fromNs, fromRepo string) error {
+	fs.gcLock.RLock()
+	defer fs.gcLock.RUnlock()
+
+	globalBlob := filepath.Join(fs.baseDir, blobDirName, bid.Digest.String())
+	for _, p := range []string{
+		filepath.Join(fs.baseDir, fromNs, fromRepo, blobDirName, bid.Digest.String()),
+		globalBlob,
+	} {
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return ErrNotFound{Err: err}
+			}
+			return fmt.Errorf("failed checking source blob: %w", err)
+		}
+	}
+
+	// the blob might not be referenced by any manifest, yet, so we protect it from garbage collection until the client
+	// has pushed the manifest.
+	now := time.Now()
+	if err := os.Chtimes(globalBlob, now, now); err != nil {
+		return fmt.Errorf("failed updating blob modification time: %w", err)
+	}
+
+	blobDir := filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName)
+	if err := ensureDir(blobDir); err != nil {
+		return fmt.Errorf("failed ensuring repo blob directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(blobDir, bid.Digest.String()), os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed creating blob link: %w", err)
+	}
+	f.Close()
+
+	return nil
 }
 
 func (fs FileStorage) finalizeBlob(tmpF string, bid types.BlobID) (types.Digest, error) {
@@ -374,17 +697,28 @@ func (fs FileStorage) finalizeBlob(tmpF string, bid types.BlobID) (types.Digest,
 	}
 	defer f.Close()
 
-	dig, err := types.NewDigest(types.AlgoSHA256, f)
+	dig, err := types.NewDigest(digestAlgo(bid.Digest), f)
 	if err != nil {
 		return types.Digest{}, fmt.Errorf("failed calculating content digest: %w", err)
 	}
 
+	if bid.Digest != (types.Digest{}) && bid.Digest != dig {
+		return types.Digest{}, ErrDigestMismatch{Expected: bid.Digest, Actual: dig}
+	}
+
 	blobFileName := filepath.Join(fs.baseDir, blobDirName, dig.String())
 
 	if err := os.Rename(tmpF, blobFileName); err != nil {
 		return types.Digest{}, fmt.Errorf("failed creating final blob file: %w", err)
 	}
 
+	// the blob keeps the modification time of its upload session which might have been idle for longer than the GC
+	// grace period so it is protected from garbage collection until the client has pushed the manifest.
+	now := time.Now()
+	if err := os.Chtimes(blobFileName, now, now); err != nil {
+		return types.Digest{}, fmt.Errorf("failed updating blob modification time: %w", err)
+	}
+
 	blobDir := filepath.Join(fs.baseDir, bid.Namespace, bid.Repo, blobDirName)
 	if err := ensureDir(blobDir); err != nil {
 		return types.Digest{}, fmt.Errorf("failed ensuring repo blob directory: %w", err)
@@ -400,6 +734,14 @@ func (fs FileStorage) finalizeBlob(tmpF string, bid types.BlobID) (types.Digest,
 }
 
 func (fs FileStorage) StoreBlob(bid types.BlobID, data io.Reader) (types.Digest, error) {
+	fs.gcLock.RLock()
+	defer fs.gcLock.RUnlock()
+
+	return fs.storeBlob(bid, data)
+}
+
+// storeBlob stores the blob without acquiring the GC lock which the caller needs to hold.
+func (fs FileStorage) storeBlob(bid types.BlobID, data io.Reader) (types.Digest, error) {
 	p := filepath.Join(fs.baseDir, blobDirName)
 	if err := ensureDir(p); err != nil {
 		return types.Digest{}, fmt.Errorf("failed ensuring blob directory: %w", err)
@@ -410,6 +752,7 @@ func (fs FileStorage) StoreBlob(bid types.BlobID, data io.Reader) (types.Digest,
 		return types.Digest{}, fmt.Errorf("failed creating temp file: %w", err)
 	}
 	defer os.Remove(tmpF.Name())
+	defer tmpF.Close()
 
 	if _, err := io.Copy(tmpF, data); err != nil {
 		return types.Digest{}, fmt.Errorf("failed writing blob data to file: %w", err)
@@ -0,0 +1,256 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+// GCOptions control a garbage collection run.
+type GCOptions struct {
+	// DryRun only reports the blobs that would be removed without removing them.
+	DryRun bool
+	// GracePeriod protects blobs that have been written more recently from being removed so that clients have time to
+	// push the manifests referencing them.
+	GracePeriod time.Duration
+}
+
+// GCResult describes the outcome of a garbage collection run.
+type GCResult struct {
+	// Removed contains the digests of all blobs that have been removed (or would have been in a dry run).
+	Removed []types.Digest
+	// Bytes is the sum of the sizes of all removed blobs.
+	Bytes int64
+}
+
+// GarbageCollect removes all blobs that aren't referenced by any manifest in any repository. A blob is referenced by a
+// manifest if it is the manifest itself, its config, one of its layers, one of the manifests of an index or its
+// subject. Blobs and links can't be created while garbage is collected. If any manifest can't be decoded, no blobs are
+// removed.
+func (fs FileStorage) GarbageCollect(opts GCOptions) (GCResult, error) {
+	fs.gcLock.Lock()
+	defer fs.gcLock.Unlock()
+
+	repos, err := fs.Repositories()
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed listing repositories: %w", err)
+	}
+
+	live := make(map[types.Digest]struct{})
+	for _, repo := range repos {
+		if err := fs.markRepository(repo, live); err != nil {
+			return GCResult{}, fmt.Errorf("failed marking blobs of repository %s: %w", repo, err)
+		}
+	}
+
+	res, err := fs.sweepBlobs(live, opts)
+	if err != nil {
+		return res, err
+	}
+
+	if opts.DryRun || len(res.Removed) == 0 {
+		return res, nil
+	}
+
+	removed := make(map[types.Digest]struct{}, len(res.Removed))
+	for _, dig := range res.Removed {
+		removed[dig] = struct{}{}
+	}
+	for _, repo := range repos {
+		if err := fs.sweepLinks(repo, removed); err != nil {
+			return res, fmt.Errorf("failed removing blob links of repository %s: %w", repo, err)
+		}
+	}
+
+	return res, nil
+}
+
+// RunGarbageCollection collects garbage every interval until ctx is done.
+func (fs FileStorage) RunGarbageCollection(ctx context.Context, interval time.Duration, opts GCOptions) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			res, err := fs.GarbageCollect(opts)
+			if err != nil {
+				fs.log.Error(err, "garbage collection failed")
+				continue
+			}
+			fs.log.Info("garbage collection finished", "blobs", len(res.Removed), "bytes", res.Bytes)
+		}
+	}
+}
+
+// markRepository adds the digests of all blobs referenced by the repository's tags and manifests to live.
+func (fs FileStorage) markRepository(repo string, live map[types.Digest]struct{}) error {
+	repoDir := filepath.Join(fs.baseDir, filepath.FromSlash(repo))
+
+	var links []string
+	for _, dir := range []string{repoDir, filepath.Join(repoDir, tagDirName)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed listing manifest links: %w", err)
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() && !isInternalFile(e.Name()) {
+				links = append(links, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	for _, link := range links {
+		b, err := os.ReadFile(link)
+		if err != nil {
+			return fmt.Errorf("failed reading manifest link: %w", err)
+		}
+		dig, err := types.ParseDigest(string(b))
+		if err != nil {
+			fs.log.V(3).Info("ignoring malformed manifest link", "file", link, "error", err.Error())
+			continue
+		}
+		if err := fs.markManifest(dig, live); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markManifest adds the manifest's digest and those of all blobs it references to live.
+func (fs FileStorage) markManifest(dig types.Digest, live map[types.Digest]struct{}) error {
+	if _, ok := live[dig]; ok {
+		return nil
+	}
+	live[dig] = struct{}{}
+
+	b, err := os.ReadFile(filepath.Join(fs.baseDir, blobDirName, dig.String()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed reading manifest %s: %w", dig, err)
+	}
+
+	// the blobs referenced by a manifest that can't be decoded are unknown so the run is aborted instead of removing
+	// blobs that might still be in use.
+	var m types.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("failed decoding manifest %s: %w", dig, err)
+	}
+
+	if m.Config != nil {
+		live[m.Config.Digest] = struct{}{}
+	}
+	for _, l := range m.Layers {
+		live[l.Digest] = struct{}{}
+	}
+	for _, child := range m.Manifests {
+		if err := fs.markManifest(child.Digest, live); err != nil {
+			return err
+		}
+	}
+	if m.Subject != nil {
+		if err := fs.markManifest(m.Subject.Digest, live); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweepBlobs removes all blobs from the global blob directory that aren't live and are older than the grace period.
+func (fs FileStorage) sweepBlobs(live map[types.Digest]struct{}, opts GCOptions) (GCResult, error) {
+	var res GCResult
+
+	blobDir := filepath.Join(fs.baseDir, blobDirName)
+	entries, err := os.ReadDir(blobDir)
+	if err != nil {
+		return res, fmt.Errorf("failed listing blob directory: %w", err)
+	}
+
+	threshold := time.Now().Add(-opts.GracePeriod)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || isInternalFile(e.Name()) {
+			continue
+		}
+		dig, err := types.ParseDigest(e.Name())
+		if err != nil {
+			fs.log.V(3).Info("ignoring unexpected file in blob directory", "file", e.Name())
+			continue
+		}
+		if _, ok := live[dig]; ok {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return res, fmt.Errorf("failed gathering blob info: %w", err)
+		}
+		if fi.ModTime().After(threshold) {
+			continue
+		}
+
+		if !opts.DryRun {
+			fs.log.V(3).Info("removing unreferenced blob", "digest", dig)
+			if err := os.Remove(filepath.Join(blobDir, e.Name())); err != nil && !os.IsNotExist(err) {
+				return res, fmt.Errorf("failed removing blob %s: %w", dig, err)
+			}
+		}
+		res.Removed = append(res.Removed, dig)
+		res.Bytes += fi.Size()
+	}
+
+	return res, nil
+}
+
+// sweepLinks removes the repository's links to removed blobs.
+func (fs FileStorage) sweepLinks(repo string, removed map[types.Digest]struct{}) error {
+	linkDir := filepath.Join(fs.baseDir, filepath.FromSlash(repo), blobDirName)
+	entries, err := os.ReadDir(linkDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed listing blob links: %w", err)
+	}
+
+	for _, e := range entries {
+		dig, err := types.ParseDigest(e.Name())
+		if err != nil {
+			continue
+		}
+		if _, ok := removed[dig]; !ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(linkDir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing blob link: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// isInternalFile reports whether the file name denotes a directory, upload session or temp file maintained by the
+// store.
+func isInternalFile(name string) bool {
+	return strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".")
+}
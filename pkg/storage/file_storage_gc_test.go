@@ -0,0 +1,183 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+func storeTestBlob(g *WithT, store storage.FileStorage, data string) types.Digest {
+	dig, err := store.StoreBlob(types.BlobID{Namespace: "ns", Repo: "repo"}, strings.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred(), "failed storing blob")
+	return dig
+}
+
+func storeTestManifest(g *WithT, store storage.FileStorage, tag *string, data string) types.Digest {
+	dig, err := types.NewDigest(types.AlgoSHA256, strings.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(store.StoreManifest(types.ManifestID{Namespace: "ns", Repo: "repo", Tag: tag, Digest: &dig}, strings.NewReader(data), storage.References{})).
+		To(Succeed(), "failed storing manifest")
+	return dig
+}
+
+func blobExists(store storage.FileStorage, dig types.Digest) bool {
+	rc, _, err := store.FetchBlob(types.BlobID{Namespace: "ns", Repo: "repo", Digest: dig})
+	if err != nil {
+		return !errors.As(err, &storage.ErrNotFound{})
+	}
+	rc.Close()
+	return true
+}
+
+func TestGarbageCollectRemovesUnreferencedBlobs(t *testing.T) {
+	g := NewWithT(t)
+
+	// Given
+
+	store, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	config := storeTestBlob(g, store, "config")
+	layer := storeTestBlob(g, store, "layer")
+	orphan := storeTestBlob(g, store, "orphan")
+	deletedLayer := storeTestBlob(g, store, "deleted layer")
+
+	image := storeTestManifest(g, store, nil, fmt.Sprintf(
+		`{"config":{"digest":%q},"layers":[{"digest":%q}]}`, config, layer))
+	// the image is only referenced by the index.
+	g.Expect(store.DeleteManifest(types.ManifestID{Namespace: "ns", Repo: "repo", Digest: &image})).To(Succeed())
+	index := storeTestManifest(g, store, stringPtr("latest"), fmt.Sprintf(`{"manifests":[{"digest":%q}]}`, image))
+	signature := storeTestManifest(g, store, nil, fmt.Sprintf(`{"subject":{"digest":%q}}`, index))
+
+	deleted := storeTestManifest(g, store, stringPtr("old"), fmt.Sprintf(`{"layers":[{"digest":%q}]}`, deletedLayer))
+	g.Expect(store.DeleteManifest(types.ManifestID{Namespace: "ns", Repo: "repo", Tag: stringPtr("old")})).To(Succeed())
+	g.Expect(store.DeleteManifest(types.ManifestID{Namespace: "ns", Repo: "repo", Digest: &deleted})).To(Succeed())
+
+	garbage := []types.Digest{orphan, deletedLayer, deleted}
+
+	// When
+
+	res, err := store.GarbageCollect(storage.GCOptions{DryRun: true})
+
+	// Then
+
+	g.Expect(err).NotTo(HaveOccurred(), "dry run failed")
+	g.Expect(res.Removed).To(ConsistOf(garbage))
+	g.Expect(res.Bytes).To(BeNumerically(">", 0))
+	for _, dig := range garbage {
+		g.Expect(blobExists(store, dig)).To(BeTrue(), "dry run removed blob %s", dig)
+	}
+
+	// When
+
+	res, err = store.GarbageCollect(storage.GCOptions{})
+
+	// Then
+
+	g.Expect(err).NotTo(HaveOccurred(), "garbage collection failed")
+	g.Expect(res.Removed).To(ConsistOf(garbage))
+	for _, dig := range garbage {
+		g.Expect(blobExists(store, dig)).To(BeFalse(), "blob %s should have been removed", dig)
+	}
+	for _, dig := range []types.Digest{config, layer, image, index, signature} {
+		g.Expect(blobExists(store, dig)).To(BeTrue(), "blob %s should have been kept", dig)
+	}
+
+	res, err = store.GarbageCollect(storage.GCOptions{})
+	g.Expect(err).NotTo(HaveOccurred(), "second garbage collection failed")
+	g.Expect(res.Removed).To(BeEmpty())
+}
+
+func TestGarbageCollectKeepsRecentBlobs(t *testing.T) {
+	g := NewWithT(t)
+
+	storeDir := t.TempDir()
+	store, err := storage.NewFileStorage(storeDir, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	recent := storeTestBlob(g, store, "recent")
+	old := storeTestBlob(g, store, "old")
+	past := time.Now().Add(-2 * time.Hour)
+	g.Expect(os.Chtimes(filepath.Join(storeDir, "_blobs", old.String()), past, past)).To(Succeed())
+
+	res, err := store.GarbageCollect(storage.GCOptions{GracePeriod: time.Hour})
+
+	g.Expect(err).NotTo(HaveOccurred(), "garbage collection failed")
+	g.Expect(res.Removed).To(ConsistOf(old))
+	g.Expect(blobExists(store, recent)).To(BeTrue(), "recent blob should have been kept")
+}
+
+func TestGarbageCollectKeepsBlobsOfIdleSessions(t *testing.T) {
+	g := NewWithT(t)
+
+	storeDir := t.TempDir()
+	store, err := storage.NewFileStorage(storeDir, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	sid, err := store.StartSession("ns", "repo")
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = store.StoreSessionData(sid, strings.NewReader("chunk"), "")
+	g.Expect(err).NotTo(HaveOccurred())
+	// the session has been idle for longer than the grace period before it is closed.
+	past := time.Now().Add(-2 * time.Hour)
+	g.Expect(os.Chtimes(filepath.Join(storeDir, "_blobs", "_"+sid.String()), past, past)).To(Succeed())
+	dig, err := store.CloseSession(sid, types.BlobID{Namespace: "ns", Repo: "repo"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	res, err := store.GarbageCollect(storage.GCOptions{GracePeriod: time.Hour})
+
+	g.Expect(err).NotTo(HaveOccurred(), "garbage collection failed")
+	g.Expect(res.Removed).To(BeEmpty())
+	g.Expect(blobExists(store, dig)).To(BeTrue(), "blob of the closed session should have been kept")
+}
+
+func TestGarbageCollectAbortsOnUndecodableManifest(t *testing.T) {
+	g := NewWithT(t)
+
+	store, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	layer := storeTestBlob(g, store, "layer")
+	orphan := storeTestBlob(g, store, "orphan")
+	broken := storeTestManifest(g, store, stringPtr("latest"), fmt.Sprintf(`{"layers":[{"digest":%q}]`, layer))
+
+	res, err := store.GarbageCollect(storage.GCOptions{})
+
+	g.Expect(err).To(MatchError(ContainSubstring("failed decoding manifest " + broken.String())))
+	g.Expect(res.Removed).To(BeEmpty())
+	for _, dig := range []types.Digest{layer, orphan, broken} {
+		g.Expect(blobExists(store, dig)).To(BeTrue(), "blob %s should have been kept", dig)
+	}
+}
+
+func TestGarbageCollectSkipsInternalDirectories(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	store, err := storage.NewFileStorage(dir, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// other components, such as the replication queue, keep their data in internal directories of the data dir.
+	job := filepath.Join(dir, "_replication", "dr", "job.json")
+	g.Expect(os.MkdirAll(filepath.Dir(job), 0o700)).To(Succeed())
+	g.Expect(os.WriteFile(job, []byte(`{"namespace":"ns"`), 0o600)).To(Succeed())
+	storeTestManifest(g, store, stringPtr("latest"), "{}")
+
+	g.Expect(store.Repositories()).To(Equal([]string{"ns/repo"}))
+	_, err = store.GarbageCollect(storage.GCOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(job).To(BeARegularFile(), "internal files should have been kept")
+}
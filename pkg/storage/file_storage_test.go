@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	. "github.com/onsi/gomega"
@@ -100,7 +101,7 @@ func TestStoreManifestFailsWithWrongDigest(t *testing.T) {
 
 	// When
 
-	g.Expect(store.StoreManifest(mid, strings.NewReader(manifest))).
+	g.Expect(store.StoreManifest(mid, strings.NewReader(manifest), storage.References{})).
 		To(
 			MatchError(ContainSubstring("digests don't match")),
 			"storing manifest should have failed",
@@ -140,7 +141,7 @@ func TestStoreManifestWritesCorrectDataToDisk(t *testing.T) {
 
 	// When
 
-	g.Expect(store.StoreManifest(mid, strings.NewReader(manifest))).To(Succeed(), "storing manifest failed")
+	g.Expect(store.StoreManifest(mid, strings.NewReader(manifest), storage.References{})).To(Succeed(), "storing manifest failed")
 
 	// Then
 
@@ -233,7 +234,7 @@ func TestDeleteManifestWritesCorrectDataToDisk(t *testing.T) {
 
 			storeDir := t.TempDir()
 			store, _ := storage.NewFileStorage(storeDir, logr.Discard())
-			g.Expect(store.StoreManifest(tt.storeMid, strings.NewReader(manifest))).To(Succeed(), "storing manifest failed")
+			g.Expect(store.StoreManifest(tt.storeMid, strings.NewReader(manifest), storage.References{})).To(Succeed(), "storing manifest failed")
 
 			// When
 
@@ -281,7 +282,7 @@ func TestWriteManifestDoesntWriteAnythingIfDigestMissing(t *testing.T) {
 		Tag:       stringPtr("baz-tag"),
 	}
 
-	g.Expect(store.StoreManifest(mid, nil)).NotTo(Succeed(), "storing manifest should have failed")
+	g.Expect(store.StoreManifest(mid, nil, storage.References{})).NotTo(Succeed(), "storing manifest should have failed")
 
 	g.Expect(filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if !d.IsDir() {
@@ -290,3 +291,118 @@ func TestWriteManifestDoesntWriteAnythingIfDigestMissing(t *testing.T) {
 		return nil
 	})).To(Succeed())
 }
+
+func TestCloseSessionDiscardsDataOnDigestMismatch(t *testing.T) {
+	g := NewWithT(t)
+
+	// Given
+
+	storeDir := t.TempDir()
+	store, _ := storage.NewFileStorage(storeDir, logr.Discard())
+
+	sid, err := store.StartSession("foo-ns", "bar-repo")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	_, err = store.StoreSessionData(sid, strings.NewReader("some data"), "")
+	g.Expect(err).NotTo(HaveOccurred(), "storing session data failed")
+
+	bid := types.BlobID{
+		Namespace: "foo-ns",
+		Repo:      "bar-repo",
+		Digest: types.Digest{
+			Algo: string(types.AlgoSHA256),
+			Enc:  "7a38bf81f383f69433ad6e900d35b3e2385593f76a7b7ab5d4355b8ba41ee24b",
+		},
+	}
+
+	// When
+
+	_, err = store.CloseSession(sid, bid)
+
+	// Then
+
+	g.Expect(err).To(matchers.BeAssignableToError(storage.ErrDigestMismatch{}))
+
+	_, err = store.GetSessionInfo(sid)
+	g.Expect(err).To(matchers.BeAssignableToError(storage.ErrSessionNotFound{}))
+
+	g.Expect(filepath.WalkDir(storeDir, func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			return fmt.Errorf("unexpected non-dir encountered: %s", path)
+		}
+		return nil
+	})).To(Succeed())
+}
+
+func TestExpireSessionsRemovesInactiveSessions(t *testing.T) {
+	g := NewWithT(t)
+
+	// Given
+
+	storeDir := t.TempDir()
+	store, _ := storage.NewFileStorage(storeDir, logr.Discard())
+
+	start := time.Now()
+	inactive, err := store.StartSession("ns", "repo")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	_, err = store.StoreSessionData(inactive, strings.NewReader("some data"), "")
+	g.Expect(err).NotTo(HaveOccurred(), "storing session data failed")
+
+	info, err := store.GetSessionInfo(inactive)
+	g.Expect(err).NotTo(HaveOccurred(), "retrieving session info failed")
+	g.Expect(info.Size).To(Equal(int64(9)))
+	g.Expect(info.Namespace).To(Equal("ns"))
+	g.Expect(info.Repo).To(Equal("repo"))
+	g.Expect(info.Created).To(BeTemporally("~", start, time.Second))
+	g.Expect(info.LastActivity).To(BeTemporally(">=", info.Created))
+
+	past := start.Add(-2 * time.Hour)
+	g.Expect(os.Chtimes(filepath.Join(storeDir, "_blobs", "_"+inactive.String()), past, past)).To(Succeed())
+
+	active, err := store.StartSession("ns", "repo")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+
+	// When
+
+	n, err := store.ExpireSessions(start.Add(-time.Hour))
+
+	// Then
+
+	g.Expect(err).NotTo(HaveOccurred(), "expiring sessions failed")
+	g.Expect(n).To(Equal(1))
+
+	_, err = store.GetSessionInfo(inactive)
+	g.Expect(errors.As(err, &storage.ErrSessionNotFound{})).To(BeTrue(), "unexpected error: %v", err)
+	_, err = os.Stat(filepath.Join(storeDir, "_blobs", "_"+inactive.String()+".info"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue(), "session metadata should have been removed")
+
+	_, err = store.GetSessionInfo(active)
+	g.Expect(err).NotTo(HaveOccurred(), "active session should have been kept")
+}
+
+func TestCancelSessionRemovesSessionData(t *testing.T) {
+	g := NewWithT(t)
+
+	// Given
+
+	storeDir := t.TempDir()
+	store, _ := storage.NewFileStorage(storeDir, logr.Discard())
+
+	sid, err := store.StartSession("ns", "repo")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	_, err = store.StoreSessionData(sid, strings.NewReader("some data"), "")
+	g.Expect(err).NotTo(HaveOccurred(), "storing session data failed")
+
+	// When
+
+	err = store.CancelSession(sid)
+
+	// Then
+
+	g.Expect(err).NotTo(HaveOccurred(), "cancelling session failed")
+	entries, err := os.ReadDir(filepath.Join(storeDir, "_blobs"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entries).To(BeEmpty(), "session files should have been removed")
+
+	err = store.CancelSession(sid)
+	g.Expect(errors.As(err, &storage.ErrSessionNotFound{})).To(BeTrue(), "unexpected error: %v", err)
+}
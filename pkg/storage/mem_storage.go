@@ -5,47 +5,266 @@ package storage
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"fmt"
 	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/makkes/garage/pkg/types"
 )
 
+// MemStorage keeps all data in memory. It is meant for ephemeral registries, e.g. in tests, and loses all data when
+// the process exits. Like FileStorage, it stores the content of each blob only once and links it into every
+// repository that it has been pushed to or mounted into. All methods are safe for concurrent use.
 type MemStorage struct {
-	manifests map[[sha256.Size]byte]types.Digest
-	blobs     map[types.BlobID][]byte
+	mu       *sync.RWMutex
+	crRE     *regexp.Regexp
+	blobs    map[types.Digest][]byte
+	repos    map[string]*memRepo
+	sessions map[uuid.UUID]*memSession
+}
+
+// memRepo holds the links of a single repository.
+type memRepo struct {
+	blobs     map[types.Digest]struct{}
+	manifests map[types.Digest]struct{}
+	// tags is nil until the first tag has been pushed to the repository.
+	tags      map[string]types.Digest
+	referrers map[types.Digest]map[types.Digest]types.Descriptor
+}
+
+type memSession struct {
+	info SessionInfo
+	data []byte
 }
 
 var _ Storage = MemStorage{}
 
 func NewMemStorage() MemStorage {
 	return MemStorage{
-		manifests: make(map[[sha256.Size]byte]types.Digest),
-		blobs:     make(map[types.BlobID][]byte),
+		mu:       &sync.RWMutex{},
+		crRE:     regexp.MustCompile(contentRangeRegex),
+		blobs:    make(map[types.Digest][]byte),
+		repos:    make(map[string]*memRepo),
+		sessions: make(map[uuid.UUID]*memSession),
+	}
+}
+
+// repo returns the repository identified by ns and repo or nil if it doesn't exist. The caller needs to hold the lock.
+func (m MemStorage) repo(ns, repo string) *memRepo {
+	return m.repos[ns+"/"+repo]
+}
+
+// ensureRepo returns the repository identified by ns and repo, creating it if it doesn't exist. The caller needs to
+// hold the write lock.
+func (m MemStorage) ensureRepo(ns, repo string) *memRepo {
+	r := m.repos[ns+"/"+repo]
+	if r == nil {
+		r = &memRepo{
+			blobs:     make(map[types.Digest]struct{}),
+			manifests: make(map[types.Digest]struct{}),
+			referrers: make(map[types.Digest]map[types.Digest]types.Descriptor),
+		}
+		m.repos[ns+"/"+repo] = r
 	}
+	return r
 }
 
 func (m MemStorage) Tags(ns, repo string) ([]string, error) {
-	return nil, fmt.Errorf("not implemented")
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.repo(ns, repo)
+	if r == nil || r.tags == nil {
+		return nil, ErrNotFound{Err: fmt.Errorf("no tags in %s/%s", ns, repo)}
+	}
+
+	res := make([]string, 0, len(r.tags))
+	for tag := range r.tags {
+		res = append(res, tag)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (m MemStorage) Repositories() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make([]string, 0, len(m.repos))
+	for name := range m.repos {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (m MemStorage) StoreReferrer(ns, repo string, subject types.Digest, desc types.Descriptor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subject = cloneDigest(subject)
+	desc.MediaType = strings.Clone(desc.MediaType)
+	desc.Digest = cloneDigest(desc.Digest)
+	desc.ArtifactType = strings.Clone(desc.ArtifactType)
+
+	r := m.ensureRepo(ns, repo)
+	if r.referrers[subject] == nil {
+		r.referrers[subject] = make(map[types.Digest]types.Descriptor)
+	}
+	r.referrers[subject][desc.Digest] = desc
+
+	return nil
+}
+
+func (m MemStorage) Referrers(ns, repo string, subject types.Digest) ([]types.Descriptor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.repo(ns, repo)
+	if r == nil {
+		return []types.Descriptor{}, nil
+	}
+
+	res := make([]types.Descriptor, 0, len(r.referrers[subject]))
+	for _, desc := range r.referrers[subject] {
+		// the referring manifest might have been deleted in the meantime.
+		if _, ok := r.manifests[desc.Digest]; ok {
+			res = append(res, desc)
+		}
+	}
+
+	return res, nil
+}
+
+func (m MemStorage) StartSession(ns, repo string) (uuid.UUID, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed generating session ID: %w", err)
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[id] = &memSession{
+		info: SessionInfo{
+			Namespace:    strings.Clone(ns),
+			Repo:         strings.Clone(repo),
+			Created:      now,
+			LastActivity: now,
+		},
+	}
+
+	return id, nil
 }
 
-func (m MemStorage) StartSession() (uuid.UUID, error) {
-	return uuid.UUID{}, fmt.Errorf("not implemented")
+func (m MemStorage) GetSessionInfo(id uuid.UUID) (SessionInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return SessionInfo{}, ErrSessionNotFound{Err: fmt.Errorf("no session %s", id)}
+	}
+
+	info := s.info
+	info.Size = int64(len(s.data))
+
+	return info, nil
 }
 
-func (m MemStorage) GetSessionInfo(_ uuid.UUID) (int64, error) {
-	panic("not implemented")
+func (m MemStorage) StoreSessionData(id uuid.UUID, in io.Reader, cr string) (int64, error) {
+	crs, cre, err := parseRange(m.crRE, cr)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing content-range: %w", err)
+	}
+
+	// the data is read before acquiring the lock so that slow clients don't block other requests.
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading session data: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return 0, ErrSessionNotFound{Err: fmt.Errorf("no session %s", id)}
+	}
+
+	size := int64(len(s.data))
+	if crs >= 0 && cre > 0 && crs != size {
+		return 0, ErrOutOfOrderChunk{
+			expected: size,
+			actual:   crs,
+		}
+	}
+
+	s.data = append(s.data, b...)
+	s.info.LastActivity = time.Now()
+
+	return int64(len(s.data)) - 1, nil
 }
 
-func (m MemStorage) StoreSessionData(_ uuid.UUID, _ io.Reader, _ string) (int64, error) {
-	panic("not implemented") // TODO: Implement
+func (m MemStorage) CloseSession(id uuid.UUID, bid types.BlobID) (types.Digest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return types.Digest{}, ErrSessionNotFound{Err: fmt.Errorf("no session %s", id)}
+	}
+
+	dig, err := m.storeBlob(bid, s.data)
+	if err != nil {
+		if _, ok := err.(ErrDigestMismatch); ok {
+			// the uploaded data is useless so we discard the whole session.
+			delete(m.sessions, id)
+		}
+		return types.Digest{}, err
+	}
+
+	delete(m.sessions, id)
+
+	return dig, nil
+}
+
+func (m MemStorage) CancelSession(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[id]; !ok {
+		return ErrSessionNotFound{Err: fmt.Errorf("no session %s", id)}
+	}
+	delete(m.sessions, id)
+
+	return nil
 }
 
-func (m MemStorage) CloseSession(_ uuid.UUID, bid types.BlobID) (types.Digest, error) {
-	panic("not implemented") // TODO: Implement
+// ExpireSessions removes all sessions that haven't received any data since before.
+func (m MemStorage) ExpireSessions(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, s := range m.sessions {
+		if s.info.LastActivity.Before(before) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+
+	return n, nil
 }
 
 func (m MemStorage) StoreBlob(bid types.BlobID, data io.Reader) (types.Digest, error) {
@@ -53,21 +272,93 @@ func (m MemStorage) StoreBlob(bid types.BlobID, data io.Reader) (types.Digest, e
 	if err != nil {
 		return types.Digest{}, fmt.Errorf("failed reading data to store: %w", err)
 	}
-	m.blobs[bid] = b
 
-	return types.NewDigest(types.AlgoSHA256, bytes.NewReader(b))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.storeBlob(bid, b)
+}
+
+// storeBlob verifies the digest of b, stores it and links it into the repository identified by bid. The caller needs
+// to hold the write lock.
+func (m MemStorage) storeBlob(bid types.BlobID, b []byte) (types.Digest, error) {
+	dig, err := types.NewDigest(digestAlgo(bid.Digest), bytes.NewReader(b))
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed calculating content digest: %w", err)
+	}
+
+	if bid.Digest != (types.Digest{}) && bid.Digest != dig {
+		return types.Digest{}, ErrDigestMismatch{Expected: bid.Digest, Actual: dig}
+	}
+
+	dig = cloneDigest(dig)
+	m.blobs[dig] = b
+	m.ensureRepo(bid.Namespace, bid.Repo).blobs[dig] = struct{}{}
+
+	return dig, nil
+}
+
+func (m MemStorage) FetchBlob(bid types.BlobID) (io.ReadSeekCloser, BlobStat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dat, err := m.linkedBlob(bid)
+	if err != nil {
+		return nil, BlobStat{}, err
+	}
+
+	return nopSeekCloser{bytes.NewReader(dat)}, BlobStat{Size: int64(len(dat))}, nil
 }
 
-func (m MemStorage) FetchBlob(dig types.BlobID) (io.ReadCloser, BlobStat, error) {
-	dat, ok := m.blobs[dig]
+func (m MemStorage) HasBlob(bid types.BlobID) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.hasBlob(bid)
+}
+
+// hasBlob reports whether the blob is linked into the repository identified by bid. The caller needs to hold the lock.
+func (m MemStorage) hasBlob(bid types.BlobID) (bool, error) {
+	r := m.repo(bid.Namespace, bid.Repo)
+	if r == nil {
+		return false, nil
+	}
+	_, ok := r.blobs[bid.Digest]
+	return ok, nil
+}
+
+// linkedBlob returns the content of the blob if it is linked into the repository identified by bid. The caller needs to
+// hold the lock.
+func (m MemStorage) linkedBlob(bid types.BlobID) ([]byte, error) {
+	r := m.repo(bid.Namespace, bid.Repo)
+	if r == nil {
+		return nil, ErrNotFound{Err: fmt.Errorf("blob with digest %s not found in %s/%s", bid.Digest, bid.Namespace, bid.Repo)}
+	}
+	if _, ok := r.blobs[bid.Digest]; !ok {
+		return nil, ErrNotFound{Err: fmt.Errorf("blob with digest %s not found in %s/%s", bid.Digest, bid.Namespace, bid.Repo)}
+	}
+
+	dat, ok := m.blobs[bid.Digest]
 	if !ok {
-		return nil, BlobStat{}, ErrNotFound{Err: fmt.Errorf("blob with digest %s not found", dig)}
+		return nil, fmt.Errorf("content of blob %s is missing", bid.Digest)
 	}
 
-	return io.NopCloser(bytes.NewReader(dat)), BlobStat{Size: int64(len(dat))}, nil
+	return dat, nil
 }
 
-func (m MemStorage) StoreManifest(id types.ManifestID, data io.Reader) error {
+func (m MemStorage) MountBlob(bid types.BlobID, fromNs, fromRepo string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.linkedBlob(types.BlobID{Namespace: fromNs, Repo: fromRepo, Digest: bid.Digest}); err != nil {
+		return err
+	}
+	m.ensureRepo(bid.Namespace, bid.Repo).blobs[cloneDigest(bid.Digest)] = struct{}{}
+
+	return nil
+}
+
+func (m MemStorage) StoreManifest(id types.ManifestID, data io.Reader, refs References) error {
 	if id.Digest == nil {
 		return fmt.Errorf("can't store manifest without digest")
 	}
@@ -77,75 +368,144 @@ func (m MemStorage) StoreManifest(id types.ManifestID, data io.Reader) error {
 		return fmt.Errorf("failed reading input data: %w", err)
 	}
 
-	m.blobs[types.BlobID{
-		Namespace: id.Namespace,
-		Repo:      id.Repo,
-		Digest:    *id.Digest,
-	}] = blob
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	dig := id.Digest
-
-	m.manifests[hash(id)] = *dig
+	missing, err := missingReferences(id.Namespace, id.Repo, refs, m.hasBlob, m.has)
+	if err != nil {
+		return fmt.Errorf("failed checking manifest references: %w", err)
+	}
+	if len(missing) > 0 {
+		return ErrReferencesUnknown{Digests: missing}
+	}
 
-	id.Digest = nil
-	m.manifests[hash(id)] = *dig
+	dig, err := m.storeBlob(types.BlobID{Namespace: id.Namespace, Repo: id.Repo, Digest: *id.Digest}, blob)
+	if err != nil {
+		return fmt.Errorf("failed storing manifest blob: %w", err)
+	}
 
-	id.Digest = dig
-	id.Tag = nil
-	m.manifests[hash(id)] = *dig
+	r := m.ensureRepo(id.Namespace, id.Repo)
+	r.manifests[dig] = struct{}{}
+	if id.Tag != nil {
+		if r.tags == nil {
+			r.tags = make(map[string]types.Digest)
+		}
+		r.tags[strings.Clone(*id.Tag)] = dig
+	}
 
 	return nil
 }
 
-func (m MemStorage) DeleteManifest(_ types.ManifestID) error {
-	panic("not implemented") // TODO: Implement
+func (m MemStorage) DeleteManifest(id types.ManifestID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.repo(id.Namespace, id.Repo)
+	switch {
+	case id.Tag != nil:
+		if r == nil || r.tags == nil {
+			return ErrNotFound{Err: fmt.Errorf("tag %s not found", *id.Tag)}
+		}
+		if _, ok := r.tags[*id.Tag]; !ok {
+			return ErrNotFound{Err: fmt.Errorf("tag %s not found", *id.Tag)}
+		}
+		delete(r.tags, *id.Tag)
+	case id.Digest != nil:
+		if r == nil {
+			return ErrNotFound{Err: fmt.Errorf("manifest %s not found", id.Digest)}
+		}
+		if _, ok := r.manifests[*id.Digest]; !ok {
+			return ErrNotFound{Err: fmt.Errorf("manifest %s not found", id.Digest)}
+		}
+		delete(r.manifests, *id.Digest)
+	default:
+		return fmt.Errorf("neither tag nor digest set for manifest")
+	}
+
+	return nil
 }
 
-func (m MemStorage) DeleteBlob(_ types.BlobID) error {
-	panic("not implemented") // TODO: Implement
+func (m MemStorage) DeleteBlob(bid types.BlobID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.repo(bid.Namespace, bid.Repo)
+	if r == nil {
+		return ErrNotFound{Err: fmt.Errorf("blob with digest %s not found", bid.Digest)}
+	}
+	if _, ok := r.blobs[bid.Digest]; !ok {
+		return ErrNotFound{Err: fmt.Errorf("blob with digest %s not found", bid.Digest)}
+	}
+	delete(r.blobs, bid.Digest)
+
+	return nil
 }
 
 func (m MemStorage) FetchManifest(id types.ManifestID) (io.ReadCloser, error) {
-	var dig types.Digest
-	if id.Digest != nil {
-		dig = *id.Digest
-	} else {
-		var ok bool
-		dig, ok = m.manifests[hash(id)]
-		if !ok {
-			return nil, fmt.Errorf("manifest not found")
-		}
-	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	rawMf, ok := m.blobs[types.BlobID{
-		Namespace: id.Namespace,
-		Repo:      id.Repo,
-		Digest:    dig,
-	}]
+	dig, ok := m.resolve(id)
 	if !ok {
-		return nil, fmt.Errorf("manifest not found")
+		return nil, ErrNotFound{Err: fmt.Errorf("manifest %s not found in %s/%s", id.Ref(), id.Namespace, id.Repo)}
 	}
 
-	return io.NopCloser(bytes.NewReader(rawMf)), nil
+	dat, err := m.linkedBlob(types.BlobID{Namespace: id.Namespace, Repo: id.Repo, Digest: dig})
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(dat)), nil
 }
 
 func (m MemStorage) Has(id types.ManifestID) (bool, error) {
-	_, ok := m.manifests[hash(id)]
-	return ok, nil
+	if id.Tag == nil && id.Digest == nil {
+		return false, fmt.Errorf("neither tag nor digest set for manifest")
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.has(id)
 }
 
-func hash(m types.ManifestID) [sha256.Size]byte {
-	var buf bytes.Buffer
+// has reports whether the manifest identified by id is stored. The caller needs to hold the lock.
+func (m MemStorage) has(id types.ManifestID) (bool, error) {
+	_, ok := m.resolve(id)
+	return ok, nil
+}
 
-	buf.WriteString(m.Namespace)
-	buf.WriteString(m.Repo)
+// resolve returns the digest of the manifest identified by its tag or, if the tag isn't set, by its digest. The caller
+// needs to hold the lock.
+func (m MemStorage) resolve(id types.ManifestID) (types.Digest, bool) {
+	r := m.repo(id.Namespace, id.Repo)
+	if r == nil {
+		return types.Digest{}, false
+	}
 
-	if m.Tag != nil {
-		buf.WriteString(*m.Tag)
-	} else if m.Digest != nil {
-		buf.WriteString(m.Digest.Algo)
-		buf.WriteString(m.Digest.Enc)
+	if id.Tag != nil {
+		dig, ok := r.tags[*id.Tag]
+		return dig, ok
 	}
+	if id.Digest != nil {
+		_, ok := r.manifests[*id.Digest]
+		return *id.Digest, ok
+	}
+
+	return types.Digest{}, false
+}
+
+// nopSeekCloser turns an io.ReadSeeker into an io.ReadSeekCloser with a no-op Close method.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
 
-	return sha256.Sum256(buf.Bytes())
+// cloneDigest returns a copy of dig that doesn't share memory with the caller. Strings passed in by the HTTP server may
+// point into buffers that are reused for subsequent requests and must not be retained.
+func cloneDigest(dig types.Digest) types.Digest {
+	return types.Digest{Algo: strings.Clone(dig.Algo), Enc: strings.Clone(dig.Enc)}
 }
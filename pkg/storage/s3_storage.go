@@ -0,0 +1,837 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/makkes/garage/pkg/types"
+)
+
+const (
+	uploadDirName = "_uploads"
+	// S3MinPartSize is the minimum size of all but the last part of a multipart upload supported by AWS S3.
+	S3MinPartSize = 5 * 1024 * 1024
+	// s3MaxCopySize is the maximum size of an object that can be copied in a single operation.
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+)
+
+// S3Options configures the connection of an S3Storage to an S3-compatible object store.
+type S3Options struct {
+	// Endpoint is the host and optional port of the S3 API, e.g. "s3.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to all object keys so that several registries can share a bucket.
+	Prefix string
+	// PathStyle puts the bucket name into the URL path instead of the host name as required by many S3-compatible
+	// stores.
+	PathStyle bool
+	// Insecure talks to the endpoint using plain HTTP.
+	Insecure bool
+	// AccessKey and SecretKey are static credentials. If they're empty, credentials are taken from the AWS_* and
+	// MINIO_* environment variables, the AWS credentials file or the instance metadata service.
+	AccessKey, SecretKey string
+	// PartSize is the size of the parts that upload sessions are stored in. It defaults to and must not be smaller
+	// than S3MinPartSize.
+	PartSize int64
+	// Transport is used for all requests to the endpoint, e.g. for trusting a custom CA. It defaults to the transport
+	// of the S3 client.
+	Transport http.RoundTripper
+	// minPartSize overrides S3MinPartSize so that tests can use tiny parts.
+	minPartSize int64
+}
+
+// S3Storage stores all data in a bucket of an S3-compatible object store using the same layout as FileStorage, i.e.
+// blobs are stored once under '_blobs' and linked into repositories by empty objects. This allows running several
+// stateless registry instances against the same bucket.
+//
+// Upload sessions are stored as multipart uploads. Chunks are buffered in a pending object until enough data has been
+// uploaded to fill a part.
+type S3Storage struct {
+	client   minio.Core
+	bucket   string
+	prefix   string
+	partSize int64
+	log      logr.Logger
+	crRE     *regexp.Regexp
+}
+
+var _ Storage = S3Storage{}
+
+func NewS3Storage(opts S3Options, log logr.Logger) (S3Storage, error) {
+	if opts.Bucket == "" {
+		return S3Storage{}, fmt.Errorf("bucket must not be empty")
+	}
+	if opts.minPartSize == 0 {
+		opts.minPartSize = S3MinPartSize
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = opts.minPartSize
+	}
+	if opts.PartSize < opts.minPartSize {
+		return S3Storage{}, fmt.Errorf("part size must be at least %d bytes", opts.minPartSize)
+	}
+
+	creds := credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, "")
+	if opts.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if opts.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.NewCore(opts.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !opts.Insecure,
+		Region:       opts.Region,
+		BucketLookup: lookup,
+		Transport:    opts.Transport,
+	})
+	if err != nil {
+		return S3Storage{}, fmt.Errorf("failed creating S3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(context.Background(), opts.Bucket)
+	if err != nil {
+		return S3Storage{}, fmt.Errorf("failed checking bucket: %w", err)
+	}
+	if !exists {
+		return S3Storage{}, fmt.Errorf("bucket %q doesn't exist", opts.Bucket)
+	}
+
+	return S3Storage{
+		client:   *client,
+		bucket:   opts.Bucket,
+		prefix:   strings.Trim(opts.Prefix, "/"),
+		partSize: opts.PartSize,
+		log:      log,
+		crRE:     regexp.MustCompile(contentRangeRegex),
+	}, nil
+}
+
+// key returns the object key for the given path elements.
+func (s S3Storage) key(elem ...string) string {
+	return path.Join(append([]string{s.prefix}, elem...)...)
+}
+
+func (s S3Storage) blobKey(dig types.Digest) string {
+	return s.key(blobDirName, dig.String())
+}
+
+func (s S3Storage) blobLinkKey(bid types.BlobID) string {
+	return s.key(bid.Namespace, bid.Repo, blobDirName, bid.Digest.String())
+}
+
+func (s S3Storage) manifestKey(mid types.ManifestID) (string, error) {
+	switch {
+	case mid.Tag != nil:
+		return s.key(mid.Namespace, mid.Repo, tagDirName, *mid.Tag), nil
+	case mid.Digest != nil:
+		return s.key(mid.Namespace, mid.Repo, mid.Digest.String()), nil
+	default:
+		return "", fmt.Errorf("neither tag nor digest set for manifest")
+	}
+}
+
+func (s S3Storage) sessionKey(id uuid.UUID, name string) string {
+	return s.key(uploadDirName, id.String(), name)
+}
+
+// isNoSuchKey reports whether err has been returned for an object that doesn't exist.
+func isNoSuchKey(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s S3Storage) put(key string, data []byte) error {
+	_, err := s.client.Client.PutObject(context.Background(), s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{})
+	return err
+}
+
+// get returns the content of the object, returning ErrNotFound if it doesn't exist.
+func (s S3Storage) get(key string) ([]byte, error) {
+	obj, err := s.client.Client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, ErrNotFound{Err: fmt.Errorf("object %s doesn't exist", key)}
+		}
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s S3Storage) exists(key string) (bool, error) {
+	_, err := s.client.Client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// remove removes the object, returning ErrNotFound if it doesn't exist.
+func (s S3Storage) remove(key string) error {
+	exists, err := s.exists(key)
+	if err != nil {
+		return fmt.Errorf("failed checking object: %w", err)
+	}
+	if !exists {
+		return ErrNotFound{Err: fmt.Errorf("object %s doesn't exist", key)}
+	}
+
+	return s.client.Client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// list returns the keys of all objects starting with prefix.
+func (s S3Storage) list(prefix string) ([]string, error) {
+	objs, err := s.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(objs))
+	for idx, obj := range objs {
+		res[idx] = obj.Key
+	}
+	return res, nil
+}
+
+// listObjects returns the info of all objects starting with prefix.
+func (s S3Storage) listObjects(prefix string) ([]minio.ObjectInfo, error) {
+	var res []minio.ObjectInfo
+	for obj := range s.client.Client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		res = append(res, obj)
+	}
+	return res, nil
+}
+
+func (s S3Storage) Tags(ns, repo string) ([]string, error) {
+	p := s.key(ns, repo, tagDirName) + "/"
+	keys, err := s.list(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing tags: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound{Err: fmt.Errorf("no tags in %s/%s", ns, repo)}
+	}
+
+	res := make([]string, len(keys))
+	for idx, k := range keys {
+		res[idx] = strings.TrimPrefix(k, p)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Repositories returns the sorted names of all repositories in the bucket. A repository is identified by the '_blobs',
+// '_tags' and '_referrers' elements in the keys of its objects.
+func (s S3Storage) Repositories() ([]string, error) {
+	p := ""
+	if s.prefix != "" {
+		p = s.prefix + "/"
+	}
+	keys, err := s.list(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing objects: %w", err)
+	}
+
+	repos := make(map[string]struct{})
+	for _, k := range keys {
+		elems := strings.Split(strings.TrimPrefix(k, p), "/")
+		for idx, e := range elems {
+			if !strings.HasPrefix(e, "_") {
+				continue
+			}
+			if idx >= 2 && (e == blobDirName || e == tagDirName || e == referrerDirName) {
+				repos[strings.Join(elems[:idx], "/")] = struct{}{}
+			}
+			break
+		}
+	}
+
+	res := make([]string, 0, len(repos))
+	for repo := range repos {
+		res = append(res, repo)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (s S3Storage) StoreReferrer(ns, repo string, subject types.Digest, desc types.Descriptor) error {
+	b, err := json.Marshal(desc)
+	if err != nil {
+		return fmt.Errorf("failed encoding descriptor: %w", err)
+	}
+
+	if err := s.put(s.key(ns, repo, referrerDirName, subject.String(), desc.Digest.String()), b); err != nil {
+		return fmt.Errorf("failed writing referrer object: %w", err)
+	}
+
+	return nil
+}
+
+func (s S3Storage) Referrers(ns, repo string, subject types.Digest) ([]types.Descriptor, error) {
+	keys, err := s.list(s.key(ns, repo, referrerDirName, subject.String()) + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed listing referrers: %w", err)
+	}
+
+	res := make([]types.Descriptor, 0, len(keys))
+	for _, k := range keys {
+		b, err := s.get(k)
+		if err != nil {
+			if errors.As(err, &ErrNotFound{}) {
+				continue
+			}
+			return nil, fmt.Errorf("failed reading referrer object: %w", err)
+		}
+
+		var desc types.Descriptor
+		if err := json.Unmarshal(b, &desc); err != nil {
+			return nil, fmt.Errorf("failed decoding referrer object %q: %w", k, err)
+		}
+
+		// the referring manifest might have been deleted in the meantime.
+		has, err := s.Has(types.ManifestID{Namespace: ns, Repo: repo, Digest: &desc.Digest})
+		if err != nil {
+			return nil, fmt.Errorf("failed checking referring manifest: %w", err)
+		}
+		if has {
+			res = append(res, desc)
+		}
+	}
+
+	return res, nil
+}
+
+func (s S3Storage) StoreBlob(bid types.BlobID, data io.Reader) (types.Digest, error) {
+	tmpKey := s.key(uploadDirName, "_"+uuid.NewString())
+
+	digester, err := types.NewDigester(digestAlgo(bid.Digest))
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed creating digester: %w", err)
+	}
+
+	// the data is uploaded to a temporary object first because its digest is only known after reading it entirely.
+	if _, err := s.client.Client.PutObject(context.Background(), s.bucket, tmpKey, io.TeeReader(data, digester), -1,
+		minio.PutObjectOptions{PartSize: uint64(max(s.partSize, S3MinPartSize))}); err != nil {
+		return types.Digest{}, fmt.Errorf("failed uploading blob data: %w", err)
+	}
+	defer s.removeQuietly(tmpKey)
+
+	dig := digester.Digest()
+	if bid.Digest != (types.Digest{}) && bid.Digest != dig {
+		return types.Digest{}, ErrDigestMismatch{Expected: bid.Digest, Actual: dig}
+	}
+
+	if err := s.commitBlob(tmpKey, bid, dig); err != nil {
+		return types.Digest{}, err
+	}
+
+	return dig, nil
+}
+
+// digest calculates the digest of the object's content.
+func (s S3Storage) digest(key string, algo types.SupportedAlgos) (types.Digest, error) {
+	obj, err := s.client.Client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed opening object for digesting: %w", err)
+	}
+	defer obj.Close()
+
+	dig, err := types.NewDigest(algo, obj)
+	if err != nil {
+		return types.Digest{}, fmt.Errorf("failed calculating content digest: %w", err)
+	}
+
+	return dig, nil
+}
+
+// commitBlob copies the object with the key src to the blob with the digest dig and links it into the repository
+// identified by bid.
+func (s S3Storage) commitBlob(src string, bid types.BlobID, dig types.Digest) error {
+	info, err := s.client.Client.StatObject(context.Background(), s.bucket, src, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed gathering blob info: %w", err)
+	}
+
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: s.blobKey(dig)}
+	srcOpts := minio.CopySrcOptions{Bucket: s.bucket, Object: src}
+	// a single copy operation is limited in size so larger blobs are copied in parts.
+	if info.Size > s3MaxCopySize {
+		_, err = s.client.Client.ComposeObject(context.Background(), dst, srcOpts)
+	} else {
+		_, err = s.client.Client.CopyObject(context.Background(), dst, srcOpts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed creating final blob object: %w", err)
+	}
+
+	bid.Digest = dig
+	if err := s.put(s.blobLinkKey(bid), nil); err != nil {
+		return fmt.Errorf("failed creating blob link: %w", err)
+	}
+
+	return nil
+}
+
+func (s S3Storage) FetchBlob(bid types.BlobID) (io.ReadSeekCloser, BlobStat, error) {
+	linked, err := s.exists(s.blobLinkKey(bid))
+	if err != nil {
+		return nil, BlobStat{}, fmt.Errorf("failed checking blob link: %w", err)
+	}
+	if !linked {
+		return nil, BlobStat{}, ErrNotFound{Err: fmt.Errorf("blob %s not found in %s/%s", bid.Digest, bid.Namespace, bid.Repo)}
+	}
+
+	obj, err := s.client.Client.GetObject(context.Background(), s.bucket, s.blobKey(bid.Digest), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobStat{}, fmt.Errorf("failed opening blob object: %w", err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, BlobStat{}, fmt.Errorf("failed gathering blob info: %w", err)
+	}
+
+	return obj, BlobStat{Size: info.Size}, nil
+}
+
+func (s S3Storage) HasBlob(bid types.BlobID) (bool, error) {
+	linked, err := s.exists(s.blobLinkKey(bid))
+	if err != nil {
+		return false, fmt.Errorf("failed checking blob link: %w", err)
+	}
+	return linked, nil
+}
+
+func (s S3Storage) MountBlob(bid types.BlobID, fromNs, fromRepo string) error {
+	for _, k := range []string{
+		s.blobLinkKey(types.BlobID{Namespace: fromNs, Repo: fromRepo, Digest: bid.Digest}),
+		s.blobKey(bid.Digest),
+	} {
+		exists, err := s.exists(k)
+		if err != nil {
+			return fmt.Errorf("failed checking source blob: %w", err)
+		}
+		if !exists {
+			return ErrNotFound{Err: fmt.Errorf("blob %s not found in %s/%s", bid.Digest, fromNs, fromRepo)}
+		}
+	}
+
+	if err := s.put(s.blobLinkKey(bid), nil); err != nil {
+		return fmt.Errorf("failed creating blob link: %w", err)
+	}
+
+	return nil
+}
+
+func (s S3Storage) DeleteBlob(bid types.BlobID) error {
+	return s.remove(s.blobLinkKey(bid))
+}
+
+func (s S3Storage) StoreManifest(mid types.ManifestID, data io.Reader, refs References) error {
+	if mid.Digest == nil {
+		return fmt.Errorf("digest cannot be nil when storing manifest")
+	}
+
+	missing, err := missingReferences(mid.Namespace, mid.Repo, refs, s.HasBlob, s.Has)
+	if err != nil {
+		return fmt.Errorf("failed checking manifest references: %w", err)
+	}
+	if len(missing) > 0 {
+		return ErrReferencesUnknown{Digests: missing}
+	}
+
+	if _, err := s.StoreBlob(types.BlobID{Namespace: mid.Namespace, Repo: mid.Repo, Digest: *mid.Digest}, data); err != nil {
+		return fmt.Errorf("failed storing manifest blob: %w", err)
+	}
+
+	link := []byte(mid.Digest.String())
+	if err := s.put(s.key(mid.Namespace, mid.Repo, mid.Digest.String()), link); err != nil {
+		return fmt.Errorf("failed creating digest manifest link: %w", err)
+	}
+	if mid.Tag != nil {
+		if err := s.put(s.key(mid.Namespace, mid.Repo, tagDirName, *mid.Tag), link); err != nil {
+			return fmt.Errorf("failed creating tag manifest link: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s S3Storage) FetchManifest(mid types.ManifestID) (io.ReadCloser, error) {
+	k, err := s.manifestKey(mid)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := s.get(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading manifest link: %w", err)
+	}
+
+	dig, err := types.ParseDigest(string(link))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing digest: %w", err)
+	}
+
+	b, _, err := s.FetchBlob(types.BlobID{Namespace: mid.Namespace, Repo: mid.Repo, Digest: dig})
+	return b, err
+}
+
+func (s S3Storage) Has(mid types.ManifestID) (bool, error) {
+	k, err := s.manifestKey(mid)
+	if err != nil {
+		return false, err
+	}
+
+	return s.exists(k)
+}
+
+func (s S3Storage) DeleteManifest(mid types.ManifestID) error {
+	k, err := s.manifestKey(mid)
+	if err != nil {
+		return err
+	}
+
+	return s.remove(k)
+}
+
+// s3Session is the metadata of an upload session.
+type s3Session struct {
+	Namespace    string    `json:"namespace"`
+	Repo         string    `json:"repo"`
+	Created      time.Time `json:"created"`
+	LastActivity time.Time `json:"lastActivity"`
+	UploadID     string    `json:"uploadID"`
+	Parts        []s3Part  `json:"parts"`
+	// Size is the number of bytes uploaded to the session and Pending the number of those that haven't been uploaded
+	// as a part, yet.
+	Size    int64 `json:"size"`
+	Pending int64 `json:"pending"`
+}
+
+type s3Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+func (s S3Storage) loadSession(id uuid.UUID) (s3Session, error) {
+	var sess s3Session
+	b, err := s.get(s.sessionKey(id, "info"))
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			return sess, ErrSessionNotFound{Err: err}
+		}
+		return sess, fmt.Errorf("failed reading session metadata: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &sess); err != nil {
+		return sess, fmt.Errorf("failed decoding session metadata: %w", err)
+	}
+
+	return sess, nil
+}
+
+func (s S3Storage) saveSession(id uuid.UUID, sess s3Session) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("failed encoding session metadata: %w", err)
+	}
+	if err := s.put(s.sessionKey(id, "info"), b); err != nil {
+		return fmt.Errorf("failed writing session metadata: %w", err)
+	}
+	return nil
+}
+
+// removeSession aborts the session's multipart upload unless uploadID is empty and removes all of its objects, logging
+// any errors.
+func (s S3Storage) removeSession(id uuid.UUID, uploadID string) {
+	if uploadID != "" {
+		if err := s.client.AbortMultipartUpload(context.Background(), s.bucket, s.sessionKey(id, "data"), uploadID); err != nil &&
+			minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+			s.log.Error(err, "failed aborting multipart upload", "session", id)
+		}
+	}
+	for _, name := range []string{"data", "pending", "info"} {
+		s.removeQuietly(s.sessionKey(id, name))
+	}
+}
+
+// removeQuietly removes the object, logging any errors.
+func (s S3Storage) removeQuietly(key string) {
+	if err := s.client.Client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}); err != nil &&
+		!isNoSuchKey(err) {
+		s.log.Error(err, "failed removing object", "key", key)
+	}
+}
+
+func (s S3Storage) StartSession(ns, repo string) (uuid.UUID, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed generating session ID: %w", err)
+	}
+
+	uploadID, err := s.client.NewMultipartUpload(context.Background(), s.bucket, s.sessionKey(id, "data"), minio.PutObjectOptions{})
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed starting multipart upload: %w", err)
+	}
+
+	now := time.Now()
+	if err := s.saveSession(id, s3Session{
+		Namespace:    ns,
+		Repo:         repo,
+		Created:      now,
+		LastActivity: now,
+		UploadID:     uploadID,
+	}); err != nil {
+		s.removeSession(id, uploadID)
+		return uuid.UUID{}, err
+	}
+
+	return id, nil
+}
+
+func (s S3Storage) GetSessionInfo(id uuid.UUID) (SessionInfo, error) {
+	sess, err := s.loadSession(id)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	return SessionInfo{
+		Namespace:    sess.Namespace,
+		Repo:         sess.Repo,
+		Size:         sess.Size,
+		Created:      sess.Created,
+		LastActivity: sess.LastActivity,
+	}, nil
+}
+
+func (s S3Storage) StoreSessionData(id uuid.UUID, in io.Reader, cr string) (int64, error) {
+	crs, cre, err := parseRange(s.crRE, cr)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing content-range: %w", err)
+	}
+
+	sess, err := s.loadSession(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if crs >= 0 && cre > 0 && crs != sess.Size {
+		return 0, ErrOutOfOrderChunk{
+			expected: sess.Size,
+			actual:   crs,
+		}
+	}
+
+	rdr := in
+	if sess.Pending > 0 {
+		pending, err := s.client.Client.GetObject(context.Background(), s.bucket, s.sessionKey(id, "pending"), minio.GetObjectOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed opening pending session data: %w", err)
+		}
+		defer pending.Close()
+		rdr = io.MultiReader(pending, in)
+	}
+
+	// all data is uploaded in parts of the same size except for the remainder which is kept pending until the next
+	// chunk arrives or the session is closed.
+	buf := make([]byte, s.partSize)
+	var total int64
+	var remainder []byte
+	for {
+		n, err := io.ReadFull(rdr, buf)
+		total += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			remainder = buf[:n]
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed reading session data: %w", err)
+		}
+
+		part, err := s.client.PutObjectPart(context.Background(), s.bucket, s.sessionKey(id, "data"), sess.UploadID,
+			len(sess.Parts)+1, bytes.NewReader(buf), int64(n), minio.PutObjectPartOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed uploading part: %w", err)
+		}
+		sess.Parts = append(sess.Parts, s3Part{Number: part.PartNumber, ETag: part.ETag})
+	}
+
+	if len(remainder) > 0 {
+		if err := s.put(s.sessionKey(id, "pending"), remainder); err != nil {
+			return 0, fmt.Errorf("failed storing pending session data: %w", err)
+		}
+	}
+
+	sess.Size += total - sess.Pending
+	sess.Pending = int64(len(remainder))
+	sess.LastActivity = time.Now()
+	if err := s.saveSession(id, sess); err != nil {
+		return 0, err
+	}
+
+	s.log.V(7).Info("wrote data to session", "session", id, "bytes", total)
+
+	return sess.Size - 1, nil
+}
+
+func (s S3Storage) CloseSession(id uuid.UUID, bid types.BlobID) (types.Digest, error) {
+	sess, err := s.loadSession(id)
+	if err != nil {
+		return types.Digest{}, err
+	}
+
+	dataKey := s.sessionKey(id, "data")
+	if sess.Pending > 0 {
+		pending, err := s.get(s.sessionKey(id, "pending"))
+		if err != nil {
+			return types.Digest{}, fmt.Errorf("failed reading pending session data: %w", err)
+		}
+		part, err := s.client.PutObjectPart(context.Background(), s.bucket, dataKey, sess.UploadID,
+			len(sess.Parts)+1, bytes.NewReader(pending), int64(len(pending)), minio.PutObjectPartOptions{})
+		if err != nil {
+			return types.Digest{}, fmt.Errorf("failed uploading last part: %w", err)
+		}
+		sess.Parts = append(sess.Parts, s3Part{Number: part.PartNumber, ETag: part.ETag})
+	}
+
+	if len(sess.Parts) == 0 {
+		// multipart uploads can't be empty.
+		if err := s.client.AbortMultipartUpload(context.Background(), s.bucket, dataKey, sess.UploadID); err != nil {
+			return types.Digest{}, fmt.Errorf("failed aborting multipart upload: %w", err)
+		}
+		if err := s.put(dataKey, nil); err != nil {
+			return types.Digest{}, fmt.Errorf("failed creating empty blob: %w", err)
+		}
+	} else {
+		parts := make([]minio.CompletePart, len(sess.Parts))
+		for idx, p := range sess.Parts {
+			parts[idx] = minio.CompletePart{PartNumber: p.Number, ETag: p.ETag}
+		}
+		if _, err := s.client.CompleteMultipartUpload(context.Background(), s.bucket, dataKey, sess.UploadID, parts,
+			minio.PutObjectOptions{}); err != nil {
+			return types.Digest{}, fmt.Errorf("failed completing multipart upload: %w", err)
+		}
+	}
+
+	dig, err := s.digest(dataKey, digestAlgo(bid.Digest))
+	if err != nil {
+		return types.Digest{}, err
+	}
+
+	if bid.Digest != (types.Digest{}) && bid.Digest != dig {
+		// the uploaded data is useless so we discard the whole session.
+		s.removeSession(id, "")
+		return types.Digest{}, ErrDigestMismatch{Expected: bid.Digest, Actual: dig}
+	}
+
+	if err := s.commitBlob(dataKey, bid, dig); err != nil {
+		return types.Digest{}, err
+	}
+
+	s.removeSession(id, "")
+
+	return dig, nil
+}
+
+func (s S3Storage) CancelSession(id uuid.UUID) error {
+	sess, err := s.loadSession(id)
+	if err != nil {
+		return err
+	}
+
+	s.removeSession(id, sess.UploadID)
+
+	return nil
+}
+
+// ExpireSessions removes all sessions that haven't received any data since before as well as the temporary objects of
+// blob uploads that have been left behind since then, e.g. by a crashed registry.
+func (s S3Storage) ExpireSessions(before time.Time) (int, error) {
+	uploadDir := s.key(uploadDirName)
+	objs, err := s.listObjects(uploadDir + "/")
+	if err != nil {
+		return 0, fmt.Errorf("failed listing upload sessions: %w", err)
+	}
+
+	var n int
+	for _, obj := range objs {
+		k := obj.Key
+		if path.Dir(k) == uploadDir && strings.HasPrefix(path.Base(k), "_") {
+			if obj.LastModified.Before(before) {
+				s.log.V(5).Info("removing stale temporary upload object", "key", k, "lastModified", obj.LastModified)
+				s.removeQuietly(k)
+			}
+			continue
+		}
+		if path.Base(k) != "info" {
+			continue
+		}
+		id, err := uuid.Parse(path.Base(path.Dir(k)))
+		if err != nil {
+			continue
+		}
+
+		sess, err := s.loadSession(id)
+		if err != nil {
+			if errors.As(err, &ErrSessionNotFound{}) {
+				continue
+			}
+			return n, err
+		}
+		if !sess.LastActivity.Before(before) {
+			continue
+		}
+
+		s.log.V(5).Info("expiring upload session", "session", id, "lastActivity", sess.LastActivity)
+		s.removeSession(id, sess.UploadID)
+		n++
+	}
+
+	return n, nil
+}
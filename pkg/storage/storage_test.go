@@ -4,146 +4,93 @@
 package storage_test
 
 import (
-	"bytes"
-	"errors"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	. "github.com/onsi/gomega"
-	"github.com/onsi/gomega/gbytes"
 
 	"github.com/makkes/garage/pkg/storage"
-	"github.com/makkes/garage/pkg/types"
+	"github.com/makkes/garage/pkg/storage/storagetest"
 )
 
-var impls = map[string]func(*testing.T) storage.Storage{
-	"file storage": func(t *testing.T) storage.Storage {
-		dir := t.TempDir()
-		s, _ := storage.NewFileStorage(dir, logr.Discard())
+func TestFileStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewFileStorage(t.TempDir(), logr.Discard())
+		NewWithT(t).Expect(err).NotTo(HaveOccurred(), "creating file storage failed")
 		return s
-	},
-	"mem storage": func(_ *testing.T) storage.Storage {
-		return storage.NewMemStorage()
-	},
+	})
 }
 
-func TestFetchByTagAndDigestReturnsExpectedData(t *testing.T) {
-	for impl, ctor := range impls {
-		t.Run(impl, func(t *testing.T) {
-			g := NewWithT(t)
-			store := ctor(t)
-
-			// Given
-
-			dig := types.Digest{
-				Algo: string(types.AlgoSHA256),
-				Enc:  "7a38bf81f383f69433ad6e900d35b3e2385593f76a7b7ab5d4355b8ba41ee24b",
-			}
-
-			mdata := `{"foo":"bar"}`
-			mid := types.ManifestID{
-				Namespace: "foo-ns",
-				Repo:      "bar-repo",
-				Tag:       stringPtr("baz-tag"),
-				Digest:    &dig,
-			}
-			g.Expect(store.StoreManifest(mid, strings.NewReader(mdata))).To(Succeed(), "storing manifest failed")
-
-			// When (fetch by tag)
-
-			mid.Digest = nil
-
-			// Then
-
-			g.Expect(store.Has(mid)).To(BeTrue(), "Has returned unexpected result for tag")
-
-			rdr, err := store.FetchManifest(mid)
-			g.Expect(err).NotTo(HaveOccurred(), "fetch failed for tag")
-			g.Eventually(gbytes.BufferReader(rdr)).Should(gbytes.Say(mdata), "unexpected data in returned manifest from tag")
-
-			// When (fetch by digest)
-
-			mid.Digest = &dig
-			mid.Tag = nil
-
-			g.Expect(store.Has(mid)).To(BeTrue(), "Has returned unexpected result for digest")
-
-			rdr, err = store.FetchManifest(mid)
-			g.Expect(err).NotTo(HaveOccurred(), "fetch failed for digest")
-			g.Eventually(gbytes.BufferReader(rdr)).Should(gbytes.Say(mdata), "unexpected data in returned manifest from")
-		})
-	}
+func TestMemStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewMemStorage()
+	})
 }
 
-func TestFetchBlobReturnsCorrectData(t *testing.T) {
-	for impl, ctor := range impls {
-		t.Run(impl, func(t *testing.T) {
-			g := NewWithT(t)
-			store := ctor(t)
-
-			// Given
-
-			bid := types.BlobID{
-				Namespace: "foo",
-				Repo:      "bar",
-				Digest: types.Digest{
-					Algo: string(types.AlgoSHA256),
-					Enc:  "596f4162a52f315b2ad0fa53fd30a2769d02a41ed7439123790966eee4ceb5cd",
-				},
-			}
-			blob := []byte{42, 42, 42}
-
-			g.Expect(store.StoreBlob(bid, bytes.NewReader(blob))).To(Equal(bid.Digest), "storing blob failed")
-
-			// When
-
-			rdr, bs, err := store.FetchBlob(bid)
-
-			// Then
-
-			g.Expect(err).NotTo(HaveOccurred(), "FetchBlob returned unexpected error")
-			g.Expect(bs.Size).To(Equal(int64(3)), "unexpected size in BlobStat")
-
-			dat := make([]byte, 100)
-			n, err := rdr.Read(dat)
-
-			g.Expect(err).NotTo(HaveOccurred(), "unexpected error when reading blob data")
-			g.Expect(n).To(Equal(3), "unexpected number of bytes read from blob reader")
-			g.Expect(dat[:3]).To(Equal(blob))
-		})
-	}
+// newS3Storage returns an S3Storage using an in-memory stand-in for S3 that stores all data in backend.
+func newS3Storage(t *testing.T, backend *s3mem.Backend) storage.S3Storage {
+	g := NewWithT(t)
+
+	// the stand-in doesn't understand the streaming signatures used over plain HTTP.
+	srv := httptest.NewTLSServer(gofakes3.New(backend).Server())
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).NotTo(HaveOccurred(), "parsing server URL failed")
+
+	s, err := storage.NewS3Storage(storage.WithMinPartSize(storage.S3Options{
+		Endpoint:  u.Host,
+		Region:    "us-east-1",
+		Bucket:    "registry",
+		Prefix:    "garage",
+		PathStyle: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+		// tiny parts make chunked uploads span several of them.
+		PartSize:  4,
+		Transport: srv.Client().Transport,
+	}, 1), logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred(), "creating S3 storage failed")
+	return s
 }
 
-func TestFetchBlobDoesntReturnBlobFromOtherRepo(t *testing.T) {
-	for impl, ctor := range impls {
-		t.Run(impl, func(t *testing.T) {
-			g := NewWithT(t)
-			store := ctor(t)
-
-			// Given
+func TestS3StorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		backend := s3mem.New()
+		NewWithT(t).Expect(backend.CreateBucket("registry")).To(Succeed(), "creating bucket failed")
+		return newS3Storage(t, backend)
+	})
+}
 
-			bid := types.BlobID{
-				Namespace: "foo",
-				Repo:      "bar",
-				Digest: types.Digest{
-					Algo: string(types.AlgoSHA256),
-					Enc:  "596f4162a52f315b2ad0fa53fd30a2769d02a41ed7439123790966eee4ceb5cd",
-				},
-			}
-			blob := []byte{42, 42, 42}
+func TestS3StorageRejectsSmallParts(t *testing.T) {
+	_, err := storage.NewS3Storage(storage.S3Options{Bucket: "registry", PartSize: storage.S3MinPartSize - 1}, logr.Discard())
+	NewWithT(t).Expect(err).To(MatchError(ContainSubstring("part size must be at least 5242880 bytes")))
+}
 
-			g.Expect(store.StoreBlob(bid, bytes.NewReader(blob))).To(Equal(bid.Digest), "storing blob failed")
+func TestS3StorageExpiresTemporaryObjects(t *testing.T) {
+	g := NewWithT(t)
 
-			// When
+	backend := s3mem.New()
+	g.Expect(backend.CreateBucket("registry")).To(Succeed(), "creating bucket failed")
+	s := newS3Storage(t, backend)
 
-			bid.Repo = "another-one"
-			blobRdr, _, err := store.FetchBlob(bid)
+	tmpKey := "garage/_uploads/_" + uuid.NewString()
+	_, err := backend.PutObject("registry", tmpKey, nil, strings.NewReader("left behind"), 11)
+	g.Expect(err).NotTo(HaveOccurred(), "creating temporary object failed")
 
-			// Then
+	_, err = s.ExpireSessions(time.Now().Add(-time.Hour))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = backend.HeadObject("registry", tmpKey)
+	g.Expect(err).NotTo(HaveOccurred(), "recent temporary object should have been kept")
 
-			g.Expect(blobRdr).To(BeNil(), "blob reader should have been nil")
-			g.Expect(errors.As(err, &storage.ErrNotFound{})).To(BeTrue(), "unexpected error returned")
-		})
-	}
+	_, err = s.ExpireSessions(time.Now().Add(time.Hour))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = backend.HeadObject("registry", tmpKey)
+	g.Expect(gofakes3.HasErrorCode(err, gofakes3.ErrNoSuchKey)).To(BeTrue(), "stale temporary object should have been removed")
 }
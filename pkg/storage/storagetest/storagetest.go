@@ -0,0 +1,523 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package storagetest provides a conformance test suite for implementations of storage.Storage.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/makkes/garage/pkg/storage"
+	"github.com/makkes/garage/pkg/types"
+)
+
+// Run runs the conformance test suite against the storage returned by newStore. newStore is called once for every
+// test and needs to return an empty storage.
+func Run(t *testing.T, newStore func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(*testing.T, storage.Storage)
+	}{
+		{"StoreAndFetchBlob", testStoreAndFetchBlob},
+		{"StoreBlobFailsWithWrongDigest", testStoreBlobFailsWithWrongDigest},
+		{"BlobsAreScopedToRepository", testBlobsAreScopedToRepository},
+		{"MountBlob", testMountBlob},
+		{"DeleteBlob", testDeleteBlob},
+		{"HasBlob", testHasBlob},
+		{"ChunkedSession", testChunkedSession},
+		{"OutOfOrderChunk", testOutOfOrderChunk},
+		{"CloseSessionFailsWithWrongDigest", testCloseSessionFailsWithWrongDigest},
+		{"CancelSession", testCancelSession},
+		{"ExpireSessions", testExpireSessions},
+		{"UnknownSession", testUnknownSession},
+		{"ManifestByTagAndDigest", testManifestByTagAndDigest},
+		{"StoreManifestFailsWithWrongDigest", testStoreManifestFailsWithWrongDigest},
+		{"StoreManifestChecksReferences", testStoreManifestChecksReferences},
+		{"DeleteManifest", testDeleteManifest},
+		{"Tags", testTags},
+		{"Repositories", testRepositories},
+		{"Referrers", testReferrers},
+		{"ConcurrentAccess", testConcurrentAccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func digestOf(g Gomega, data []byte) types.Digest {
+	dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred(), "calculating digest failed")
+	return dig
+}
+
+func storeBlob(g Gomega, store storage.Storage, ns, repo string, data []byte) types.BlobID {
+	bid := types.BlobID{Namespace: ns, Repo: repo, Digest: digestOf(g, data)}
+	g.Expect(store.StoreBlob(bid, bytes.NewReader(data))).To(Equal(bid.Digest), "storing blob failed")
+	return bid
+}
+
+func storeManifest(g Gomega, store storage.Storage, ns, repo, tag string, data []byte) types.Digest {
+	dig := digestOf(g, data)
+	mid := types.ManifestID{Namespace: ns, Repo: repo, Digest: &dig}
+	if tag != "" {
+		mid.Tag = &tag
+	}
+	g.Expect(store.StoreManifest(mid, bytes.NewReader(data), storage.References{})).To(Succeed(), "storing manifest failed")
+	return dig
+}
+
+func expectBlob(g Gomega, store storage.Storage, bid types.BlobID, data []byte) {
+	rdr, bs, err := store.FetchBlob(bid)
+	g.Expect(err).NotTo(HaveOccurred(), "fetching blob failed")
+	defer rdr.Close()
+	g.Expect(bs.Size).To(Equal(int64(len(data))), "unexpected size in BlobStat")
+	g.Expect(io.ReadAll(rdr)).To(Equal(data), "unexpected blob data")
+}
+
+func expectNotFound(g Gomega, err error) {
+	g.ExpectWithOffset(1, errors.As(err, &storage.ErrNotFound{})).To(BeTrue(), "unexpected error returned: %v", err)
+}
+
+func expectSessionNotFound(g Gomega, err error) {
+	g.ExpectWithOffset(1, errors.As(err, &storage.ErrSessionNotFound{})).To(BeTrue(), "unexpected error returned: %v", err)
+}
+
+func testStoreAndFetchBlob(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	data := []byte("some blob")
+	bid := storeBlob(g, store, "foo", "bar", data)
+	expectBlob(g, store, bid, data)
+
+	rdr, _, err := store.FetchBlob(bid)
+	g.Expect(err).NotTo(HaveOccurred(), "fetching blob failed")
+	defer rdr.Close()
+	g.Expect(rdr.Seek(5, io.SeekStart)).To(Equal(int64(5)), "seeking in blob failed")
+	g.Expect(io.ReadAll(rdr)).To(Equal([]byte("blob")), "unexpected blob data after seeking")
+
+	// blobs can be stored without knowing their digest upfront.
+	bid.Digest = types.Digest{}
+	g.Expect(store.StoreBlob(bid, bytes.NewReader(data))).To(Equal(digestOf(g, data)))
+}
+
+func testStoreBlobFailsWithWrongDigest(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	bid := types.BlobID{Namespace: "foo", Repo: "bar", Digest: digestOf(g, []byte("expected"))}
+	_, err := store.StoreBlob(bid, strings.NewReader("actual"))
+	g.Expect(errors.As(err, &storage.ErrDigestMismatch{})).To(BeTrue(), "unexpected error returned: %v", err)
+
+	_, _, err = store.FetchBlob(bid)
+	expectNotFound(g, err)
+}
+
+func testBlobsAreScopedToRepository(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	bid := storeBlob(g, store, "foo", "bar", []byte("some blob"))
+
+	bid.Repo = "another-one"
+	rdr, _, err := store.FetchBlob(bid)
+	g.Expect(rdr).To(BeNil(), "blob reader should have been nil")
+	expectNotFound(g, err)
+}
+
+func testMountBlob(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	data := []byte("some blob")
+	src := storeBlob(g, store, "foo", "bar", data)
+
+	dst := types.BlobID{Namespace: "foo", Repo: "baz", Digest: src.Digest}
+	g.Expect(store.MountBlob(dst, "foo", "bar")).To(Succeed(), "mounting blob failed")
+	expectBlob(g, store, dst, data)
+
+	dst.Repo = "qux"
+	expectNotFound(g, store.MountBlob(dst, "foo", "does-not-exist"))
+	_, _, err := store.FetchBlob(dst)
+	expectNotFound(g, err)
+}
+
+func testDeleteBlob(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	data := []byte("some blob")
+	bid := storeBlob(g, store, "foo", "bar", data)
+	other := storeBlob(g, store, "foo", "baz", data)
+
+	g.Expect(store.DeleteBlob(bid)).To(Succeed(), "deleting blob failed")
+
+	_, _, err := store.FetchBlob(bid)
+	expectNotFound(g, err)
+	expectNotFound(g, store.DeleteBlob(bid))
+
+	// deleting a blob from one repository doesn't affect other repositories.
+	expectBlob(g, store, other, data)
+}
+
+func testHasBlob(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	bid := types.BlobID{Namespace: "foo", Repo: "bar", Digest: digestOf(g, []byte("some blob"))}
+	g.Expect(store.HasBlob(bid)).To(BeFalse(), "blob shouldn't exist before it has been stored")
+
+	bid = storeBlob(g, store, "foo", "bar", []byte("some blob"))
+	g.Expect(store.HasBlob(bid)).To(BeTrue(), "stored blob should exist")
+
+	other := bid
+	other.Repo = "baz"
+	g.Expect(store.HasBlob(other)).To(BeFalse(), "blob shouldn't exist in another repository")
+	g.Expect(store.MountBlob(other, "foo", "bar")).To(Succeed(), "mounting blob failed")
+	g.Expect(store.HasBlob(other)).To(BeTrue(), "mounted blob should exist")
+
+	g.Expect(store.DeleteBlob(bid)).To(Succeed(), "deleting blob failed")
+	g.Expect(store.HasBlob(bid)).To(BeFalse(), "deleted blob shouldn't exist")
+}
+
+func testChunkedSession(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	before := time.Now().Add(-time.Second)
+	sid, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+
+	info, err := store.GetSessionInfo(sid)
+	g.Expect(err).NotTo(HaveOccurred(), "retrieving session info failed")
+	g.Expect(info.Namespace).To(Equal("foo"))
+	g.Expect(info.Repo).To(Equal("bar"))
+	g.Expect(info.Size).To(BeZero())
+	g.Expect(info.Created).To(BeTemporally(">", before))
+
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("some "), "0-4")).To(Equal(int64(4)), "storing first chunk failed")
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("chunked "), "5-12")).To(Equal(int64(12)), "storing second chunk failed")
+	// the range is optional.
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("blob"), "")).To(Equal(int64(16)), "storing third chunk failed")
+
+	info, err = store.GetSessionInfo(sid)
+	g.Expect(err).NotTo(HaveOccurred(), "retrieving session info failed")
+	g.Expect(info.Size).To(Equal(int64(17)))
+	g.Expect(info.LastActivity).To(BeTemporally(">", before))
+
+	data := []byte("some chunked blob")
+	bid := types.BlobID{Namespace: "foo", Repo: "bar", Digest: digestOf(g, data)}
+	g.Expect(store.CloseSession(sid, bid)).To(Equal(bid.Digest), "closing session failed")
+	expectBlob(g, store, bid, data)
+
+	_, err = store.GetSessionInfo(sid)
+	expectSessionNotFound(g, err)
+}
+
+func testOutOfOrderChunk(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	sid, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("some "), "0-4")).To(Equal(int64(4)), "storing first chunk failed")
+
+	for _, cr := range []string{"4-8", "6-10"} {
+		_, err = store.StoreSessionData(sid, strings.NewReader("chunk"), cr)
+		g.Expect(errors.As(err, &storage.ErrOutOfOrderChunk{})).To(BeTrue(), "unexpected error returned for range %s: %v", cr, err)
+	}
+
+	info, err := store.GetSessionInfo(sid)
+	g.Expect(err).NotTo(HaveOccurred(), "retrieving session info failed")
+	g.Expect(info.Size).To(Equal(int64(5)), "out-of-order chunks must not be stored")
+
+	_, err = store.StoreSessionData(sid, strings.NewReader("chunk"), "invalid")
+	g.Expect(err).To(HaveOccurred(), "invalid range should have been rejected")
+}
+
+func testCloseSessionFailsWithWrongDigest(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	sid, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("actual"), "")).To(Equal(int64(5)), "storing data failed")
+
+	bid := types.BlobID{Namespace: "foo", Repo: "bar", Digest: digestOf(g, []byte("expected"))}
+	_, err = store.CloseSession(sid, bid)
+	g.Expect(errors.As(err, &storage.ErrDigestMismatch{})).To(BeTrue(), "unexpected error returned: %v", err)
+
+	_, _, err = store.FetchBlob(bid)
+	expectNotFound(g, err)
+	// the session's data is useless so it is discarded.
+	_, err = store.GetSessionInfo(sid)
+	expectSessionNotFound(g, err)
+}
+
+func testCancelSession(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	sid, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	g.Expect(store.StoreSessionData(sid, strings.NewReader("some data"), "")).To(Equal(int64(8)), "storing data failed")
+
+	g.Expect(store.CancelSession(sid)).To(Succeed(), "cancelling session failed")
+
+	_, err = store.GetSessionInfo(sid)
+	expectSessionNotFound(g, err)
+	expectSessionNotFound(g, store.CancelSession(sid))
+}
+
+func testExpireSessions(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	expired, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+
+	// file systems might only have a resolution of a second for modification times and their clock can lag behind
+	// time.Now() so the cutoff keeps a clear margin to the activity of both sessions.
+	time.Sleep(time.Second)
+	cutoff := time.Now()
+	time.Sleep(1500 * time.Millisecond)
+
+	active, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	g.Expect(store.StoreSessionData(active, strings.NewReader("some data"), "")).To(Equal(int64(8)), "storing data failed")
+
+	g.Expect(store.ExpireSessions(cutoff)).To(Equal(1), "unexpected number of expired sessions")
+
+	_, err = store.GetSessionInfo(expired)
+	expectSessionNotFound(g, err)
+	_, err = store.GetSessionInfo(active)
+	g.Expect(err).NotTo(HaveOccurred(), "active session should not have expired")
+}
+
+func testUnknownSession(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	sid, err := store.StartSession("foo", "bar")
+	g.Expect(err).NotTo(HaveOccurred(), "starting session failed")
+	g.Expect(store.CancelSession(sid)).To(Succeed(), "cancelling session failed")
+
+	_, err = store.StoreSessionData(sid, strings.NewReader("some data"), "")
+	expectSessionNotFound(g, err)
+	_, err = store.CloseSession(sid, types.BlobID{Namespace: "foo", Repo: "bar"})
+	expectSessionNotFound(g, err)
+}
+
+func testManifestByTagAndDigest(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	data := []byte(`{"foo":"bar"}`)
+	dig := storeManifest(g, store, "foo", "bar", "v1", data)
+
+	for _, mid := range []types.ManifestID{
+		{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1")},
+		{Namespace: "foo", Repo: "bar", Digest: &dig},
+	} {
+		g.Expect(store.Has(mid)).To(BeTrue(), "manifest %s not found", mid.Ref())
+
+		rdr, err := store.FetchManifest(mid)
+		g.Expect(err).NotTo(HaveOccurred(), "fetching manifest %s failed", mid.Ref())
+		g.Expect(io.ReadAll(rdr)).To(Equal(data), "unexpected data in manifest %s", mid.Ref())
+		rdr.Close()
+	}
+
+	// manifests are blobs, too.
+	expectBlob(g, store, types.BlobID{Namespace: "foo", Repo: "bar", Digest: dig}, data)
+
+	for _, mid := range []types.ManifestID{
+		{Namespace: "foo", Repo: "bar", Tag: stringPtr("v2")},
+		{Namespace: "foo", Repo: "baz", Tag: stringPtr("v1")},
+		{Namespace: "foo", Repo: "baz", Digest: &dig},
+	} {
+		g.Expect(store.Has(mid)).To(BeFalse(), "manifest %s/%s:%s should not exist", mid.Namespace, mid.Repo, mid.Ref())
+		_, err := store.FetchManifest(mid)
+		expectNotFound(g, err)
+		expectNotFound(g, store.DeleteManifest(mid))
+	}
+
+	// a tag can be moved to another manifest.
+	newData := []byte(`{"foo":"baz"}`)
+	storeManifest(g, store, "foo", "bar", "v1", newData)
+	rdr, err := store.FetchManifest(types.ManifestID{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1")})
+	g.Expect(err).NotTo(HaveOccurred(), "fetching moved tag failed")
+	defer rdr.Close()
+	g.Expect(io.ReadAll(rdr)).To(Equal(newData), "tag should point to the new manifest")
+}
+
+func testStoreManifestFailsWithWrongDigest(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	dig := digestOf(g, []byte("expected"))
+	mid := types.ManifestID{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1"), Digest: &dig}
+	err := store.StoreManifest(mid, strings.NewReader("actual"), storage.References{})
+	g.Expect(errors.As(err, &storage.ErrDigestMismatch{})).To(BeTrue(), "unexpected error returned: %v", err)
+	g.Expect(store.Has(mid)).To(BeFalse(), "manifest should not have been stored")
+
+	mid.Digest = nil
+	g.Expect(store.StoreManifest(mid, strings.NewReader("actual"), storage.References{})).NotTo(Succeed(), "manifests without digest must be rejected")
+}
+
+func testStoreManifestChecksReferences(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	layer := storeBlob(g, store, "foo", "bar", []byte("layer"))
+	child := storeManifest(g, store, "foo", "bar", "", []byte(`{"child":true}`))
+	other := storeBlob(g, store, "foo", "baz", []byte("other"))
+	missing := digestOf(g, []byte("missing"))
+
+	data := []byte(`{"foo":"bar"}`)
+	dig := digestOf(g, data)
+	mid := types.ManifestID{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1"), Digest: &dig}
+	err := store.StoreManifest(mid, bytes.NewReader(data), storage.References{
+		Blobs: []types.Digest{layer.Digest, missing, other.Digest},
+		// blobs aren't manifests.
+		Manifests: []types.Digest{child, layer.Digest},
+	})
+	var unknown storage.ErrReferencesUnknown
+	g.Expect(errors.As(err, &unknown)).To(BeTrue(), "unexpected error returned: %v", err)
+	g.Expect(unknown.Digests).To(ConsistOf(missing, other.Digest, layer.Digest))
+	g.Expect(store.Has(mid)).To(BeFalse(), "manifest should not have been stored")
+
+	g.Expect(store.StoreManifest(mid, bytes.NewReader(data), storage.References{
+		Blobs:     []types.Digest{layer.Digest},
+		Manifests: []types.Digest{child},
+	})).To(Succeed(), "storing manifest failed")
+	g.Expect(store.Has(mid)).To(BeTrue(), "manifest should have been stored")
+}
+
+func testDeleteManifest(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	dig := storeManifest(g, store, "foo", "bar", "v1", []byte(`{"foo":"bar"}`))
+	byTag := types.ManifestID{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1")}
+	byDigest := types.ManifestID{Namespace: "foo", Repo: "bar", Digest: &dig}
+
+	g.Expect(store.DeleteManifest(byTag)).To(Succeed(), "deleting tag failed")
+	g.Expect(store.Has(byTag)).To(BeFalse(), "tag should have been deleted")
+	g.Expect(store.Has(byDigest)).To(BeTrue(), "deleting a tag must not delete the manifest")
+	_, err := store.FetchManifest(byTag)
+	expectNotFound(g, err)
+	expectNotFound(g, store.DeleteManifest(byTag))
+
+	g.Expect(store.DeleteManifest(byDigest)).To(Succeed(), "deleting manifest failed")
+	g.Expect(store.Has(byDigest)).To(BeFalse(), "manifest should have been deleted")
+	_, err = store.FetchManifest(byDigest)
+	expectNotFound(g, err)
+	expectNotFound(g, store.DeleteManifest(byDigest))
+}
+
+func testTags(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	_, err := store.Tags("foo", "bar")
+	expectNotFound(g, err)
+
+	for _, tag := range []string{"v2", "latest", "v1"} {
+		storeManifest(g, store, "foo", "bar", tag, []byte(fmt.Sprintf(`{"tag":%q}`, tag)))
+	}
+	storeManifest(g, store, "foo", "baz", "other", []byte(`{}`))
+
+	g.Expect(store.Tags("foo", "bar")).To(Equal([]string{"latest", "v1", "v2"}))
+
+	g.Expect(store.DeleteManifest(types.ManifestID{Namespace: "foo", Repo: "bar", Tag: stringPtr("v1")})).To(Succeed())
+	g.Expect(store.Tags("foo", "bar")).To(Equal([]string{"latest", "v2"}))
+}
+
+func testRepositories(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	g.Expect(store.Repositories()).To(BeEmpty(), "store should be empty initially")
+
+	storeBlob(g, store, "foo", "bar", []byte{42})
+	storeBlob(g, store, "foo/bar", "baz", []byte{42})
+	storeManifest(g, store, "another", "one", "v1", []byte(`{}`))
+
+	g.Expect(store.Repositories()).To(Equal([]string{"another/one", "foo/bar", "foo/bar/baz"}))
+}
+
+func testReferrers(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	subject := digestOf(g, []byte("subject"))
+	data := []byte(`{"foo":"bar"}`)
+	dig := storeManifest(g, store, "foo", "bar", "", data)
+	desc := types.Descriptor{
+		MediaType:    types.MediaTypeImageManifest,
+		Digest:       dig,
+		Size:         int64(len(data)),
+		ArtifactType: "application/example",
+	}
+	g.Expect(store.StoreReferrer("foo", "bar", subject, desc)).To(Succeed(), "storing referrer failed")
+
+	g.Expect(store.Referrers("foo", "bar", subject)).To(Equal([]types.Descriptor{desc}))
+	g.Expect(store.Referrers("foo", "another-one", subject)).To(BeEmpty(), "referrers must be scoped to their repository")
+	g.Expect(store.Referrers("foo", "bar", dig)).To(BeEmpty())
+
+	// referrers whose manifest has been deleted aren't returned.
+	g.Expect(store.DeleteManifest(types.ManifestID{Namespace: "foo", Repo: "bar", Digest: &dig})).To(Succeed())
+	g.Expect(store.Referrers("foo", "bar", subject)).To(BeEmpty())
+}
+
+func testConcurrentAccess(t *testing.T, store storage.Storage) {
+	g := NewWithT(t)
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*n)
+	for i := range n {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			_, err := store.StoreBlob(types.BlobID{Namespace: "foo", Repo: fmt.Sprintf("repo-%d", i)}, strings.NewReader("shared blob"))
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf(`{"n":%d}`, i))
+			dig, err := types.NewDigest(types.AlgoSHA256, bytes.NewReader(data))
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- store.StoreManifest(types.ManifestID{Namespace: "foo", Repo: "manifests", Tag: stringPtr(fmt.Sprintf("v%d", i)), Digest: &dig},
+				bytes.NewReader(data), storage.References{})
+		}()
+		go func() {
+			defer wg.Done()
+			sid, err := store.StartSession("foo", "sessions")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := store.StoreSessionData(sid, strings.NewReader(fmt.Sprintf("session %d", i)), ""); err != nil {
+				errs <- err
+				return
+			}
+			_, err = store.CloseSession(sid, types.BlobID{Namespace: "foo", Repo: "sessions"})
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := store.Repositories()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	g.Expect(store.Repositories()).To(HaveLen(n+2), "unexpected number of repositories")
+	g.Expect(store.Tags("foo", "manifests")).To(HaveLen(n), "unexpected number of tags")
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
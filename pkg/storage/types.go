@@ -6,6 +6,7 @@ package storage
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -36,24 +37,114 @@ func (e ErrOutOfOrderChunk) Error() string {
 	return fmt.Sprintf("upload chunk out of order: expected %d but got %d", e.expected, e.actual)
 }
 
+type ErrDigestMismatch struct {
+	Expected, Actual types.Digest
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digests don't match: provided: %s, calculated: %s", e.Expected, e.Actual)
+}
+
+// ErrReferencesUnknown is returned when storing a manifest that refers to blobs or manifests that aren't stored in its
+// repository.
+type ErrReferencesUnknown struct {
+	Digests []types.Digest
+}
+
+func (e ErrReferencesUnknown) Error() string {
+	return fmt.Sprintf("manifest references unknown blobs or manifests: %v", e.Digests)
+}
+
+// References are the blobs and manifests a manifest refers to.
+type References struct {
+	Blobs     []types.Digest
+	Manifests []types.Digest
+}
+
 type BlobStat struct {
 	Size int64
 }
 
+// SessionInfo describes the state of an upload session.
+type SessionInfo struct {
+	// Namespace and Repo identify the repository the session has been started for.
+	Namespace, Repo string
+	// Size is the number of bytes uploaded so far.
+	Size int64
+	// Created is the time the session has been started.
+	Created time.Time
+	// LastActivity is the time data has last been uploaded to the session.
+	LastActivity time.Time
+}
+
 type Storage interface {
 	StoreBlob(types.BlobID, io.Reader) (types.Digest, error)
-	FetchBlob(types.BlobID) (io.ReadCloser, BlobStat, error)
+	FetchBlob(types.BlobID) (io.ReadSeekCloser, BlobStat, error)
 	DeleteBlob(types.BlobID) error
+	MountBlob(bid types.BlobID, fromNs, fromRepo string) error
+	// HasBlob reports whether the blob is linked into the repository identified by bid without opening it.
+	HasBlob(types.BlobID) (bool, error)
 
-	StartSession() (uuid.UUID, error)
-	GetSessionInfo(uuid.UUID) (int64, error)
+	// StartSession starts an upload session for a blob in the repository identified by ns and repo.
+	StartSession(ns, repo string) (uuid.UUID, error)
+	GetSessionInfo(uuid.UUID) (SessionInfo, error)
+	// StoreSessionData appends the data to the session, verifying that it starts at the offset given by the optional
+	// content range of the form 'start-end'. It returns the offset of the last byte uploaded to the session so far.
 	StoreSessionData(uuid.UUID, io.Reader, string) (int64, error)
 	CloseSession(uuid.UUID, types.BlobID) (types.Digest, error)
+	// CancelSession discards the session and all data uploaded to it.
+	CancelSession(uuid.UUID) error
+	// ExpireSessions removes all sessions without any activity since before and returns the number of removed
+	// sessions.
+	ExpireSessions(before time.Time) (int, error)
 
-	StoreManifest(types.ManifestID, io.Reader) error
+	// StoreManifest stores the manifest identified by mid which needs to have a digest. It fails with
+	// ErrReferencesUnknown if any of refs isn't stored in the manifest's repository. Checking the references and storing
+	// the manifest is atomic with regard to garbage collection.
+	StoreManifest(mid types.ManifestID, data io.Reader, refs References) error
 	FetchManifest(types.ManifestID) (io.ReadCloser, error)
 	Has(types.ManifestID) (bool, error)
 	DeleteManifest(types.ManifestID) error
 
 	Tags(ns, repo string) ([]string, error)
+	Repositories() ([]string, error)
+
+	StoreReferrer(ns, repo string, subject types.Digest, desc types.Descriptor) error
+	Referrers(ns, repo string, subject types.Digest) ([]types.Descriptor, error)
+}
+
+// digestAlgo returns the algorithm to use for calculating the digest of content that is expected to have the digest
+// dig. SHA-256 is used if dig is empty.
+func digestAlgo(dig types.Digest) types.SupportedAlgos {
+	if dig.Algo == "" {
+		return types.AlgoSHA256
+	}
+	return types.SupportedAlgos(dig.Algo)
+}
+
+// missingReferences returns the digests of all blobs and manifests in refs that hasBlob and has report as not being
+// stored in the repository identified by ns and repo.
+func missingReferences(ns, repo string, refs References, hasBlob func(types.BlobID) (bool, error),
+	has func(types.ManifestID) (bool, error)) ([]types.Digest, error) {
+	var missing []types.Digest
+	for _, dig := range refs.Blobs {
+		ok, err := hasBlob(types.BlobID{Namespace: ns, Repo: repo, Digest: dig})
+		if err != nil {
+			return nil, fmt.Errorf("failed checking blob %s: %w", dig, err)
+		}
+		if !ok {
+			missing = append(missing, dig)
+		}
+	}
+	for _, dig := range refs.Manifests {
+		ok, err := has(types.ManifestID{Namespace: ns, Repo: repo, Digest: &dig})
+		if err != nil {
+			return nil, fmt.Errorf("failed checking manifest %s: %w", dig, err)
+		}
+		if !ok {
+			missing = append(missing, dig)
+		}
+	}
+
+	return missing, nil
 }
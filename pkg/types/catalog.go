@@ -0,0 +1,8 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+type Catalog struct {
+	Repositories []string `json:"repositories"`
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Max Jonas Werner
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+import "strings"
+
+const (
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// MediaTypeDockerForeignLayer denotes layers that are downloaded from the URLs in their descriptor instead of the
+	// registry.
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	// MediaTypePrefixNonDistributableLayer is the prefix of the media types of OCI layers that are downloaded from the
+	// URLs in their descriptor instead of the registry.
+	MediaTypePrefixNonDistributableLayer = "application/vnd.oci.image.layer.nondistributable."
+)
+
+// Descriptor describes the content a manifest refers to as specified by the OCI image spec.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       Digest            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	URLs         []string          `json:"urls,omitempty"`
+}
+
+// Distributable reports whether the content described by the descriptor is expected to be stored in the registry.
+func (d Descriptor) Distributable() bool {
+	return d.MediaType != MediaTypeDockerForeignLayer && !strings.HasPrefix(d.MediaType, MediaTypePrefixNonDistributableLayer)
+}
+
+// Index is an OCI image index.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
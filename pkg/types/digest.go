@@ -34,36 +34,87 @@ func ParseDigest(s string) (Digest, error) {
 		return Digest{}, fmt.Errorf("unexpected digest format %q", s)
 	}
 
-	if _, ok := digestCtors[parts[0]]; !ok {
+	ctor, ok := digestCtors[parts[0]]
+	if !ok {
 		return Digest{}, fmt.Errorf("%s is an unsupported algorithm", parts[0])
 	}
 
+	// the encoded part ends up in storage paths so it must be exactly what NewDigest would produce.
+	if len(parts[1]) != 2*ctor().Size() || !isLowerHex(parts[1]) {
+		return Digest{}, fmt.Errorf("invalid %s encoding %q", parts[0], parts[1])
+	}
+
 	return Digest{
 		Algo: parts[0],
 		Enc:  parts[1],
 	}, nil
 }
 
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func (d Digest) String() string {
 	return d.Algo + ":" + d.Enc
 }
 
 func NewDigest(alg SupportedAlgos, data io.Reader) (Digest, error) {
-	var h hash.Hash
+	d, err := NewDigester(alg)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	if _, err := io.Copy(d, data); err != nil {
+		return Digest{}, fmt.Errorf("failed preparing hash: %w", err)
+	}
+
+	return d.Digest(), nil
+}
+
+// Digester calculates the digest of all data written to it, e.g. while the data is being copied elsewhere.
+type Digester struct {
+	alg SupportedAlgos
+	h   hash.Hash
+}
 
+func NewDigester(alg SupportedAlgos) (Digester, error) {
 	ctor := digestCtors[string(alg)]
 	if ctor == nil {
-		return Digest{}, fmt.Errorf("unsupported algorithm %q requested", alg)
+		return Digester{}, fmt.Errorf("unsupported algorithm %q requested", alg)
 	}
 
-	h = ctor()
+	return Digester{
+		alg: alg,
+		h:   ctor(),
+	}, nil
+}
 
-	if _, err := io.Copy(h, data); err != nil {
-		return Digest{}, fmt.Errorf("failed preparing hash: %w", err)
-	}
+func (d Digester) Write(p []byte) (int, error) {
+	return d.h.Write(p)
+}
 
+// Digest returns the digest of the data written so far.
+func (d Digester) Digest() Digest {
 	return Digest{
-		Algo: string(alg),
-		Enc:  fmt.Sprintf("%x", h.Sum(nil)),
-	}, nil
+		Algo: string(d.alg),
+		Enc:  fmt.Sprintf("%x", d.h.Sum(nil)),
+	}
+}
+
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Digest) UnmarshalText(b []byte) error {
+	dig, err := ParseDigest(string(b))
+	if err != nil {
+		return err
+	}
+	*d = dig
+	return nil
 }
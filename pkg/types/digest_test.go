@@ -5,6 +5,7 @@ package types_test
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/opencontainers/go-digest"
@@ -26,3 +27,39 @@ func TestNewDigest(t *testing.T) {
 
 	t.Log(dig2.String())
 }
+
+func TestParseDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    string
+		valid bool
+	}{
+		{"sha256", "sha256:" + strings.Repeat("0a", 32), true},
+		{"sha512", "sha512:" + strings.Repeat("0a", 64), true},
+		{"path traversal", "sha256:../../../../../../escaped", false},
+		{"uppercase", "sha256:" + strings.Repeat("0A", 32), false},
+		{"too short", "sha256:" + strings.Repeat("0a", 31), false},
+		{"sha512 length for sha256", "sha256:" + strings.Repeat("0a", 64), false},
+		{"unsupported algorithm", "md5:" + strings.Repeat("0a", 16), false},
+		{"no encoding", "sha256", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dig, err := types.ParseDigest(tc.in)
+			if tc.valid {
+				if err != nil {
+					t.Fatalf("unexpected error parsing %q: %s", tc.in, err)
+				}
+				if dig.String() != tc.in {
+					t.Fatalf("%s != %s", dig.String(), tc.in)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("%q has been parsed successfully", tc.in)
+			}
+			if err := dig.UnmarshalText([]byte(tc.in)); err == nil {
+				t.Fatalf("%q has been unmarshaled successfully", tc.in)
+			}
+		})
+	}
+}
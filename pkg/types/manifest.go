@@ -19,3 +19,27 @@ func (m ManifestID) Ref() string {
 
 	return ""
 }
+
+// Manifest holds the fields of a manifest or index that the registry needs to interpret.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *Descriptor       `json:"config,omitempty"`
+	Layers        []Descriptor      `json:"layers,omitempty"`
+	Manifests     []Descriptor      `json:"manifests,omitempty"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// EffectiveArtifactType returns the artifact type of the manifest, falling back to the config's media type as
+// mandated by the OCI distribution spec for the referrers API.
+func (m Manifest) EffectiveArtifactType() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	if m.Config != nil {
+		return m.Config.MediaType
+	}
+	return ""
+}